@@ -0,0 +1,379 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+const (
+	// exportTTL is how long a finished export can be downloaded.
+	exportTTL = 7 * 24 * time.Hour
+	// exportTimeout is how long an export may stay pending, one that takes
+	// longer was lost with a restart and the user may start another.
+	exportTimeout = 15 * time.Minute
+)
+
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	vdtr := validator.New()
+
+	if data.ValidatePasswordPlainText(vdtr, input.Password); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	match, err := user.Password.Matches(input.Password)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !match {
+		vdtr.AddError("password", "is incorrect")
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	deletedAt, err := app.models.Users.ScheduleDeletion(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	_, err = app.models.Sessions.DeleteAllForUser(user.ID, uuid.Nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	deleteAt := deletedAt.Add(app.config.users.deletionGrace)
+	env := envelope{
+		"message":   "your account will be deleted, sign in again before then to keep it",
+		"delete_at": deleteAt,
+	}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.manager.closeUser(user.ID)
+}
+
+// purgeDeletedUsers anonymizes the accounts whose deletion grace period is
+// over.
+func (app *application) purgeDeletedUsers() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		userIDs, err := app.models.Users.GetDeletedBefore(time.Now().Add(-app.config.users.deletionGrace))
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"job": "purge deleted users"})
+		}
+		for _, userID := range userIDs {
+			err = app.purgeUser(userID)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"job":     "purge deleted users",
+					"user_id": userID.String(),
+				})
+			}
+		}
+
+		<-ticker.C
+	}
+}
+
+// purgeUser takes a deleted user out of their chats, passing on the chats
+// they owned, and then anonymizes the account.
+func (app *application) purgeUser(userID uuid.UUID) error {
+	user, err := app.models.Users.GetByID(userID)
+	if err != nil {
+		return err
+	}
+
+	chatIDs, err := app.models.Users.GetChatsID(user.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, chatID := range chatIDs {
+		chat := &data.Chat{ID: chatID}
+		err = app.models.Chats.GetChat(chat)
+		if err != nil && !errors.Is(err, data.ErrChatNotFound) {
+			return err
+		}
+
+		err = app.models.Chats.Leave(chatID, user.ID)
+		if err != nil && !errors.Is(err, data.ErrNotInChat) {
+			return err
+		}
+		if chat.OwnerID == user.ID && !chat.IsPrivate {
+			app.handOverChat(user, chat)
+		}
+
+		app.removeChatMember(chatID, user.ID, user.ID, "left")
+		app.sendSystemMessage(user, chatID, user.Name+" Deleted their account.", data.MessageLeft)
+	}
+
+	files, err := app.models.Users.Anonymize(user.ID)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		err = app.storage.Delete(file)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exportUserHandler responds with the user's current export, starting a new
+// one in the background when there is none.
+func (app *application) exportUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Exports.FailStale(user.ID, time.Now().Add(-exportTimeout))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	export, err := app.models.Exports.GetLatest(user.ID)
+	switch {
+	case err == nil:
+	case errors.Is(err, data.ErrExportNotFound):
+		export = &data.Export{
+			ID:        uuid.New(),
+			UserID:    user.ID,
+			ExpiresAt: time.Now().Add(exportTTL),
+		}
+		err = app.models.Exports.Insert(export)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(func() {
+			app.buildExport(export, user)
+		})
+	default:
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	status := http.StatusAccepted
+	env := envelope{"export": export}
+	if export.Status == data.ExportReady {
+		status = http.StatusOK
+		env["download_url"] = "/v1/user/export/download?id=" + export.ID.String()
+	}
+
+	err = app.writeJSON(w, status, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) downloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	exportIDString := r.URL.Query().Get("id")
+	exportID, err := uuid.Parse(exportIDString)
+	if err != nil || exportIDString == "" {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "Bad UUID")
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	export, err := app.models.Exports.Get(exportID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrExportNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if export.Status != data.ExportReady {
+		app.errorResponse(w, r, http.StatusConflict, "the export is not ready yet")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="gocha-export.zip"`)
+	w.Header().Set("Cache-Control", "private, no-store")
+	http.ServeFile(w, r, app.storage.Path(export.File))
+}
+
+// buildExport writes the archive for the export and emails the user once it
+// can be downloaded.
+func (app *application) buildExport(export *data.Export, user *data.User) {
+	export.Status = data.ExportReady
+
+	content, err := app.exportArchive(user)
+	if err == nil {
+		export.File, err = app.storage.Save(
+			path.Join("exports", export.ID.String()+".zip"),
+			content,
+		)
+	}
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"job":       "build export",
+			"export_id": export.ID.String(),
+		})
+		export.Status = data.ExportFailed
+		export.File = ""
+	}
+
+	err = app.models.Exports.Finish(export)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"job":       "build export",
+			"export_id": export.ID.String(),
+		})
+		return
+	}
+
+	if export.Status == data.ExportReady {
+		app.sendEmail(user.Email, "export_ready.tmpl", map[string]interface{}{
+			"name":      user.Name,
+			"exportID":  export.ID,
+			"expiresAt": export.ExpiresAt.Format(time.RFC1123),
+		})
+	}
+}
+
+// exportArchive zips up everything the user created: their profile, the
+// messages they sent, the chats they own, their reactions and the images
+// they uploaded.
+func (app *application) exportArchive(user *data.User) ([]byte, error) {
+	messages, err := app.models.Exports.Messages(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	chats, err := app.models.Exports.OwnedChats(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	reactions, err := app.models.Exports.Reactions(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	documents := []struct {
+		name    string
+		content interface{}
+	}{
+		{"profile.json", user},
+		{"messages.json", messages},
+		{"chats_owned.json", chats},
+		{"reactions.json", reactions},
+	}
+
+	attachments := map[string]string{}
+	if user.Avatar != "" {
+		attachments["attachments/avatar"+filepath.Ext(user.Avatar)] = user.Avatar
+	}
+	for _, chat := range chats {
+		if chat.Avatar != "" {
+			attachments["attachments/chats/"+chat.ID.String()+filepath.Ext(chat.Avatar)] = chat.Avatar
+		}
+	}
+
+	var buffer bytes.Buffer
+	archive := zip.NewWriter(&buffer)
+
+	for _, document := range documents {
+		content, err := json.MarshalIndent(document.content, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+
+		file, err := archive.Create(document.name)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = file.Write(content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for name, stored := range attachments {
+		content, err := os.ReadFile(app.storage.Path(stored))
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return nil, err
+		}
+
+		file, err := archive.Create(name)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = file.Write(content)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// purgeExpiredExports removes exports that can no longer be downloaded.
+func (app *application) purgeExpiredExports() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		files, err := app.models.Exports.PurgeExpired()
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"job": "purge expired exports"})
+		}
+		for _, file := range files {
+			err = app.storage.Delete(file)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"job": "purge expired exports"})
+			}
+		}
+
+		<-ticker.C
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/storage"
+)
+
+const maxAvatarBytes = 2 << 20
+
+// readAvatar reads a raw image request body, responding and returning nil
+// when it is missing or too large.
+func (app *application) readAvatar(w http.ResponseWriter, r *http.Request) []byte {
+	r.Body = http.MaxBytesReader(w, r.Body, maxAvatarBytes)
+	content, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			app.errorResponse(w, r, http.StatusRequestEntityTooLarge, "image must not be larger than 2MB")
+		default:
+			app.badRequestResponse(w, r, err)
+		}
+		return nil
+	}
+	if len(content) == 0 {
+		app.badRequestResponse(w, r, errors.New("body must not be empty"))
+		return nil
+	}
+	return content
+}
+
+func (app *application) uploadChatAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	chatIDString := r.URL.Query().Get("id")
+	chatID, err := uuid.Parse(chatIDString)
+	if err != nil || chatIDString == "" {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "Bad UUID")
+		return
+	}
+
+	chat := app.authorizeChatAdmin(w, r, chatID)
+	if chat == nil {
+		return
+	}
+
+	content := app.readAvatar(w, r)
+	if content == nil {
+		return
+	}
+
+	avatar, err := app.storage.SaveImage("chat-avatars", chat.ID.String(), content)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrUnsupportedImage):
+			app.errorResponse(w, r, http.StatusUnsupportedMediaType, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Chats.SetAvatar(chat.ID, avatar)
+	if err != nil {
+		// the chat is gone, so is any use for the file just stored
+		if avatar != chat.Avatar {
+			if deleteErr := app.storage.Delete(avatar); deleteErr != nil {
+				app.logError(r, deleteErr)
+			}
+		}
+		switch {
+		case errors.Is(err, data.ErrChatNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "Chat not found")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if chat.Avatar != "" && chat.Avatar != avatar {
+		err = app.storage.Delete(chat.Avatar)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+	chat.Avatar = avatar
+	chat.HasAvatar = true
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"chat": chat}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	user := app.contextGetUser(r)
+	app.chatUpdated(user, chat, []string{user.Name + " Changed the chat avatar."})
+}
+
+func (app *application) deleteChatAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	chatIDString := r.URL.Query().Get("id")
+	chatID, err := uuid.Parse(chatIDString)
+	if err != nil || chatIDString == "" {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "Bad UUID")
+		return
+	}
+
+	chat := app.authorizeChatAdmin(w, r, chatID)
+	if chat == nil {
+		return
+	}
+	if chat.Avatar == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Chats.SetAvatar(chat.ID, "")
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrChatNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "Chat not found")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.storage.Delete(chat.Avatar)
+	if err != nil {
+		app.logError(r, err)
+	}
+	chat.Avatar = ""
+	chat.HasAvatar = false
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"chat": chat}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	user := app.contextGetUser(r)
+	app.chatUpdated(user, chat, []string{user.Name + " Removed the chat avatar."})
+}
+
+func (app *application) getChatAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	chatIDString := r.URL.Query().Get("id")
+	chatID, err := uuid.Parse(chatIDString)
+	if err != nil || chatIDString == "" {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "Bad UUID")
+		return
+	}
+
+	chat := &data.Chat{ID: chatID}
+	err = app.models.Chats.GetChat(chat)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrChatNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if chat.IsPrivate {
+		user := app.contextGetUser(r)
+		err = app.models.Users.IsInChat(user.ID, chat.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrNotInChat):
+				app.errorResponse(w, r, http.StatusUnauthorized, err.Error())
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	if chat.Avatar == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	http.ServeFile(w, r, app.storage.Path(chat.Avatar))
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+func (app *application) listBlocksHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	blocked, err := app.models.Blocks.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"blocks": blocked}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) blockUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID   uuid.UUID `json:"user_id"`
+		Username string    `json:"username"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	vdtr := validator.New()
+
+	var blockedUser *data.User
+	if input.Username != "" {
+		blockedUser, err = app.models.Users.GetByUsername(input.Username)
+	} else {
+		blockedUser, err = app.models.Users.GetByID(input.UserID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound) && input.Username != "":
+			vdtr.AddError("username", "no user exists with this username")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		case errors.Is(err, data.ErrRecordNotFound):
+			vdtr.AddError("user_id", "no user exists with this id")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Blocks.Insert(user.ID, blockedUser.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrBlockSelf):
+			vdtr.AddError("user_id", err.Error())
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		case errors.Is(err, data.ErrAlreadyBlocked):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"blocked": blockedUser.PublicProfile()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.manager.setBlocked(user.ID, blockedUser.ID, true)
+}
+
+func (app *application) unblockUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID uuid.UUID `json:"user_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.Blocks.Delete(user.ID, input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotBlocked):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user was unblocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.manager.setBlocked(user.ID, input.UserID, false)
+}
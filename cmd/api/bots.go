@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+func (app *application) createBotHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name     string `json:"name"`
+		Username string `json:"username"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	bot := &data.Bot{
+		Name:     input.Name,
+		Username: data.NormalizeUsername(input.Username),
+		OwnerID:  user.ID,
+	}
+
+	vdtr := validator.New()
+
+	if data.ValidateBot(vdtr, bot); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	err = app.models.Bots.Insert(bot)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateUsername):
+			vdtr.AddError("username", "a user with this username already exists")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"bot": bot}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listBotsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	bots, err := app.models.Bots.GetAllForOwner(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"bots": bots}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// getOwnBot looks up one of the request user's bots. It writes the error
+// response itself and returns nil when there is no such bot.
+func (app *application) getOwnBot(w http.ResponseWriter, r *http.Request, botID uuid.UUID) *data.Bot {
+	bot, err := app.models.Bots.Get(botID, app.contextGetUser(r).ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrBotNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	return bot
+}
+
+// createAPIKeyHandler issues a key for the bot and adds the bot to the chats
+// the key is scoped to, which the request user has to be an admin of.
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		BotID       uuid.UUID   `json:"bot_id"`
+		Name        string      `json:"name"`
+		ChatIDs     []uuid.UUID `json:"chat_ids"`
+		Permissions []string    `json:"permissions"`
+		Expiry      *time.Time  `json:"expiry"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	key := &data.APIKey{
+		BotID:       input.BotID,
+		Name:        input.Name,
+		ChatIDs:     input.ChatIDs,
+		Permissions: input.Permissions,
+		Expiry:      input.Expiry,
+	}
+
+	vdtr := validator.New()
+
+	if data.ValidateAPIKey(vdtr, key); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	bot := app.getOwnBot(w, r, input.BotID)
+	if bot == nil {
+		return
+	}
+
+	user := app.contextGetUser(r)
+	for _, chatID := range key.ChatIDs {
+		chat := &data.Chat{ID: chatID}
+		err = app.models.Chats.GetChat(chat)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrChatNotFound):
+				vdtr.AddError("chat_ids", "no chat exists with id "+chatID.String())
+				app.failedValidationResponse(w, r, vdtr.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		if chat.IsPrivate {
+			vdtr.AddError("chat_ids", "bots cannot be added to private chats")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+			return
+		}
+
+		err = app.models.Users.IsAdmin(user.ID, chatID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrNotAdmin), errors.Is(err, data.ErrNotInChat):
+				app.errorResponse(
+					w,
+					r,
+					http.StatusForbidden,
+					"you must be an admin of every chat the key is scoped to",
+				)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	var joined []uuid.UUID
+	for _, chatID := range key.ChatIDs {
+		err = app.models.Chats.AddMember(chatID, bot.ID, false)
+		switch {
+		case err == nil:
+			joined = append(joined, chatID)
+		case errors.Is(err, data.ErrAlreadyMember):
+		case errors.Is(err, data.ErrBannedFromChat):
+			app.errorResponse(w, r, http.StatusForbidden, "the bot is banned from chat "+chatID.String())
+			return
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.Bots.NewKey(key)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	if len(joined) > 0 {
+		botUser, err := app.models.Users.GetByID(bot.ID)
+		if err != nil {
+			app.logError(r, err)
+			return
+		}
+		for _, chatID := range joined {
+			app.memberJoined(botUser, chatID)
+		}
+	}
+}
+
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	botID, err := uuid.Parse(r.URL.Query().Get("bot_id"))
+	if err != nil {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "Bad UUID")
+		return
+	}
+
+	bot := app.getOwnBot(w, r, botID)
+	if bot == nil {
+		return
+	}
+
+	keys, err := app.models.Bots.GetKeys(bot.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		BotID uuid.UUID `json:"bot_id"`
+		KeyID uuid.UUID `json:"key_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	bot := app.getOwnBot(w, r, input.BotID)
+	if bot == nil {
+		return
+	}
+
+	err = app.models.Bots.DeleteKey(input.KeyID, bot.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrAPIKeyNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "api key revoked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	// bot sockets carry the id of the key they were opened with
+	app.manager.closeSessions(bot.ID, input.KeyID)
+}
@@ -1,11 +1,11 @@
 package main
 
 import (
-	"database/sql"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/google/uuid"
 
@@ -19,6 +19,7 @@ func (app *application) createChatHandler(w http.ResponseWriter, r *http.Request
 		Name      string    `json:"name"`
 		IsPrivate bool      `json:"is_private"`
 		UserID    uuid.UUID `json:"user_id,omitempty"`
+		Username  string    `json:"username,omitempty"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -27,12 +28,17 @@ func (app *application) createChatHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if input.IsPrivate {
+		app.openDirectChat(w, r, input.UserID, input.Username)
+		return
+	}
+
 	requestUser := app.contextGetUser(r)
 
 	chat := &data.Chat{
-		OwnerID:   requestUser.ID,
-		Name:      input.Name,
-		IsPrivate: input.IsPrivate,
+		ID:      uuid.New(),
+		OwnerID: requestUser.ID,
+		Name:    input.Name,
 	}
 
 	vdtr := validator.New()
@@ -40,28 +46,6 @@ func (app *application) createChatHandler(w http.ResponseWriter, r *http.Request
 		app.failedValidationResponse(w, r, vdtr.Errors)
 		return
 	}
-	if input.IsPrivate {
-		user, err := app.models.Users.GetByID(input.UserID)
-		if err != nil {
-			switch {
-			case errors.Is(err, data.ErrRecordNotFound):
-				vdtr.AddError("user_id", "no user exists with this id")
-				app.failedValidationResponse(w, r, vdtr.Errors)
-				return
-			default:
-				app.serverErrorResponse(w, r, err)
-				return
-			}
-		}
-		if requestUser.ID == user.ID {
-			vdtr.AddError("user_id", "cannot create chat with self")
-			app.failedValidationResponse(w, r, vdtr.Errors)
-			return
-		}
-		chat.ID = input.UserID
-	} else {
-		chat.ID = uuid.New()
-	}
 
 	chat.CreatedAt, err = app.models.Chats.Insert(chat)
 	if err != nil {
@@ -86,104 +70,268 @@ func (app *application) createChatHandler(w http.ResponseWriter, r *http.Request
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
-	message := &data.Message{
-		UserID: requestUser.ID,
-		ChatID: chat.ID,
-		ID:     uuid.New(),
-		Content: data.Content{
-			NullString: sql.NullString{
-				Valid:  true,
-				String: requestUser.Name + " Created the chat.",
-			},
-		},
-		Type: data.Int32{
-			Int: sql.NullInt32{
-				Valid: true,
-				Int32: data.MessageJoined,
-			},
-		},
-	}
-	err = app.models.Messages.SendMessage(message)
+
+	app.manager.addToChat(chat.ID, requestUser.ID)
+	app.sendSystemMessage(
+		requestUser,
+		chat.ID,
+		requestUser.Name+" Created the chat.",
+		data.MessageJoined,
+	)
+}
+
+func (app *application) deleteChatHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatId uuid.UUID `json:"chat_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
 	if err != nil {
-		app.logger.PrintError(
-			err,
-			map[string]string{"error sending created chat message": err.Error()},
-		)
+		app.badRequestResponse(w, r, err)
 		return
 	}
 
 	user := app.contextGetUser(r)
 
-	if client, ok := app.manager.connectionClients[requestUser.ID]; ok {
-		var broadMessage NewMessageEvent
-		broadMessage.Message = message.Content.NullString.String
-		broadMessage.From = message.UserID
-		broadMessage.ChatID = message.ChatID
-		broadMessage.Sent = message.Sent.Sent.Time
-		broadMessage.ID = message.ID
-		broadMessage.UserName = user.Name
-
-		sendData, err := json.Marshal(broadMessage)
-		if err != nil {
-			app.logger.PrintError(
-				err,
-				map[string]string{"error marshaling created chat message": err.Error()},
-			)
+	deletedAt, err := app.models.Chats.Delete(user.ID, input.ChatId)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDeletionFailed):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "Unable to delete chat")
+			return
+		default:
+			app.serverErrorResponse(w, r, err)
 			return
 		}
+	}
+	purgeAt := deletedAt.Add(app.config.chats.deletionGrace)
+
+	err = app.writeJSON(
+		w,
+		http.StatusOK,
+		envelope{"message": "deleted successfully!", "purge_at": purgeAt},
+		nil,
+	)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.chatDeleted(input.ChatId, user.ID, purgeAt)
+}
+
+func (app *application) restoreChatHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID uuid.UUID `json:"chat_id"`
+	}
 
-		outGoingEvent := Event{
-			Payload: sendData,
-			Type:    EventJoinedMessage,
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	deletedAfter := time.Now().Add(-app.config.chats.deletionGrace)
+
+	err = app.models.Chats.Restore(user.ID, input.ChatID, deletedAfter)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotRestorable),
+			errors.Is(err, data.ErrDuplicateChat),
+			errors.Is(err, data.ErrDuplicateMembers):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
 		}
+		return
+	}
 
-		app.manager.Lock()
-		app.manager.clients[message.ChatID] = make(map[uuid.UUID]*Client)
-		app.manager.clients[message.ChatID][message.UserID] = client
-		app.manager.clients[message.ChatID][message.UserID].chatsID = append(
-			app.manager.clients[message.ChatID][message.UserID].chatsID,
-			message.ChatID,
-		)
-		app.manager.Unlock()
-		client.egress <- outGoingEvent
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "restored successfully!"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
 	}
+
+	memberIDs, err := app.models.Chats.GetMemberIDs(input.ChatID)
+	if err != nil {
+		app.logError(r, err)
+		return
+	}
+	for _, memberID := range memberIDs {
+		app.manager.addToChat(input.ChatID, memberID)
+	}
+	app.sendSystemMessage(user, input.ChatID, user.Name+" Restored the chat.", data.MessageUpdated)
 }
 
-func (app *application) deleteChatHandler(w http.ResponseWriter, r *http.Request) {
+func (app *application) getDeletedChatsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	chats, err := app.models.Chats.GetDeleted(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(
+		w,
+		http.StatusOK,
+		envelope{"data": chats, "grace_period": app.config.chats.deletionGrace.String()},
+		nil,
+	)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) transferChatHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		ChatId uuid.UUID `json:"chat_id"`
+		ChatID uuid.UUID `json:"chat_id"`
+		UserID uuid.UUID `json:"user_id"`
 	}
 
-	app.readJSON(w, r, &input)
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
 
 	user := app.contextGetUser(r)
 
-	err := app.models.Chats.Delete(user.ID, input.ChatId)
+	chat := &data.Chat{ID: input.ChatID}
+	err = app.models.Chats.GetChat(chat)
 	if err != nil {
 		switch {
-		case errors.Is(err, data.ErrDeletionFailed):
-			app.errorResponse(w, r, http.StatusUnprocessableEntity, "Unable to delete chat")
-			return
+		case errors.Is(err, data.ErrChatNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "Chat not found")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if chat.OwnerID != user.ID {
+		app.notPermittedResponse(w, r)
+		return
+	}
+	if chat.IsPrivate {
+		// conversations have no owner to speak of, ownership only decides
+		// who may delete them
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "private chats cannot be transferred")
+		return
+	}
+
+	vdtr := validator.New()
+	vdtr.Check(input.UserID != user.ID, "user_id", "you already own this chat")
+	if !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	newOwner, err := app.models.Users.GetByID(input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			vdtr.AddError("user_id", "no user exists with this id")
+			app.failedValidationResponse(w, r, vdtr.Errors)
 		default:
 			app.serverErrorResponse(w, r, err)
-			return
 		}
+		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "deleted successfully!"}, nil)
+	err = app.models.Chats.TransferOwnership(chat.ID, user.ID, newOwner.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotInChat):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "user is not a member of chat")
+		case errors.Is(err, data.ErrNotOwner):
+			app.notPermittedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	chat.OwnerID = newOwner.ID
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"chat": chat}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
-	if _, ok := app.manager.clients[input.ChatId]; ok {
-		app.manager.Lock()
-		for userID := range app.manager.clients[input.ChatId] {
-			app.manager.connectionClients[userID].chatsID = removeFromSliceByValue(
-				app.manager.connectionClients[userID].chatsID,
-				input.ChatId,
-			)
+
+	app.chatUpdated(user, chat, []string{
+		user.Name + " Transferred the chat ownership to " + newOwner.Name + ".",
+	})
+}
+
+// handOverChat passes a chat on after its owner left, or deletes it when
+// nobody is left to inherit it.
+func (app *application) handOverChat(owner *data.User, chat *data.Chat) {
+	nextOwnerID, err := app.models.Chats.NextOwner(chat.ID)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"chat_id": chat.ID.String()})
+		return
+	}
+
+	if nextOwnerID == uuid.Nil {
+		deletedAt, err := app.models.Chats.Delete(owner.ID, chat.ID)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"chat_id": chat.ID.String()})
+			return
+		}
+		app.chatDeleted(chat.ID, owner.ID, deletedAt.Add(app.config.chats.deletionGrace))
+		return
+	}
+
+	err = app.models.Chats.TransferOwnership(chat.ID, owner.ID, nextOwnerID)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"chat_id": chat.ID.String()})
+		return
+	}
+
+	nextOwner, err := app.models.Users.GetByID(nextOwnerID)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"chat_id": chat.ID.String()})
+		return
+	}
+	chat.OwnerID = nextOwner.ID
+
+	app.chatUpdated(nextOwner, chat, []string{nextOwner.Name + " Is now the owner of the chat."})
+}
+
+// chatDeleted drops every subscription to the chat and tells the connected
+// members when it is going to be purged.
+func (app *application) chatDeleted(chatID, deletedBy uuid.UUID, purgeAt time.Time) {
+	event, err := newEvent(EventChatDeleted, ChatDeletedEvent{
+		ChatID:    chatID,
+		DeletedBy: deletedBy,
+		PurgeAt:   purgeAt,
+	})
+	if err != nil {
+		app.logger.PrintError(
+			err,
+			map[string]string{"error marshaling chat deleted event": err.Error()},
+		)
+		return
+	}
+	app.manager.dropChat(chatID, event)
+}
+
+// purgeDeletedChats removes deleted chats for good once their grace period is
+// over.
+func (app *application) purgeDeletedChats() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for {
+		avatars, err := app.models.Chats.Purge(time.Now().Add(-app.config.chats.deletionGrace))
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"job": "purge deleted chats"})
 		}
-		delete(app.manager.clients, input.ChatId)
-		app.manager.Unlock()
+		for _, avatar := range avatars {
+			err = app.storage.Delete(avatar)
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"job": "purge deleted chats"})
+			}
+		}
+
+		<-ticker.C
 	}
 }
 
@@ -195,7 +343,7 @@ func (app *application) getChatUsersHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	chatUsers, err := app.models.Chats.GetUsers(chatID)
+	chatUsers, err := app.models.Chats.GetUsers(chatID, app.contextGetUser(r).ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrChatNotFound):
@@ -258,6 +406,15 @@ func (app *application) joinChatHandler(w http.ResponseWriter, r *http.Request)
 		case errors.Is(err, data.ErrAlreadyMember):
 			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
 			return
+		case errors.Is(err, data.ErrBannedFromChat):
+			app.errorResponse(w, r, http.StatusForbidden, err.Error())
+			return
+		case errors.Is(err, data.ErrInviteOnly):
+			app.errorResponse(w, r, http.StatusForbidden, err.Error())
+			return
+		case errors.Is(err, data.ErrJoinRequired):
+			app.requestJoin(w, r, input.ChatId, user.ID)
+			return
 		default:
 			app.serverErrorResponse(w, r, err)
 			return
@@ -270,70 +427,7 @@ func (app *application) joinChatHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	message := &data.Message{
-		UserID: user.ID,
-		ChatID: input.ChatId,
-		ID:     uuid.New(),
-		Content: data.Content{
-			NullString: sql.NullString{
-				Valid:  true,
-				String: user.Name + " Joined the chat.",
-			},
-		},
-		Type: data.Int32{
-			Int: sql.NullInt32{
-				Valid: true,
-				Int32: data.MessageJoined,
-			},
-		},
-	}
-	err = app.models.Messages.SendMessage(message)
-	if err != nil {
-		app.logger.PrintError(
-			err,
-			map[string]string{"error sending joined chat message": err.Error()},
-		)
-		return
-	}
-
-	var broadMessage NewMessageEvent
-	broadMessage.Message = message.Content.NullString.String
-	broadMessage.From = message.UserID
-	broadMessage.ChatID = message.ChatID
-	broadMessage.Sent = message.Sent.Sent.Time
-	broadMessage.ID = message.ID
-	broadMessage.UserName = user.Name
-
-	sendData, err := json.Marshal(broadMessage)
-	if err != nil {
-		app.logger.PrintError(
-			err,
-			map[string]string{"error marshaling joined chat message": err.Error()},
-		)
-		return
-	}
-
-	outGoingEvent := Event{
-		Payload: sendData,
-		Type:    EventJoinedMessage,
-	}
-
-	app.manager.Lock()
-	if _, ok := app.manager.clients[message.ChatID]; !ok {
-		app.manager.clients[message.ChatID] = make(map[uuid.UUID]*Client)
-	}
-	if _, ok := app.manager.connectionClients[message.UserID]; ok {
-		app.manager.clients[message.ChatID][message.UserID] = app.manager.connectionClients[message.UserID]
-		app.manager.clients[message.ChatID][message.UserID].chatsID = append(
-			app.manager.clients[message.ChatID][message.UserID].chatsID,
-			message.ChatID,
-		)
-	}
-	app.manager.Unlock()
-
-	for _, client := range app.manager.clients[message.ChatID] {
-		client.egress <- outGoingEvent
-	}
+	app.memberJoined(user, input.ChatId)
 }
 
 func (app *application) leaveChatHandler(w http.ResponseWriter, r *http.Request) {
@@ -348,6 +442,14 @@ func (app *application) leaveChatHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	user := app.contextGetUser(r)
+
+	chat := &data.Chat{ID: input.ChatId}
+	err = app.models.Chats.GetChat(chat)
+	if err != nil && !errors.Is(err, data.ErrChatNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
 	err = app.models.Chats.Leave(input.ChatId, user.ID)
 	if err != nil {
 		switch {
@@ -359,72 +461,17 @@ func (app *application) leaveChatHandler(w http.ResponseWriter, r *http.Request)
 			return
 		}
 	}
+	if chat.OwnerID == user.ID && !chat.IsPrivate {
+		defer app.handOverChat(user, chat)
+	}
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ok"}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
 
-	message := &data.Message{
-		UserID: user.ID,
-		ChatID: input.ChatId,
-		ID:     uuid.New(),
-		Content: data.Content{
-			NullString: sql.NullString{
-				Valid:  true,
-				String: user.Name + " Left the chat.",
-			},
-		},
-		Type: data.Int32{
-			Int: sql.NullInt32{
-				Valid: true,
-				Int32: data.MessageLeft,
-			},
-		},
-	}
-	err = app.models.Messages.SendMessage(message)
-	if err != nil {
-		app.logger.PrintError(
-			err,
-			map[string]string{"error sending Left chat message": err.Error()},
-		)
-		return
-	}
-
-	var broadMessage NewMessageEvent
-	broadMessage.Message = message.Content.NullString.String
-	broadMessage.From = message.UserID
-	broadMessage.ChatID = message.ChatID
-	broadMessage.Sent = message.Sent.Sent.Time
-	broadMessage.ID = message.ID
-	broadMessage.UserName = user.Name
-
-	sendData, err := json.Marshal(broadMessage)
-	if err != nil {
-		app.logger.PrintError(
-			err,
-			map[string]string{"error marshaling left chat message": err.Error()},
-		)
-		return
-	}
-
-	outGoingEvent := Event{
-		Payload: sendData,
-		Type:    EventLeftMessage,
-	}
-
-	if _, ok := app.manager.clients[message.ChatID][message.UserID]; ok {
-		app.manager.Lock()
-		app.manager.connectionClients[message.UserID].chatsID = removeFromSliceByValue(
-			app.manager.connectionClients[message.UserID].chatsID,
-			message.ChatID,
-		)
-		delete(app.manager.clients[message.ChatID], user.ID)
-		app.manager.Unlock()
-	}
-
-	for _, client := range app.manager.clients[message.ChatID] {
-		client.egress <- outGoingEvent
-	}
+	// the user's other devices drop the chat as well
+	app.removeChatMember(input.ChatId, user.ID, user.ID, "left")
+	app.sendSystemMessage(user, input.ChatId, user.Name+" Left the chat.", data.MessageLeft)
 }
 
 func (app *application) getChatMessagesHandler(w http.ResponseWriter, r *http.Request) {
@@ -466,6 +513,10 @@ func (app *application) getChatMessagesHandler(w http.ResponseWriter, r *http.Re
 		return
 	}
 
+	if !app.authorizeBotChat(w, r, chatID) {
+		return
+	}
+
 	user := app.contextGetUser(r)
 	err = app.models.Users.IsInChat(user.ID, chatID)
 	if err != nil {
@@ -479,7 +530,7 @@ func (app *application) getChatMessagesHandler(w http.ResponseWriter, r *http.Re
 		}
 	}
 
-	messages, err := app.models.Chats.GetChatMessage(chatID, int(size), int(start))
+	messages, err := app.models.Chats.GetChatMessage(chatID, user.ID, int(size), int(start))
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -490,3 +541,169 @@ func (app *application) getChatMessagesHandler(w http.ResponseWriter, r *http.Re
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) updateChatHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID      uuid.UUID `json:"chat_id"`
+		Name        *string   `json:"name"`
+		Description *string   `json:"description"`
+		Topic       *string   `json:"topic"`
+		IsListed    *bool     `json:"is_listed"`
+
+		SlowModeSeconds  *int  `json:"slow_mode_seconds"`
+		AnnouncementOnly *bool `json:"announcement_only"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	chat := app.authorizeChatAdmin(w, r, input.ChatID)
+	if chat == nil {
+		return
+	}
+
+	user := app.contextGetUser(r)
+	var changes []string
+
+	if input.Name != nil && *input.Name != chat.Name {
+		chat.Name = *input.Name
+		changes = append(changes, user.Name+" Renamed the chat to \""+chat.Name+"\".")
+	}
+	if input.Description != nil && *input.Description != chat.Description {
+		chat.Description = *input.Description
+		changes = append(changes, user.Name+" Changed the chat description.")
+	}
+	if input.Topic != nil && *input.Topic != chat.Topic {
+		chat.Topic = *input.Topic
+		if chat.Topic == "" {
+			changes = append(changes, user.Name+" Cleared the chat topic.")
+		} else {
+			changes = append(changes, user.Name+" Changed the topic to \""+chat.Topic+"\".")
+		}
+	}
+
+	if input.IsListed != nil && *input.IsListed != chat.IsListed {
+		if chat.OwnerID != user.ID {
+			app.errorResponse(
+				w,
+				r,
+				http.StatusForbidden,
+				"only the owner can change the chat listing",
+			)
+			return
+		}
+		chat.IsListed = *input.IsListed
+		if chat.IsListed {
+			changes = append(changes, user.Name+" Listed the chat in the directory.")
+		} else {
+			changes = append(changes, user.Name+" Removed the chat from the directory.")
+		}
+	}
+
+	if input.SlowModeSeconds != nil && *input.SlowModeSeconds != chat.SlowModeSeconds {
+		chat.SlowModeSeconds = *input.SlowModeSeconds
+		if chat.SlowModeSeconds == 0 {
+			changes = append(changes, user.Name+" Turned off slow mode.")
+		} else {
+			changes = append(changes, fmt.Sprintf(
+				"%s Turned on slow mode, members can send one message every %d seconds.",
+				user.Name,
+				chat.SlowModeSeconds,
+			))
+		}
+	}
+	if input.AnnouncementOnly != nil && *input.AnnouncementOnly != chat.AnnouncementOnly {
+		chat.AnnouncementOnly = *input.AnnouncementOnly
+		if chat.AnnouncementOnly {
+			changes = append(changes, user.Name+" Made the chat announcement only.")
+		} else {
+			changes = append(changes, user.Name+" Let all members post in the chat.")
+		}
+	}
+
+	vdtr := validator.New()
+	data.ValidateChatName(vdtr, chat.Name)
+	data.ValidateChatDescription(vdtr, chat.Description)
+	data.ValidateChatTopic(vdtr, chat.Topic)
+	data.ValidateSlowMode(vdtr, chat.SlowModeSeconds)
+	if !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	if len(changes) > 0 {
+		err = app.models.Chats.UpdateProfile(chat)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrChatNotFound):
+				app.errorResponse(w, r, http.StatusUnprocessableEntity, "Chat not found")
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"chat": chat}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.chatUpdated(user, chat, changes)
+}
+
+// chatUpdated records each change as a system message and pushes the new
+// chat profile to the connected members.
+func (app *application) chatUpdated(user *data.User, chat *data.Chat, changes []string) {
+	if len(changes) == 0 {
+		return
+	}
+
+	for _, change := range changes {
+		app.sendSystemMessage(user, chat.ID, change, data.MessageUpdated)
+	}
+
+	event, err := newEvent(EventChatUpdated, ChatUpdatedEvent{Chat: chat, UpdatedBy: user.ID})
+	if err != nil {
+		app.logger.PrintError(
+			err,
+			map[string]string{"error marshaling chat updated event": err.Error()},
+		)
+		return
+	}
+	app.manager.broadcast(chat.ID, event)
+}
+
+func (app *application) discoverChatsHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	vdtr := validator.New()
+
+	search := app.readString(qs, "q", "")
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, vdtr),
+		PageSize:     app.readInt(qs, "page_size", 20, vdtr),
+		Sort:         app.readString(qs, "sort", "activity"),
+		SortSafelist: data.DiscoverSortSafelist,
+	}
+
+	vdtr.Check(len(search) <= 100, "q", "cannot be more than 100 characters long")
+	if data.ValidateFilters(vdtr, filters); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	chats, metadata, err := app.models.Chats.Discover(user.ID, search, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": chats, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
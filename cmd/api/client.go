@@ -2,48 +2,170 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+
+	"github.com/mf751/gocha/internal/data"
 )
 
 const (
 	pongWait     = 10 * time.Second
 	pingInterval = (pongWait * 9) / 10
+	writeWait    = 10 * time.Second
+	egressSize   = 32
+
+	// closeTokenExpired is sent when the access token a socket was opened or
+	// last re-authenticated with runs out.
+	closeTokenExpired = 4001
 )
 
-type ClientList map[uuid.UUID]map[uuid.UUID]*Client
+var errAuthenticationFailed = errors.New("in-band authentication failed")
+
+// ClientList groups connections by a chat or user id.
+type ClientList map[uuid.UUID]map[*Client]bool
+
+func (list ClientList) add(id uuid.UUID, client *Client) {
+	if _, ok := list[id]; !ok {
+		list[id] = make(map[*Client]bool)
+	}
+	list[id][client] = true
+}
+
+func (list ClientList) remove(id uuid.UUID, client *Client) {
+	delete(list[id], client)
+	if len(list[id]) == 0 {
+		delete(list, id)
+	}
+}
 
+func (list ClientList) list(id uuid.UUID) []*Client {
+	clients := make([]*Client, 0, len(list[id]))
+	for client := range list[id] {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Client is a websocket connection, or an SSE stream when connection is
+// nil.
 type Client struct {
 	connection *websocket.Conn
 	manager    *Manager
 	chatsID    []uuid.UUID
 	userID     uuid.UUID
+	userName   string
+	sessionID  uuid.UUID
+	expiry     atomic.Int64
+	// apiKey is set on the sockets of bots, they only follow the chats the
+	// key is scoped to
+	apiKey *data.APIKey
+
+	// preferences and blocked are guarded by the manager's lock
+	preferences map[uuid.UUID]data.ChatPreferences
+	blocked     map[uuid.UUID]bool
 
-	egress chan Event
+	egress    chan Event
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func newClient(
 	conn *websocket.Conn,
 	manager *Manager,
-	userID uuid.UUID,
+	user *data.User,
+	session *data.Session,
 	chatsID []uuid.UUID,
+	preferences map[uuid.UUID]data.ChatPreferences,
+	blocked map[uuid.UUID]bool,
 ) *Client {
-	return &Client{
-		connection: conn,
-		manager:    manager,
-		egress:     make(chan Event),
-		userID:     userID,
-		chatsID:    chatsID,
+	client := &Client{
+		connection:  conn,
+		manager:     manager,
+		egress:      make(chan Event, egressSize),
+		done:        make(chan struct{}),
+		userID:      user.ID,
+		userName:    user.Name,
+		sessionID:   session.ID,
+		chatsID:     chatsID,
+		preferences: preferences,
+		blocked:     blocked,
+	}
+	client.expiry.Store(session.TokenExpiry.UnixNano())
+	return client
+}
+
+func (c *Client) expired(now time.Time) bool {
+	return now.UnixNano() >= c.expiry.Load()
+}
+
+// authenticateHandler extends the life of the socket with a fresh access
+// token of the same session.
+func authenticateHandler(event Event, c *Client) error {
+	var payload AuthenticateEvent
+	if err := json.Unmarshal(event.Payload, &payload); err != nil {
+		return err
+	}
+
+	session, _, err := c.manager.app.models.Sessions.GetForToken(payload.Token)
+	if err != nil {
+		return err
+	}
+	if session.ID != c.sessionID || session.UserID != c.userID {
+		return errAuthenticationFailed
+	}
+	c.expiry.Store(session.TokenExpiry.UnixNano())
+
+	reply, err := newEvent(EventAuthenticated, AuthenticatedEvent{Expiry: session.TokenExpiry})
+	if err != nil {
+		return err
+	}
+	c.send(reply)
+	return nil
+}
+
+// send queues the event for the connection, it gives up once the connection
+// is closed.
+func (c *Client) send(event Event) {
+	select {
+	case c.egress <- event:
+	case <-c.done:
+	}
+}
+
+// trySend queues the event without waiting, it reports false when the
+// queue is full.
+func (c *Client) trySend(event Event) bool {
+	select {
+	case c.egress <- event:
+		return true
+	case <-c.done:
+		return true
+	default:
+		return false
 	}
 }
 
+func (c *Client) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		if c.connection != nil {
+			c.connection.Close()
+		}
+	})
+}
+
 func (c *Client) pongHandler(pongMessage string) error {
 	return c.connection.SetReadDeadline(time.Now().Add(pongWait))
 }
 
-func (c *Client) writeMessages() {
+// readMessages keeps reading from the connection so control frames are
+// handled, and hands incoming events to their handlers.
+func (c *Client) readMessages() {
 	defer func() {
 		c.manager.removeClient(c)
 	}()
@@ -60,20 +182,35 @@ func (c *Client) writeMessages() {
 	c.connection.SetReadLimit(512)
 	c.connection.SetPongHandler(c.pongHandler)
 
+	for {
+		_, payload, err := c.connection.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var event Event
+		if err := json.Unmarshal(payload, &event); err != nil {
+			continue
+		}
+
+		if handler, ok := c.manager.handlers[event.Type]; ok {
+			if err := handler(event, c); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) writeMessages() {
 	ticker := time.NewTicker(pingInterval)
+	defer func() {
+		ticker.Stop()
+		c.manager.removeClient(c)
+	}()
 
 	for {
 		select {
-		case message, ok := <-c.egress:
-			if !ok {
-				if err := c.connection.WriteMessage(websocket.CloseMessage, nil); err != nil {
-					c.manager.app.logger.PrintError(
-						err,
-						map[string]string{"connection closed": err.Error()},
-					)
-				}
-				break
-			}
+		case message := <-c.egress:
 			data, err := json.Marshal(message)
 			if err != nil {
 				c.manager.app.logger.PrintError(
@@ -83,18 +220,25 @@ func (c *Client) writeMessages() {
 				continue
 			}
 
+			c.connection.SetWriteDeadline(time.Now().Add(writeWait))
 			if err := c.connection.WriteMessage(websocket.TextMessage, data); err != nil {
-				c.manager.app.logger.PrintError(
-					err,
-					map[string]string{"failed to send message": err.Error()},
-				)
-				continue
+				return
 			}
 		// message sent
-		case <-ticker.C:
+		case now := <-ticker.C:
+			c.connection.SetWriteDeadline(time.Now().Add(writeWait))
+			if c.expired(now) {
+				c.connection.WriteMessage(
+					websocket.CloseMessage,
+					websocket.FormatCloseMessage(closeTokenExpired, "access token expired"),
+				)
+				return
+			}
 			if err := c.connection.WriteMessage(websocket.PingMessage, []byte(``)); err != nil {
-				break
+				return
 			}
+		case <-c.done:
+			return
 		}
 	}
 }
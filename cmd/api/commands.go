@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+const (
+	defaultMuteMinutes     = 60
+	commandInviteTTL       = 7 * 24 * time.Hour
+	externalCommandTimeout = 5 * time.Second
+)
+
+var commandRX = regexp.MustCompile(`^/([a-zA-Z0-9_-]{1,32})(?:\s+(.*))?$`)
+
+// Command is a slash command sent in a chat, Args is the text after its
+// name.
+type Command struct {
+	Name string
+	Args string
+	User *data.User
+	Chat *data.Chat
+}
+
+// CommandHandler runs a command and returns the reply that is shown to the
+// caller alone.
+type CommandHandler func(app *application, command Command) (string, error)
+
+var commandHandlers = map[string]CommandHandler{
+	"help":   helpCommand,
+	"topic":  topicCommand,
+	"invite": inviteCommand,
+	"mute":   muteCommand,
+}
+
+var commandHelp = []string{
+	"/me <action> sends the action in the third person",
+	"/topic [text] shows the chat topic or sets it",
+	"/invite @username sends the user an invite to the chat",
+	"/mute @username [minutes] mutes the member, for an hour by default",
+	"//text sends a message that starts with a slash",
+}
+
+// parseCommand splits a message of the form "/name args", it reports false
+// for anything else.
+func parseCommand(content string) (string, string, bool) {
+	matches := commandRX.FindStringSubmatch(strings.TrimSpace(content))
+	if matches == nil {
+		return "", "", false
+	}
+	return strings.ToLower(matches[1]), strings.TrimSpace(matches[2]), true
+}
+
+// runCommand accepts the command and runs it after responding, built-in
+// commands are run here and any other goes to the external command
+// endpoint when one is configured.
+func (app *application) runCommand(
+	w http.ResponseWriter,
+	r *http.Request,
+	user *data.User,
+	chatID uuid.UUID,
+	name, args string,
+) {
+	chat := &data.Chat{ID: chatID}
+	err := app.models.Chats.GetChat(chat)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrChatNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "Chat not found")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"command": "/" + name}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	command := Command{Name: name, Args: args, User: user, Chat: chat}
+
+	handler, ok := commandHandlers[name]
+	if !ok {
+		if app.config.commands.url == "" {
+			app.commandReply(command, "Unknown command /"+name+", try /help.")
+			return
+		}
+		handler = externalCommand
+	}
+
+	app.background(func() {
+		reply, err := handler(app, command)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"command": "/" + name,
+				"chat_id": chat.ID.String(),
+			})
+			reply = "The /" + name + " command failed, please try again later."
+		}
+		app.commandReply(command, reply)
+	})
+}
+
+// commandReply sends the reply over the caller's sockets only.
+func (app *application) commandReply(command Command, text string) {
+	event, err := newEvent(EventCommandResponse, CommandResponseEvent{
+		ChatID:  command.Chat.ID,
+		Command: "/" + command.Name,
+		Text:    text,
+	})
+	if err != nil {
+		app.logger.PrintError(
+			err,
+			map[string]string{"error marshaling command response event": err.Error()},
+		)
+		return
+	}
+	app.manager.sendToUser(command.User.ID, event)
+}
+
+func helpCommand(app *application, command Command) (string, error) {
+	help := strings.Join(commandHelp, "\n")
+	if app.config.commands.url != "" {
+		help += "\nOther commands are handled by an external service."
+	}
+	return help, nil
+}
+
+// commandAdmin reports whether the caller may run admin commands in the
+// chat, the reply says why when they may not.
+func (app *application) commandAdmin(command Command) (string, error) {
+	if command.Chat.IsPrivate {
+		return "/" + command.Name + " cannot be used in private chats.", nil
+	}
+
+	err := app.models.Users.IsAdmin(command.User.ID, command.Chat.ID)
+	switch {
+	case err == nil:
+		return "", nil
+	case errors.Is(err, data.ErrNotAdmin), errors.Is(err, data.ErrNotInChat):
+		return "Only admins can use /" + command.Name + ".", nil
+	default:
+		return "", err
+	}
+}
+
+// commandUser looks up the user named by a command's "@username" argument,
+// the reply says why when there is none. With discoverable set it only
+// finds users who want to be found by the caller.
+func (app *application) commandUser(
+	command Command,
+	username string,
+	discoverable bool,
+) (*data.User, string, error) {
+	if username == "" {
+		return nil, "Name a user as @username.", nil
+	}
+
+	var user *data.User
+	var err error
+	if discoverable {
+		user, err = app.models.Users.GetDiscoverableByUsername(command.User.ID, username)
+	} else {
+		user, err = app.models.Users.GetByUsername(username)
+	}
+	switch {
+	case err == nil:
+		return user, "", nil
+	case errors.Is(err, data.ErrRecordNotFound):
+		return nil, "There is no user @" + data.NormalizeUsername(username) + ".", nil
+	default:
+		return nil, "", err
+	}
+}
+
+func topicCommand(app *application, command Command) (string, error) {
+	if command.Args == "" {
+		if command.Chat.Topic == "" {
+			return "This chat has no topic.", nil
+		}
+		return "The topic is \"" + command.Chat.Topic + "\".", nil
+	}
+
+	reply, err := app.commandAdmin(command)
+	if err != nil || reply != "" {
+		return reply, err
+	}
+
+	chat := command.Chat
+	if command.Args == chat.Topic {
+		return "The topic is already \"" + chat.Topic + "\".", nil
+	}
+	chat.Topic = command.Args
+
+	vdtr := validator.New()
+	if data.ValidateChatTopic(vdtr, chat.Topic); !vdtr.Valid() {
+		return "The topic " + vdtr.Errors["topic"] + ".", nil
+	}
+
+	err = app.models.Chats.UpdateProfile(chat)
+	switch {
+	case errors.Is(err, data.ErrChatNotFound):
+		return "This chat was deleted.", nil
+	case err != nil:
+		return "", err
+	}
+
+	app.chatUpdated(command.User, chat, []string{
+		command.User.Name + " Changed the topic to \"" + chat.Topic + "\".",
+	})
+	return "Topic updated.", nil
+}
+
+// inviteCommand sends the user a single use invite to the chat, they only
+// join once they accept it.
+func inviteCommand(app *application, command Command) (string, error) {
+	reply, err := app.commandAdmin(command)
+	if err != nil || reply != "" {
+		return reply, err
+	}
+
+	invited, reply, err := app.commandUser(command, command.Args, true)
+	if err != nil || reply != "" {
+		return reply, err
+	}
+	name := "@" + invited.Username
+
+	blocked, err := app.models.Blocks.Between(command.User.ID, invited.ID)
+	if err != nil {
+		return "", err
+	}
+	if blocked {
+		return "You cannot invite " + name + ".", nil
+	}
+
+	err = app.models.Users.IsInChat(invited.ID, command.Chat.ID)
+	switch {
+	case err == nil:
+		return name + " is already a member.", nil
+	case !errors.Is(err, data.ErrNotInChat):
+		return "", err
+	}
+
+	banned, err := app.models.Chats.IsBanned(command.Chat.ID, invited.ID)
+	if err != nil {
+		return "", err
+	}
+	if banned {
+		return name + " is banned from this chat.", nil
+	}
+
+	expiry := time.Now().Add(commandInviteTTL)
+	invite := &data.Invite{
+		ChatID:    command.Chat.ID,
+		CreatedBy: command.User.ID,
+		MaxUses:   1,
+		Expiry:    &expiry,
+	}
+	err = app.models.Invites.New(invite)
+	if err != nil {
+		return "", err
+	}
+
+	event, err := newEvent(EventChatInvite, ChatInviteEvent{
+		ChatID:    command.Chat.ID,
+		ChatName:  command.Chat.Name,
+		InvitedBy: command.User.ID,
+		Token:     invite.PlainText,
+		Expiry:    expiry,
+	})
+	if err != nil {
+		return "", err
+	}
+	app.manager.sendToUser(invited.ID, event)
+
+	return "Invited " + name + ", the invite is theirs to accept for a week.", nil
+}
+
+func muteCommand(app *application, command Command) (string, error) {
+	reply, err := app.commandAdmin(command)
+	if err != nil || reply != "" {
+		return reply, err
+	}
+
+	username, minutesString, _ := strings.Cut(command.Args, " ")
+	minutes := defaultMuteMinutes
+	if minutesString = strings.TrimSpace(minutesString); minutesString != "" {
+		minutes, err = strconv.Atoi(minutesString)
+		if err != nil || minutes <= 0 || minutes > maxMuteMinutes {
+			return "Minutes must be a number from 1 to " + strconv.Itoa(maxMuteMinutes) + ".", nil
+		}
+	}
+
+	// members who do not want to be found can still be muted
+	target, reply, err := app.commandUser(command, username, false)
+	if err != nil || reply != "" {
+		return reply, err
+	}
+	name := "@" + target.Username
+
+	// the same rules as for the moderation routes
+	switch {
+	case target.ID == command.User.ID:
+		return "You cannot mute yourself.", nil
+	case target.ID == command.Chat.OwnerID:
+		return "You cannot mute the chat owner.", nil
+	case command.User.ID != command.Chat.OwnerID:
+		err = app.models.Users.IsAdmin(target.ID, command.Chat.ID)
+		switch {
+		case err == nil:
+			return "Only the owner can mute admins.", nil
+		case errors.Is(err, data.ErrNotAdmin), errors.Is(err, data.ErrNotInChat):
+		default:
+			return "", err
+		}
+	}
+
+	mutedUntil := time.Now().Add(time.Duration(minutes) * time.Minute)
+	err = app.models.Chats.Mute(command.Chat.ID, target.ID, mutedUntil)
+	switch {
+	case err == nil:
+	case errors.Is(err, data.ErrNotInChat):
+		return name + " is not a member of this chat.", nil
+	default:
+		return "", err
+	}
+
+	return fmt.Sprintf("Muted %s until %s.", name, mutedUntil.Format(time.RFC1123)), nil
+}
+
+// ExternalCommandRequest is posted to the external command endpoint, it is
+// signed the way webhook deliveries are.
+type ExternalCommandRequest struct {
+	Command  string    `json:"command"`
+	Text     string    `json:"text"`
+	ChatID   uuid.UUID `json:"chat_id"`
+	UserID   uuid.UUID `json:"user_id"`
+	UserName string    `json:"user_name"`
+	Username string    `json:"username"`
+}
+
+// externalCommand hands the command to the configured endpoint, which
+// replies with {"text": "..."} or a 404 for commands it does not know.
+func externalCommand(app *application, command Command) (string, error) {
+	body, err := json.Marshal(ExternalCommandRequest{
+		Command:  "/" + command.Name,
+		Text:     command.Args,
+		ChatID:   command.Chat.ID,
+		UserID:   command.User.ID,
+		UserName: command.User.Name,
+		Username: command.User.Username,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, app.config.commands.url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Gocha-Commands")
+	req.Header.Set("X-Gocha-Timestamp", timestamp)
+	req.Header.Set("X-Gocha-Signature", "sha256="+signWebhook(app.config.commands.secret, timestamp, body))
+
+	client := &http.Client{Timeout: externalCommandTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound:
+		return "Unknown command /" + command.Name + ", try /help.", nil
+	case res.StatusCode < 200 || res.StatusCode >= 300:
+		return "", fmt.Errorf("external command endpoint responded with %s", res.Status)
+	}
+
+	var reply struct {
+		Text string `json:"text"`
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, 64<<10)).Decode(&reply)
+	if err != nil {
+		return "", err
+	}
+	return reply.Text, nil
+}
@@ -9,7 +9,12 @@ import (
 
 type contextKey string
 
-const userContextKey = contextKey("user")
+const (
+	userContextKey     = contextKey("user")
+	sessionContextKey  = contextKey("session")
+	apiKeyContextKey   = contextKey("api-key")
+	botRouteContextKey = contextKey("bot-route")
+)
 
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
 	ctx := context.WithValue(r.Context(), userContextKey, user)
@@ -24,3 +29,37 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+func (app *application) contextSetSession(r *http.Request, session *data.Session) *http.Request {
+	ctx := context.WithValue(r.Context(), sessionContextKey, session)
+	return r.WithContext(ctx)
+}
+
+// contextGetSession returns the session the request was authenticated with,
+// or nil for anonymous requests.
+func (app *application) contextGetSession(r *http.Request) *data.Session {
+	session, _ := r.Context().Value(sessionContextKey).(*data.Session)
+	return session
+}
+
+func (app *application) contextSetAPIKey(r *http.Request, key *data.APIKey) *http.Request {
+	ctx := context.WithValue(r.Context(), apiKeyContextKey, key)
+	return r.WithContext(ctx)
+}
+
+// contextGetAPIKey returns the API key a bot authenticated with, or nil for
+// requests made by people.
+func (app *application) contextGetAPIKey(r *http.Request) *data.APIKey {
+	key, _ := r.Context().Value(apiKeyContextKey).(*data.APIKey)
+	return key
+}
+
+func (app *application) contextSetBotRoute(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), botRouteContextKey, true)
+	return r.WithContext(ctx)
+}
+
+func (app *application) contextIsBotRoute(r *http.Request) bool {
+	allowed, _ := r.Context().Value(botRouteContextKey).(bool)
+	return allowed
+}
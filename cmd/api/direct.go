@@ -0,0 +1,328 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+func (app *application) openDirectChatHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserID   uuid.UUID `json:"user_id"`
+		Username string    `json:"username"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	app.openDirectChat(w, r, input.UserID, input.Username)
+}
+
+// openDirectChat responds with the private chat between the request user and
+// the peer given by id or username, creating it on first use.
+func (app *application) openDirectChat(
+	w http.ResponseWriter,
+	r *http.Request,
+	peerID uuid.UUID,
+	username string,
+) {
+	requestUser := app.contextGetUser(r)
+	vdtr := validator.New()
+
+	var peer *data.User
+	var err error
+	if username != "" {
+		// a username can be guessed, so it only finds the users search
+		// would show to the caller
+		peer, err = app.models.Users.GetDiscoverableByUsername(requestUser.ID, username)
+	} else {
+		peer, err = app.models.Users.GetByID(peerID)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound) && username != "":
+			app.notFoundResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			vdtr.AddError("user_id", "no user exists with this id")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	blocked, err := app.models.Blocks.Between(requestUser.ID, peer.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if blocked {
+		app.errorResponse(w, r, http.StatusForbidden, "you cannot message this user")
+		return
+	}
+
+	chat, created, err := app.models.Chats.OpenDirect(requestUser.ID, peer.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDirectWithSelf):
+			vdtr.AddError("user_id", err.Error())
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	chat.Name = peer.Name
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	err = app.writeJSON(w, status, envelope{"chat": chat}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.manager.addToChat(chat.ID, requestUser.ID)
+	app.manager.addToChat(chat.ID, peer.ID)
+	if created {
+		app.sendSystemMessage(
+			requestUser,
+			chat.ID,
+			requestUser.Name+" Created the chat.",
+			data.MessageJoined,
+		)
+	}
+}
+
+func (app *application) openGroupDirectHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		UserIDs []uuid.UUID `json:"user_ids"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	requestUser := app.contextGetUser(r)
+	memberIDs := append([]uuid.UUID{requestUser.ID}, input.UserIDs...)
+
+	vdtr := validator.New()
+	if data.ValidateGroupDirectMembers(vdtr, memberIDs); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	members := app.getGroupDirectUsers(w, r, input.UserIDs, memberIDs)
+	if members == nil {
+		return
+	}
+
+	chat, created, err := app.models.Chats.OpenGroupDirect(requestUser.ID, memberIDs)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	err = app.writeJSON(w, status, envelope{"chat": chat}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	if created {
+		for _, memberID := range memberIDs {
+			app.manager.addToChat(chat.ID, memberID)
+		}
+		app.sendSystemMessage(
+			requestUser,
+			chat.ID,
+			requestUser.Name+" Created the conversation.",
+			data.MessageJoined,
+		)
+	}
+}
+
+func (app *application) addGroupDirectMembersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID  uuid.UUID   `json:"chat_id"`
+		UserIDs []uuid.UUID `json:"user_ids"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	requestUser := app.contextGetUser(r)
+
+	chat := &data.Chat{ID: input.ChatID}
+	err = app.models.Chats.GetChat(chat)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrChatNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "Chat not found")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if !chat.IsGroupDirect {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, data.ErrNotGroupDirect.Error())
+		return
+	}
+
+	memberIDs, err := app.models.Chats.GetMemberIDs(chat.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !slices.Contains(memberIDs, requestUser.ID) {
+		app.errorResponse(w, r, http.StatusUnauthorized, data.ErrNotInChat.Error())
+		return
+	}
+	memberIDs = append(memberIDs, input.UserIDs...)
+
+	vdtr := validator.New()
+	vdtr.Check(len(input.UserIDs) > 0, "user_ids", "must be provided")
+	if data.ValidateGroupDirectMembers(vdtr, memberIDs); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	added := app.getGroupDirectUsers(w, r, input.UserIDs, memberIDs)
+	if added == nil {
+		return
+	}
+
+	names := make([]string, len(added))
+	for i, user := range added {
+		names[i] = user.Name
+	}
+
+	if app.config.groupDirect.addMode == groupDirectAddConvert {
+		err = app.models.Chats.ConvertGroupDirect(chat.ID, memberIDs)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrDuplicateMembers):
+				app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"chat": chat}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+
+		for _, user := range added {
+			app.manager.addToChat(chat.ID, user.ID)
+		}
+		app.sendSystemMessage(
+			requestUser,
+			chat.ID,
+			requestUser.Name+" Added "+strings.Join(names, ", ")+".",
+			data.MessageJoined,
+		)
+		return
+	}
+
+	newChat, created, err := app.models.Chats.OpenGroupDirect(requestUser.ID, memberIDs)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	status := http.StatusOK
+	if created {
+		status = http.StatusCreated
+	}
+
+	err = app.writeJSON(w, status, envelope{"chat": newChat}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	if created {
+		for _, memberID := range memberIDs {
+			app.manager.addToChat(newChat.ID, memberID)
+		}
+		app.sendSystemMessage(
+			requestUser,
+			newChat.ID,
+			requestUser.Name+" Created the conversation with "+strings.Join(names, ", ")+".",
+			data.MessageJoined,
+		)
+	}
+}
+
+// getGroupDirectUsers loads the invited users, responding with an error and
+// returning nil if any of them does not exist or a block stands between any
+// two of the members the conversation would have.
+func (app *application) getGroupDirectUsers(
+	w http.ResponseWriter,
+	r *http.Request,
+	userIDs []uuid.UUID,
+	memberIDs []uuid.UUID,
+) []*data.User {
+	users := make([]*data.User, 0, len(userIDs))
+	for _, userID := range userIDs {
+		user, err := app.models.Users.GetByID(userID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				vdtr := validator.New()
+				vdtr.AddError("user_ids", "no user exists with id "+userID.String())
+				app.failedValidationResponse(w, r, vdtr.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return nil
+		}
+		users = append(users, user)
+	}
+
+	// nobody can be pulled into a conversation with someone they blocked or
+	// were blocked by
+	blocked, err := app.models.Blocks.Among(memberIDs...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return nil
+	}
+	if blocked {
+		app.errorResponse(w, r, http.StatusForbidden, "some of these users blocked one another")
+		return nil
+	}
+	return users
+}
@@ -5,19 +5,47 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
 )
 
 type Event struct {
+	// ID numbers the events the manager fans out, SSE clients resume from it.
+	ID      uint64          `json:"-"`
 	Type    string          `json:"type"`
 	Payload json.RawMessage `json:"payload"`
+	// Silent is set per connection when the member's chat preferences say
+	// the event should not alert them.
+	Silent bool `json:"silent,omitempty"`
 }
 
 type EventHandler func(event Event, c *Client) error
 
+func newEvent(eventType string, payload interface{}) (Event, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return Event{}, err
+	}
+	return Event{Type: eventType, Payload: data}, nil
+}
+
 const (
-	EventNewMessage    string = "new_message"
-	EventJoinedMessage string = "joined_message"
-	EventLeftMessage   string = "left_message"
+	EventNewMessage      string = "new_message"
+	EventJoinedMessage   string = "joined_message"
+	EventLeftMessage     string = "left_message"
+	EventSystemMessage   string = "system_message"
+	EventRemovedFromChat string = "removed_from_chat"
+	EventChatUpdated     string = "chat_updated"
+	EventChatDeleted     string = "chat_deleted"
+	EventReactionAdded   string = "reaction_added"
+	EventReactionRemoved string = "reaction_removed"
+	EventUserUpdated     string = "user_updated"
+	EventAuthenticate    string = "authenticate"
+	EventAuthenticated   string = "authenticated"
+	EventCommandResponse string = "command_response"
+	EventChatInvite      string = "chat_invite"
+	EventResync          string = "resync"
+	EventTokenExpired    string = "token_expired"
 )
 
 type NewMessageEvent struct {
@@ -27,4 +55,71 @@ type NewMessageEvent struct {
 	From     uuid.UUID `json:"from"`
 	ID       uuid.UUID `json:"id"`
 	UserName string    `json:"user_name"`
+	Type     int32     `json:"type"`
+
+	DisplayName   string           `json:"display_name,omitempty"`
+	DisplayAvatar string           `json:"display_avatar,omitempty"`
+	Attachments   data.Attachments `json:"attachments,omitempty"`
+}
+
+// CommandResponseEvent is the reply to a slash command, it is only sent to
+// the user who ran it.
+type CommandResponseEvent struct {
+	ChatID  uuid.UUID `json:"chat_id"`
+	Command string    `json:"command"`
+	Text    string    `json:"text"`
+}
+
+// ChatInviteEvent carries a personal invite, the token is accepted at
+// /v1/chat/invites/accept like any other.
+type ChatInviteEvent struct {
+	ChatID    uuid.UUID `json:"chat_id"`
+	ChatName  string    `json:"chat_name"`
+	InvitedBy uuid.UUID `json:"invited_by"`
+	Token     string    `json:"token"`
+	Expiry    time.Time `json:"expiry"`
+}
+
+type RemovedFromChatEvent struct {
+	ChatID uuid.UUID `json:"chat_id"`
+	Reason string    `json:"reason"`
+	By     uuid.UUID `json:"by"`
+}
+
+type ChatUpdatedEvent struct {
+	Chat      *data.Chat `json:"chat"`
+	UpdatedBy uuid.UUID  `json:"updated_by"`
+}
+
+type ChatDeletedEvent struct {
+	ChatID    uuid.UUID `json:"chat_id"`
+	DeletedBy uuid.UUID `json:"deleted_by"`
+	PurgeAt   time.Time `json:"purge_at"`
+}
+
+type ReactionEvent struct {
+	ChatID    uuid.UUID `json:"chat_id"`
+	MessageID uuid.UUID `json:"message_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	Emoji     string    `json:"emoji"`
+}
+
+// UserUpdatedEvent carries the public part of a changed profile.
+type UserUpdatedEvent struct {
+	ID        uuid.UUID       `json:"id"`
+	Username  string          `json:"username"`
+	Name      string          `json:"name"`
+	Bio       string          `json:"bio"`
+	HasAvatar bool            `json:"has_avatar"`
+	Status    data.UserStatus `json:"status"`
+}
+
+// AuthenticateEvent is sent by a client to keep its socket open past the
+// expiry of the access token it connected with.
+type AuthenticateEvent struct {
+	Token string `json:"token"`
+}
+
+type AuthenticatedEvent struct {
+	Expiry time.Time `json:"expiry"`
 }
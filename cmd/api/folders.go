@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+func (app *application) createChatFolderHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name            string `json:"name"`
+		IncludeDirect   bool   `json:"include_direct"`
+		IncludeGroups   bool   `json:"include_groups"`
+		IncludePublic   bool   `json:"include_public"`
+		ExcludeMuted    bool   `json:"exclude_muted"`
+		ExcludeArchived bool   `json:"exclude_archived"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	folder := &data.ChatFolder{
+		UserID:          user.ID,
+		Name:            input.Name,
+		IncludeDirect:   input.IncludeDirect,
+		IncludeGroups:   input.IncludeGroups,
+		IncludePublic:   input.IncludePublic,
+		ExcludeMuted:    input.ExcludeMuted,
+		ExcludeArchived: input.ExcludeArchived,
+	}
+
+	vdtr := validator.New()
+	if data.ValidateChatFolder(vdtr, folder); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	err = app.models.Folders.Insert(folder)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTooManyFolders):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"folder": folder}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listChatFoldersHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	folders, err := app.models.Folders.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"folders": folders}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateChatFolderHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		FolderID        uuid.UUID `json:"folder_id"`
+		Name            *string   `json:"name"`
+		IncludeDirect   *bool     `json:"include_direct"`
+		IncludeGroups   *bool     `json:"include_groups"`
+		IncludePublic   *bool     `json:"include_public"`
+		ExcludeMuted    *bool     `json:"exclude_muted"`
+		ExcludeArchived *bool     `json:"exclude_archived"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	folder, err := app.models.Folders.Get(input.FolderID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrFolderNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if input.Name != nil {
+		folder.Name = *input.Name
+	}
+	if input.IncludeDirect != nil {
+		folder.IncludeDirect = *input.IncludeDirect
+	}
+	if input.IncludeGroups != nil {
+		folder.IncludeGroups = *input.IncludeGroups
+	}
+	if input.IncludePublic != nil {
+		folder.IncludePublic = *input.IncludePublic
+	}
+	if input.ExcludeMuted != nil {
+		folder.ExcludeMuted = *input.ExcludeMuted
+	}
+	if input.ExcludeArchived != nil {
+		folder.ExcludeArchived = *input.ExcludeArchived
+	}
+
+	vdtr := validator.New()
+	if data.ValidateChatFolder(vdtr, folder); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	err = app.models.Folders.Update(folder)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrFolderNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"folder": folder}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteChatFolderHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		FolderID uuid.UUID `json:"folder_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	err = app.models.Folders.Delete(input.FolderID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrFolderNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "deleted successfully!"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) addChatToFolderHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		FolderID uuid.UUID `json:"folder_id"`
+		ChatID   uuid.UUID `json:"chat_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	err = app.models.Folders.AddChat(input.FolderID, user.ID, input.ChatID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrFolderNotFound),
+			errors.Is(err, data.ErrAlreadyInFolder),
+			errors.Is(err, data.ErrNotInChat):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ok"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) removeChatFromFolderHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		FolderID uuid.UUID `json:"folder_id"`
+		ChatID   uuid.UUID `json:"chat_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	err = app.models.Folders.RemoveChat(input.FolderID, user.ID, input.ChatID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotInFolder):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ok"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
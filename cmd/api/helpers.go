@@ -7,11 +7,18 @@ import (
 	"io"
 	"maps"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
+
+	"github.com/mf751/gocha/internal/validator"
 )
 
 type envelope map[string]interface{}
 
+const maxEmailAttempts = 3
+
 func (app *application) writeJSON(
 	w http.ResponseWriter,
 	status int,
@@ -100,3 +107,69 @@ func removeFromSliceByValue[T comparable](s []T, val T) []T {
 	}
 	return s // not found; return unchanged
 }
+
+func (app *application) readString(qs url.Values, key string, defaultValue string) string {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	return s
+}
+
+func (app *application) readInt(
+	qs url.Values,
+	key string,
+	defaultValue int,
+	vdtr *validator.Validator,
+) int {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		vdtr.AddError(key, "must be an integer value")
+		return defaultValue
+	}
+	return i
+}
+
+// background runs fn in its own goroutine, recovering from any panic so it
+// cannot take the server down.
+func (app *application) background(fn func()) {
+	go func() {
+		defer func() {
+			if err := recover(); err != nil {
+				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+			}
+		}()
+
+		fn()
+	}()
+}
+
+// sendEmail delivers a templated email in the background, retrying failed
+// attempts with a growing delay.
+func (app *application) sendEmail(recipient, templateFile string, data interface{}) {
+	app.background(func() {
+		var err error
+		delay := 500 * time.Millisecond
+
+		for i := 1; i <= maxEmailAttempts; i++ {
+			err = app.mailer.Send(recipient, templateFile, data)
+			if err == nil {
+				return
+			}
+			if i < maxEmailAttempts {
+				time.Sleep(delay)
+				delay *= 2
+			}
+		}
+
+		app.logger.PrintError(err, map[string]string{
+			"error sending email": templateFile,
+			"recipient":           recipient,
+		})
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	historySize   = 4096
+	historyWindow = 5 * time.Minute
+)
+
+// historyEntry is an event the manager fanned out along with who it went
+// to, SSE clients that reconnect are sent the entries they missed.
+type historyEntry struct {
+	event Event
+	at    time.Time
+	// the event went to the members of chatIDs, skipping those who blocked
+	// senderID, and to every connection of userID
+	chatIDs  []uuid.UUID
+	senderID uuid.UUID
+	userID   uuid.UUID
+	// content is set for chat messages, whether they are silent depends on
+	// the preferences of each member
+	content string
+	message bool
+}
+
+// eventHistory numbers the events of this process and keeps the recent
+// ones. Ids are only meaningful together with the epoch, which changes when
+// the server restarts.
+type eventHistory struct {
+	sync.Mutex
+	epoch   int64
+	lastID  uint64
+	entries []historyEntry
+}
+
+func newEventHistory() *eventHistory {
+	return &eventHistory{epoch: time.Now().UnixNano()}
+}
+
+// record gives the entry's event the next id, keeps the entry and returns
+// the numbered event.
+func (h *eventHistory) record(entry historyEntry) Event {
+	h.Lock()
+	defer h.Unlock()
+
+	h.lastID++
+	entry.event.ID = h.lastID
+	entry.at = time.Now()
+	h.entries = append(h.entries, entry)
+
+	cutoff := entry.at.Add(-historyWindow)
+	drop := 0
+	for drop < len(h.entries) &&
+		(len(h.entries)-drop > historySize || h.entries[drop].at.Before(cutoff)) {
+		drop++
+	}
+	h.entries = h.entries[drop:]
+
+	return entry.event
+}
+
+// current returns the id of the last event recorded.
+func (h *eventHistory) current() uint64 {
+	h.Lock()
+	defer h.Unlock()
+
+	return h.lastID
+}
+
+// since returns the entries recorded after lastID along with the id of the
+// last one recorded, it reports false when some of them were already
+// dropped.
+func (h *eventHistory) since(lastID uint64) ([]historyEntry, uint64, bool) {
+	h.Lock()
+	defer h.Unlock()
+
+	if lastID > h.lastID {
+		return nil, 0, false
+	}
+	if lastID == h.lastID {
+		return nil, h.lastID, true
+	}
+	if len(h.entries) == 0 || lastID+1 < h.entries[0].event.ID {
+		return nil, 0, false
+	}
+
+	start := lastID + 1 - h.entries[0].event.ID
+	return slices.Clone(h.entries[start:]), h.lastID, true
+}
+
+// formatID and parseID convert between event ids and the ids SSE clients
+// hand back in Last-Event-ID.
+func (h *eventHistory) formatID(id uint64) string {
+	return strconv.FormatInt(h.epoch, 36) + "-" + strconv.FormatUint(id, 10)
+}
+
+func (h *eventHistory) parseID(eventID string) (uint64, bool) {
+	epoch, id, ok := strings.Cut(eventID, "-")
+	if !ok || epoch != strconv.FormatInt(h.epoch, 36) {
+		return 0, false
+	}
+
+	lastID, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return lastID, true
+}
+
+// reaches reports whether the entry's event was meant for the client.
+func (entry historyEntry) reaches(client *Client) bool {
+	if entry.userID == client.userID {
+		return true
+	}
+	if entry.senderID != uuid.Nil && client.blocked[entry.senderID] {
+		return false
+	}
+	for _, chatID := range entry.chatIDs {
+		if slices.Contains(client.chatsID, chatID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+func incomingWebhookURL(token string) string {
+	return "/v1/hooks/incoming?token=" + token
+}
+
+func (app *application) createIncomingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID uuid.UUID `json:"chat_id"`
+		Name   string    `json:"name"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	webhook := &data.IncomingWebhook{
+		ChatID:    input.ChatID,
+		CreatedBy: user.ID,
+		Name:      input.Name,
+	}
+
+	vdtr := validator.New()
+
+	if data.ValidateIncomingWebhook(vdtr, webhook); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	if chat := app.authorizeChatAdmin(w, r, input.ChatID); chat == nil {
+		return
+	}
+
+	err = app.models.Incoming.Insert(webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// the token is only ever shown here and when it is rotated
+	env := envelope{"incoming_webhook": webhook, "url": incomingWebhookURL(webhook.Token)}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.memberJoined(&data.User{ID: webhook.UserID, Name: webhook.Name, IsBot: true}, webhook.ChatID)
+}
+
+func (app *application) listIncomingWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	chatIDString := r.URL.Query().Get("chat_id")
+	chatID, err := uuid.Parse(chatIDString)
+	if err != nil || chatIDString == "" {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "Bad UUID")
+		return
+	}
+
+	if chat := app.authorizeChatAdmin(w, r, chatID); chat == nil {
+		return
+	}
+
+	webhooks, err := app.models.Incoming.GetAllForChat(chatID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"incoming_webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// authorizeIncomingWebhook loads the webhook and checks that the request
+// user is an admin of its chat. It writes the error response itself and
+// returns nil when they are not.
+func (app *application) authorizeIncomingWebhook(
+	w http.ResponseWriter,
+	r *http.Request,
+	webhookID uuid.UUID,
+) *data.IncomingWebhook {
+	webhook, err := app.models.Incoming.Get(webhookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrIncomingWebhookNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	if chat := app.authorizeChatAdmin(w, r, webhook.ChatID); chat == nil {
+		return nil
+	}
+	return webhook
+}
+
+func (app *application) rotateIncomingWebhookTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		WebhookID uuid.UUID `json:"webhook_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := app.authorizeIncomingWebhook(w, r, input.WebhookID)
+	if webhook == nil {
+		return
+	}
+
+	err = app.models.Incoming.RotateToken(webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrIncomingWebhookNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"incoming_webhook": webhook, "url": incomingWebhookURL(webhook.Token)}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteIncomingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		WebhookID uuid.UUID `json:"webhook_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := app.authorizeIncomingWebhook(w, r, input.WebhookID)
+	if webhook == nil {
+		return
+	}
+
+	err = app.models.Incoming.Delete(webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrIncomingWebhookNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "incoming webhook deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.removeChatMember(webhook.ChatID, webhook.UserID, app.contextGetUser(r).ID, "removed")
+}
+
+// postIncomingWebhookHandler posts a message into the webhook's chat, the
+// secret token in the URL is all the authentication there is.
+func (app *application) postIncomingWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+
+	vdtr := validator.New()
+
+	if data.ValidateIncomingWebhookToken(vdtr, token); !vdtr.Valid() {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Text        string            `json:"text"`
+		Username    string            `json:"username"`
+		AvatarURL   string            `json:"avatar_url"`
+		Attachments []data.Attachment `json:"attachments"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook, err := app.models.Incoming.GetForToken(token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	message := &data.Message{
+		UserID: webhook.UserID,
+		ChatID: webhook.ChatID,
+		Content: data.Content{
+			NullString: sql.NullString{
+				Valid:  true,
+				String: input.Text,
+			},
+		},
+		Type: data.Int32{
+			Int: sql.NullInt32{
+				Valid: true,
+				Int32: data.MessageNormal,
+			},
+		},
+		DisplayName:   input.Username,
+		DisplayAvatar: input.AvatarURL,
+		Attachments:   input.Attachments,
+	}
+
+	// a message made of attachments alone needs no text
+	if input.Text != "" || len(input.Attachments) == 0 {
+		data.ValidateMessage(vdtr, message, &app.models.Users)
+	}
+	if data.ValidateAttachments(vdtr, message); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	chat := &data.Chat{ID: webhook.ChatID}
+	err = app.models.Chats.GetChat(chat)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrChatNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Users.IsInChat(webhook.UserID, webhook.ChatID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotInChat):
+			app.errorResponse(w, r, http.StatusForbidden, "the webhook is no longer a member of this chat")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	mutedUntil, err := app.models.Chats.MutedUntil(webhook.ChatID, webhook.UserID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if !mutedUntil.IsZero() {
+		app.errorResponse(
+			w,
+			r,
+			http.StatusForbidden,
+			"the webhook is muted in this chat until "+mutedUntil.Format(time.RFC3339),
+		)
+		return
+	}
+
+	// the webhook posts as an ordinary member, announcement only chats and
+	// slow mode apply to it too
+	if !app.storeMessage(w, r, chat, message) {
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": message}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.messageSent(&data.User{ID: webhook.UserID, Name: webhook.Name, IsBot: true}, message)
+}
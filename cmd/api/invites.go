@@ -0,0 +1,354 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+func (app *application) setJoinPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID     uuid.UUID `json:"chat_id"`
+		JoinPolicy string    `json:"join_policy"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	vdtr := validator.New()
+	if data.ValidateJoinPolicy(vdtr, input.JoinPolicy); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	chat := app.authorizeChatAdmin(w, r, input.ChatID)
+	if chat == nil {
+		return
+	}
+
+	err = app.models.Chats.SetJoinPolicy(chat.ID, input.JoinPolicy)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrChatNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "Chat not found")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	chat.JoinPolicy = input.JoinPolicy
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"chat": chat}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID         uuid.UUID `json:"chat_id"`
+		ExpiresInHours int       `json:"expires_in_hours"`
+		MaxUses        int       `json:"max_uses"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	invite := &data.Invite{
+		ChatID:    input.ChatID,
+		CreatedBy: user.ID,
+		MaxUses:   input.MaxUses,
+	}
+	if input.ExpiresInHours != 0 {
+		expiry := time.Now().Add(time.Duration(input.ExpiresInHours) * time.Hour)
+		invite.Expiry = &expiry
+	}
+
+	vdtr := validator.New()
+	if data.ValidateInvite(vdtr, invite); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	if chat := app.authorizeChatAdmin(w, r, input.ChatID); chat == nil {
+		return
+	}
+
+	err = app.models.Invites.New(invite)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"invite": invite}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listInvitesHandler(w http.ResponseWriter, r *http.Request) {
+	chatIDString := r.URL.Query().Get("id")
+	chatID, err := uuid.Parse(chatIDString)
+	if err != nil || chatIDString == "" {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "Bad UUID")
+		return
+	}
+
+	if chat := app.authorizeChatAdmin(w, r, chatID); chat == nil {
+		return
+	}
+
+	invites, err := app.models.Invites.GetAllForChat(chatID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"invites": invites}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) revokeInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID   uuid.UUID `json:"chat_id"`
+		InviteID uuid.UUID `json:"invite_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if chat := app.authorizeChatAdmin(w, r, input.ChatID); chat == nil {
+		return
+	}
+
+	err = app.models.Invites.Revoke(input.ChatID, input.InviteID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInviteNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "revoked successfully!"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) acceptInviteHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	vdtr := validator.New()
+	if data.ValidateTokenPlainText(vdtr, input.Token); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	chatID, err := app.models.Invites.Redeem(input.Token, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrInvalidInvite):
+			vdtr.AddError("token", err.Error())
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		case errors.Is(err, data.ErrAlreadyMember):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		case errors.Is(err, data.ErrBannedFromChat):
+			app.errorResponse(w, r, http.StatusForbidden, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"chat_id": chatID}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.memberJoined(user, chatID)
+}
+
+func (app *application) requestJoin(
+	w http.ResponseWriter,
+	r *http.Request,
+	chatID, userID uuid.UUID,
+) {
+	err := app.models.Users.IsInChat(userID, chatID)
+	switch {
+	case err == nil:
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, data.ErrAlreadyMember.Error())
+		return
+	case !errors.Is(err, data.ErrNotInChat):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	banned, err := app.models.Chats.IsBanned(chatID, userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	if banned {
+		app.errorResponse(w, r, http.StatusForbidden, data.ErrBannedFromChat.Error())
+		return
+	}
+
+	err = app.models.Chats.RequestJoin(chatID, userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRequest):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"message": "join request sent"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listJoinRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	chatIDString := r.URL.Query().Get("id")
+	chatID, err := uuid.Parse(chatIDString)
+	if err != nil || chatIDString == "" {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "Bad UUID")
+		return
+	}
+
+	if chat := app.authorizeChatAdmin(w, r, chatID); chat == nil {
+		return
+	}
+
+	requests, err := app.models.Chats.GetJoinRequests(chatID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"requests": requests}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) approveJoinRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID uuid.UUID `json:"chat_id"`
+		UserID uuid.UUID `json:"user_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if chat := app.authorizeChatAdmin(w, r, input.ChatID); chat == nil {
+		return
+	}
+
+	err = app.models.Chats.ApproveJoinRequest(input.ChatID, input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRequestNotFound), errors.Is(err, data.ErrAlreadyMember):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		case errors.Is(err, data.ErrBannedFromChat):
+			app.errorResponse(w, r, http.StatusForbidden, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ok"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	member, err := app.models.Users.GetByID(input.UserID)
+	if err != nil {
+		app.logger.PrintError(
+			err,
+			map[string]string{"error fetching approved member": err.Error()},
+		)
+		return
+	}
+	app.memberJoined(member, input.ChatID)
+}
+
+func (app *application) rejectJoinRequestHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID uuid.UUID `json:"chat_id"`
+		UserID uuid.UUID `json:"user_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	if chat := app.authorizeChatAdmin(w, r, input.ChatID); chat == nil {
+		return
+	}
+
+	err = app.models.Chats.DeleteJoinRequest(input.ChatID, input.UserID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRequestNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ok"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// memberJoined subscribes a new member's connection to the chat and announces
+// them to the rest.
+func (app *application) memberJoined(user *data.User, chatID uuid.UUID) {
+	app.manager.addToChat(chatID, user.ID)
+	app.sendSystemMessage(user, chatID, user.Name+" Joined the chat.", data.MessageJoined)
+	app.dispatchWebhook(chatID, data.WebhookMemberJoined, MemberJoinedWebhook{
+		ChatID:   chatID,
+		UserID:   user.ID,
+		UserName: user.Name,
+	})
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
@@ -11,6 +13,9 @@ import (
 
 	"github.com/mf751/gocha/internal/data"
 	"github.com/mf751/gocha/internal/jsonlog"
+	"github.com/mf751/gocha/internal/mailer"
+	"github.com/mf751/gocha/internal/oidc"
+	"github.com/mf751/gocha/internal/storage"
 )
 
 type config struct {
@@ -29,13 +34,62 @@ type config struct {
 		burst   int
 		enabled bool
 	}
+	groupDirect struct {
+		addMode string
+	}
+	storage struct {
+		dir string
+	}
+	chats struct {
+		deletionGrace time.Duration
+	}
+	users struct {
+		deletionGrace time.Duration
+	}
+	smtp struct {
+		host     string
+		port     int
+		username string
+		password string
+		sender   string
+	}
+	tokens struct {
+		accessTTL  time.Duration
+		refreshTTL time.Duration
+	}
+	oidc struct {
+		issuer       string
+		clientID     string
+		clientSecret string
+		redirectURL  string
+		scopes       []string
+	}
+	// commands.url receives the slash commands that are not built in.
+	commands struct {
+		url    string
+		secret string
+	}
+	// requireActivation keeps accounts that were not activated yet out of the
+	// messaging routes.
+	requireActivation bool
 }
 
+// Adding people to a group conversation either opens a new conversation for
+// the larger member set or converts the existing one in place.
+const (
+	groupDirectAddNew     = "new"
+	groupDirectAddConvert = "convert"
+)
+
 type application struct {
 	config  config
 	logger  *jsonlog.Logger
 	models  data.Modles
 	manager *Manager
+	storage *storage.Disk
+	mailer  mailer.Mailer
+	// oidc is nil when no identity provider is configured.
+	oidc *oidc.Provider
 }
 
 func main() {
@@ -56,6 +110,67 @@ func main() {
 	cfg.limiter.rps = 5
 	cfg.limiter.burst = 8
 	cfg.limiter.enabled = true
+	cfg.groupDirect.addMode = os.Getenv("GROUP_DIRECT_ADD_MODE")
+	if cfg.groupDirect.addMode != groupDirectAddConvert {
+		cfg.groupDirect.addMode = groupDirectAddNew
+	}
+	cfg.chats.deletionGrace = 7 * 24 * time.Hour
+	if grace := os.Getenv("CHAT_DELETION_GRACE"); grace != "" {
+		cfg.chats.deletionGrace, err = time.ParseDuration(grace)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+	cfg.users.deletionGrace = 30 * 24 * time.Hour
+	if grace := os.Getenv("ACCOUNT_DELETION_GRACE"); grace != "" {
+		cfg.users.deletionGrace, err = time.ParseDuration(grace)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+	cfg.storage.dir = os.Getenv("STORAGE_DIR")
+	if cfg.storage.dir == "" {
+		cfg.storage.dir = "./storage"
+	}
+
+	cfg.smtp.host = os.Getenv("SMTP_HOST")
+	cfg.smtp.port = 25
+	if port := os.Getenv("SMTP_PORT"); port != "" {
+		cfg.smtp.port, err = strconv.Atoi(port)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+	cfg.smtp.username = os.Getenv("SMTP_USERNAME")
+	cfg.smtp.password = os.Getenv("SMTP_PASSWORD")
+	cfg.smtp.sender = os.Getenv("SMTP_SENDER")
+	if cfg.smtp.sender == "" {
+		cfg.smtp.sender = "Gocha <no-reply@gocha.local>"
+	}
+	cfg.requireActivation = os.Getenv("REQUIRE_ACTIVATION") == "true"
+	cfg.tokens.accessTTL = 15 * time.Minute
+	if ttl := os.Getenv("ACCESS_TOKEN_TTL"); ttl != "" {
+		cfg.tokens.accessTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+	cfg.tokens.refreshTTL = 30 * 24 * time.Hour
+	if ttl := os.Getenv("REFRESH_TOKEN_TTL"); ttl != "" {
+		cfg.tokens.refreshTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	cfg.oidc.issuer = os.Getenv("OIDC_ISSUER")
+	cfg.oidc.clientID = os.Getenv("OIDC_CLIENT_ID")
+	cfg.oidc.clientSecret = os.Getenv("OIDC_CLIENT_SECRET")
+	cfg.oidc.redirectURL = os.Getenv("OIDC_REDIRECT_URL")
+	cfg.oidc.scopes = strings.Fields(os.Getenv("OIDC_SCOPES"))
+
+	cfg.commands.url = os.Getenv("COMMANDS_URL")
+	cfg.commands.secret = os.Getenv("COMMANDS_SECRET")
 
 	db, err := openDB(cfg)
 	if err != nil {
@@ -64,13 +179,47 @@ func main() {
 	defer db.Close()
 	logger.PrintInfo("Database connection established", nil)
 
+	disk, err := storage.New(cfg.storage.dir)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// without an SMTP server emails are written to the log output
+	var mail mailer.Mailer = mailer.NewLog(os.Stdout, cfg.smtp.sender)
+	if cfg.smtp.host != "" {
+		mail = mailer.NewSMTP(
+			cfg.smtp.host,
+			cfg.smtp.port,
+			cfg.smtp.username,
+			cfg.smtp.password,
+			cfg.smtp.sender,
+		)
+	}
+
 	app := &application{
-		config: cfg,
-		models: data.NewModels(db),
-		logger: logger,
+		config:  cfg,
+		models:  data.NewModels(db),
+		logger:  logger,
+		storage: disk,
+		mailer:  mail,
 	}
 	app.manager = newManager(app)
 
+	if cfg.oidc.issuer != "" {
+		app.oidc = oidc.New(oidc.Config{
+			Issuer:       cfg.oidc.issuer,
+			ClientID:     cfg.oidc.clientID,
+			ClientSecret: cfg.oidc.clientSecret,
+			RedirectURL:  cfg.oidc.redirectURL,
+			Scopes:       cfg.oidc.scopes,
+		}, nil)
+	}
+
+	go app.purgeDeletedChats()
+	go app.purgeDeletedUsers()
+	go app.purgeExpiredExports()
+	go app.deliverWebhooks()
+
 	app.serve()
 }
 
@@ -2,24 +2,39 @@ package main
 
 import (
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
 )
 
 type Manager struct {
+	// clients holds the connections subscribed to each chat and
+	// connectionClients every connection of each user, a user has one per
+	// signed in device.
 	clients           ClientList
-	connectionClients map[uuid.UUID]*Client
+	connectionClients ClientList
 	sync.RWMutex
 
 	handlers map[string]EventHandler
 	app      *application
+	// history keeps the recent events for SSE clients that reconnect
+	history *eventHistory
+	// fanout is held while an event is numbered and queued for its clients,
+	// so every client gets the events in the order of their ids
+	fanout sync.Mutex
 }
 
 func newManager(app *application) *Manager {
 	m := &Manager{
 		clients:           make(ClientList),
 		app:               app,
-		connectionClients: make(map[uuid.UUID]*Client),
+		connectionClients: make(ClientList),
+		history:           newEventHistory(),
+		handlers: map[string]EventHandler{
+			EventAuthenticate: authenticateHandler,
+		},
 	}
 	return m
 }
@@ -28,13 +43,9 @@ func (m *Manager) addClient(client *Client) {
 	m.Lock()
 	defer m.Unlock()
 
-	m.connectionClients[client.userID] = client
-
+	m.connectionClients.add(client.userID, client)
 	for _, chatID := range client.chatsID {
-		if _, ok := m.clients[chatID]; !ok {
-			m.clients[chatID] = make(map[uuid.UUID]*Client)
-		}
-		m.clients[chatID][client.userID] = client
+		m.clients.add(chatID, client)
 	}
 }
 
@@ -42,12 +53,301 @@ func (m *Manager) removeClient(client *Client) {
 	m.Lock()
 	defer m.Unlock()
 
-	client.connection.Close()
-	delete(m.connectionClients, client.userID)
+	if _, ok := m.connectionClients[client.userID][client]; !ok {
+		return
+	}
+
+	client.close()
+	m.connectionClients.remove(client.userID, client)
 	for _, chatID := range client.chatsID {
-		delete(m.clients[chatID], client.userID)
-		if len(m.clients[chatID]) == 0 {
-			delete(m.clients, chatID)
+		m.clients.remove(chatID, client)
+	}
+}
+
+// broadcast sends the event to every connected member of the chat.
+func (m *Manager) broadcast(chatID uuid.UUID, event Event) {
+	m.fanout.Lock()
+	defer m.fanout.Unlock()
+	event = m.history.record(historyEntry{event: event, chatIDs: []uuid.UUID{chatID}})
+
+	m.RLock()
+	clients := m.clients.list(chatID)
+	m.RUnlock()
+
+	for _, client := range clients {
+		m.deliver(client, event)
+	}
+}
+
+// sendToUser sends the event to every connection of the user alone.
+func (m *Manager) sendToUser(userID uuid.UUID, event Event) {
+	m.fanout.Lock()
+	defer m.fanout.Unlock()
+	event = m.history.record(historyEntry{event: event, userID: userID})
+
+	m.RLock()
+	clients := m.connectionClients.list(userID)
+	m.RUnlock()
+
+	for _, client := range clients {
+		m.deliver(client, event)
+	}
+}
+
+// addToChat subscribes the user's connections, if any, to the chat.
+func (m *Manager) addToChat(chatID, userID uuid.UUID) {
+	m.Lock()
+	defer m.Unlock()
+
+	for client := range m.connectionClients[userID] {
+		if client.apiKey != nil && !client.apiKey.AllowsChat(chatID) {
+			continue
+		}
+		if _, ok := m.clients[chatID][client]; !ok {
+			client.chatsID = append(client.chatsID, chatID)
+		}
+		if _, ok := client.preferences[chatID]; !ok {
+			client.preferences[chatID] = data.DefaultChatPreferences()
+		}
+		m.clients.add(chatID, client)
+	}
+}
+
+// setPreferences updates the cached chat preferences of a connected user.
+func (m *Manager) setPreferences(userID, chatID uuid.UUID, preferences data.ChatPreferences) {
+	m.Lock()
+	defer m.Unlock()
+
+	for client := range m.connectionClients[userID] {
+		client.preferences[chatID] = preferences
+	}
+}
+
+// broadcastFrom sends an event caused by senderID to the chat, skipping the
+// members who blocked the sender.
+func (m *Manager) broadcastFrom(chatID, senderID uuid.UUID, event Event) {
+	m.fanout.Lock()
+	defer m.fanout.Unlock()
+	event = m.history.record(historyEntry{
+		event:    event,
+		chatIDs:  []uuid.UUID{chatID},
+		senderID: senderID,
+	})
+
+	m.RLock()
+	var clients []*Client
+	for client := range m.clients[chatID] {
+		if !client.blocked[senderID] {
+			clients = append(clients, client)
+		}
+	}
+	m.RUnlock()
+
+	for _, client := range clients {
+		m.deliver(client, event)
+	}
+}
+
+// setBlocked updates the cached blocks of a connected user.
+func (m *Manager) setBlocked(userID, blockedID uuid.UUID, blocked bool) {
+	m.Lock()
+	defer m.Unlock()
+
+	for client := range m.connectionClients[userID] {
+		if blocked {
+			client.blocked[blockedID] = true
+		} else {
+			delete(client.blocked, blockedID)
+		}
+	}
+}
+
+// broadcastMessage fans a chat message out like broadcastFrom, marking it
+// silent for every member whose preferences say it should not notify them.
+func (m *Manager) broadcastMessage(chatID, senderID uuid.UUID, event Event, content string) {
+	now := time.Now()
+	m.fanout.Lock()
+	defer m.fanout.Unlock()
+	event = m.history.record(historyEntry{
+		event:    event,
+		chatIDs:  []uuid.UUID{chatID},
+		senderID: senderID,
+		content:  content,
+		message:  true,
+	})
+
+	m.RLock()
+	var clients []*Client
+	for client := range m.clients[chatID] {
+		if !client.blocked[senderID] {
+			clients = append(clients, client)
+		}
+	}
+	events := make([]Event, len(clients))
+	for i, client := range clients {
+		preferences, ok := client.preferences[chatID]
+		if !ok {
+			preferences = data.DefaultChatPreferences()
+		}
+		events[i] = event
+		events[i].Silent = !preferences.ShouldNotify(content, client.userName, now)
+	}
+	m.RUnlock()
+
+	for i, client := range clients {
+		m.deliver(client, events[i])
+	}
+}
+
+// removeFromChat drops the user's subscriptions to the chat and tells their
+// connections about it with the given event.
+func (m *Manager) removeFromChat(chatID, userID uuid.UUID, event Event) {
+	m.fanout.Lock()
+	defer m.fanout.Unlock()
+	event = m.history.record(historyEntry{event: event, userID: userID})
+
+	m.Lock()
+	clients := m.connectionClients.list(userID)
+	for _, client := range clients {
+		client.chatsID = removeFromSliceByValue(client.chatsID, chatID)
+		m.clients.remove(chatID, client)
+	}
+	m.Unlock()
+
+	for _, client := range clients {
+		m.deliver(client, event)
+	}
+}
+
+// dropChat removes every subscription to the chat and sends the event to the
+// members that were connected.
+func (m *Manager) dropChat(chatID uuid.UUID, event Event) {
+	m.fanout.Lock()
+	defer m.fanout.Unlock()
+	event = m.history.record(historyEntry{event: event, chatIDs: []uuid.UUID{chatID}})
+
+	m.Lock()
+	clients := m.clients.list(chatID)
+	for _, client := range clients {
+		client.chatsID = removeFromSliceByValue(client.chatsID, chatID)
+	}
+	delete(m.clients, chatID)
+	m.Unlock()
+
+	for _, client := range clients {
+		m.deliver(client, event)
+	}
+}
+
+// closeSessions disconnects the sockets opened with the given sessions.
+func (m *Manager) closeSessions(userID uuid.UUID, sessionIDs ...uuid.UUID) {
+	m.RLock()
+	var clients []*Client
+	for client := range m.connectionClients[userID] {
+		for _, sessionID := range sessionIDs {
+			if client.sessionID == sessionID {
+				clients = append(clients, client)
+			}
+		}
+	}
+	m.RUnlock()
+
+	for _, client := range clients {
+		m.removeClient(client)
+	}
+}
+
+// closeUser disconnects every socket of the user.
+func (m *Manager) closeUser(userID uuid.UUID) {
+	m.RLock()
+	clients := m.connectionClients.list(userID)
+	m.RUnlock()
+
+	for _, client := range clients {
+		m.removeClient(client)
+	}
+}
+
+// userUpdated refreshes the user's own connections and sends the event once
+// to everyone connected to one of the given chats.
+func (m *Manager) userUpdated(user *data.User, chatIDs []uuid.UUID, event Event) {
+	m.fanout.Lock()
+	defer m.fanout.Unlock()
+	event = m.history.record(historyEntry{event: event, chatIDs: chatIDs, userID: user.ID})
+
+	m.Lock()
+	recipients := make(map[*Client]bool)
+	for client := range m.connectionClients[user.ID] {
+		client.userName = user.Name
+		recipients[client] = true
+	}
+	for _, chatID := range chatIDs {
+		for client := range m.clients[chatID] {
+			recipients[client] = true
+		}
+	}
+	m.Unlock()
+
+	for client := range recipients {
+		m.deliver(client, event)
+	}
+}
+
+// deliver queues the event for the client, a client that fell so far behind
+// that its queue is full is disconnected rather than holding up the others.
+func (m *Manager) deliver(client *Client, event Event) {
+	if !client.trySend(event) {
+		m.removeClient(client)
+	}
+}
+
+// subscribe adds an SSE client and returns the events it missed since
+// lastID, or none when resume is false. The id returned is the last one
+// recorded before the client was added, every later event reaches the client
+// through its queue. It reports false when the history no longer reaches
+// back to lastID.
+func (m *Manager) subscribe(client *Client, lastID uint64, resume bool) ([]Event, uint64, bool) {
+	m.fanout.Lock()
+	defer m.fanout.Unlock()
+
+	m.addClient(client)
+	if !resume {
+		return nil, m.history.current(), true
+	}
+
+	events, currentID, ok := m.replay(client, lastID)
+	if !ok {
+		return nil, m.history.current(), false
+	}
+	return events, currentID, true
+}
+
+// replay returns the recorded events after lastID that were meant for the
+// client along with the id of the last event recorded, it reports false when
+// the history no longer reaches back that far.
+func (m *Manager) replay(client *Client, lastID uint64) ([]Event, uint64, bool) {
+	entries, currentID, ok := m.history.since(lastID)
+	if !ok {
+		return nil, 0, false
+	}
+
+	m.RLock()
+	defer m.RUnlock()
+
+	var events []Event
+	for _, entry := range entries {
+		if !entry.reaches(client) {
+			continue
+		}
+		event := entry.event
+		if entry.message {
+			preferences, ok := client.preferences[entry.chatIDs[0]]
+			if !ok {
+				preferences = data.DefaultChatPreferences()
+			}
+			event.Silent = !preferences.ShouldNotify(entry.content, client.userName, entry.at)
 		}
+		events = append(events, event)
 	}
+	return events, currentID, true
 }
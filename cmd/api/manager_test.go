@@ -0,0 +1,116 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+)
+
+func newTestClient(manager *Manager, chatIDs ...uuid.UUID) *Client {
+	user := &data.User{ID: uuid.New(), Name: "Alice"}
+	session := &data.Session{ID: uuid.New(), TokenExpiry: time.Now().Add(time.Hour)}
+	return newClient(
+		nil,
+		manager,
+		user,
+		session,
+		chatIDs,
+		map[uuid.UUID]data.ChatPreferences{},
+		map[uuid.UUID]bool{},
+	)
+}
+
+func TestBroadcastKeepsIDOrder(t *testing.T) {
+	manager := newManager(&application{})
+	chatID := uuid.New()
+	client := newTestClient(manager, chatID)
+	manager.addClient(client)
+
+	const senders, perSender = 8, 200
+
+	received := make(chan []uint64)
+	go func() {
+		var ids []uint64
+		for len(ids) < senders*perSender {
+			select {
+			case event := <-client.egress:
+				ids = append(ids, event.ID)
+			case <-client.done:
+				received <- ids
+				return
+			}
+		}
+		received <- ids
+	}()
+
+	var wg sync.WaitGroup
+	for range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range perSender {
+				manager.broadcast(chatID, Event{Type: EventResync})
+			}
+		}()
+	}
+	wg.Wait()
+
+	ids := <-received
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Fatalf("event %d arrived after event %d", ids[i], ids[i-1])
+		}
+	}
+}
+
+func TestSubscribeReplaysUpToTheCut(t *testing.T) {
+	manager := newManager(&application{})
+	chatID := uuid.New()
+
+	manager.broadcast(chatID, Event{Type: EventResync})
+	manager.broadcast(chatID, Event{Type: EventResync})
+
+	client := newTestClient(manager, chatID)
+	events, cut, ok := manager.subscribe(client, 1, true)
+	if !ok {
+		t.Fatal("subscribe could not replay from id 1")
+	}
+	if len(events) != 1 || events[0].ID != 2 || cut != 2 {
+		t.Fatalf("got %d events up to %d, want event 2 up to 2", len(events), cut)
+	}
+
+	manager.broadcast(chatID, Event{Type: EventResync})
+	select {
+	case event := <-client.egress:
+		if event.ID != 3 {
+			t.Fatalf("got event %d live, want 3", event.ID)
+		}
+	default:
+		t.Fatal("the event after the cut was not queued")
+	}
+
+	if _, _, ok := manager.subscribe(newTestClient(manager), 7, true); ok {
+		t.Fatal("subscribe replayed from an id that was never handed out")
+	}
+}
+
+func TestDeliverDisconnectsFullClients(t *testing.T) {
+	manager := newManager(&application{})
+	chatID := uuid.New()
+	client := newTestClient(manager, chatID)
+	manager.addClient(client)
+
+	for range egressSize + 1 {
+		manager.broadcast(chatID, Event{Type: EventResync})
+	}
+
+	select {
+	case <-client.done:
+	default:
+		t.Fatal("a client with a full queue was not disconnected")
+	}
+}
@@ -4,7 +4,12 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/google/uuid"
 
@@ -27,6 +32,34 @@ func (app *application) sendMessageHandler(w http.ResponseWriter, r *http.Reques
 
 	user := app.contextGetUser(r)
 
+	messageType := data.MessageNormal
+	switch name, args, ok := parseCommand(input.Content); {
+	case strings.HasPrefix(input.Content, "//"):
+		// "//" escapes a message that should start with a slash
+		input.Content = input.Content[1:]
+	case ok && name == "me":
+		input.Content = args
+		messageType = data.MessageAction
+	case ok:
+		if !app.authorizeBotChat(w, r, input.ChatID) {
+			return
+		}
+
+		err = app.models.Users.IsInChat(user.ID, input.ChatID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrNotInChat):
+				app.errorResponse(w, r, http.StatusUnauthorized, err.Error())
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		app.runCommand(w, r, user, input.ChatID, name, args)
+		return
+	}
+
 	message := &data.Message{
 		UserID: user.ID,
 		ID:     uuid.New(),
@@ -40,7 +73,7 @@ func (app *application) sendMessageHandler(w http.ResponseWriter, r *http.Reques
 		Type: data.Int32{
 			Int: sql.NullInt32{
 				Valid: true,
-				Int32: data.MessageNormal,
+				Int32: messageType,
 			},
 		},
 	}
@@ -52,6 +85,10 @@ func (app *application) sendMessageHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	if !app.authorizeBotChat(w, r, message.ChatID) {
+		return
+	}
+
 	err = app.models.Users.IsInChat(message.UserID, message.ChatID)
 	if err != nil {
 		switch {
@@ -64,11 +101,43 @@ func (app *application) sendMessageHandler(w http.ResponseWriter, r *http.Reques
 		}
 	}
 
-	err = app.models.Messages.SendMessage(message)
+	mutedUntil, err := app.models.Chats.MutedUntil(message.ChatID, message.UserID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+	if !mutedUntil.IsZero() {
+		app.errorResponse(
+			w,
+			r,
+			http.StatusForbidden,
+			"you are muted in this chat until "+mutedUntil.Format(time.RFC3339),
+		)
+		return
+	}
+
+	chat := &data.Chat{ID: message.ChatID}
+	err = app.models.Chats.GetChat(chat)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if chat.IsPrivate && !chat.IsGroupDirect {
+		blocked, err := app.models.Blocks.InDirectChat(chat.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if blocked {
+			app.errorResponse(w, r, http.StatusForbidden, "you cannot message this user")
+			return
+		}
+	}
+
+	if !app.storeMessage(w, r, chat, message) {
+		return
+	}
 
 	err = app.writeJSON(w, http.StatusOK, envelope{"message": message}, nil)
 	if err != nil {
@@ -76,6 +145,69 @@ func (app *application) sendMessageHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	app.messageSent(user, message)
+}
+
+// storeMessage stores the message unless the chat's posting restrictions
+// forbid it, in which case it responds with why and returns false.
+func (app *application) storeMessage(
+	w http.ResponseWriter,
+	r *http.Request,
+	chat *data.Chat,
+	message *data.Message,
+) bool {
+	var err error
+
+	// admins are exempt from both posting restrictions
+	slowMode := false
+	if chat.AnnouncementOnly || chat.SlowModeSeconds > 0 {
+		err = app.models.Users.IsAdmin(message.UserID, message.ChatID)
+		switch {
+		case err == nil:
+		case errors.Is(err, data.ErrNotAdmin):
+			if chat.AnnouncementOnly {
+				app.errorResponse(w, r, http.StatusForbidden, "only admins can post in this chat")
+				return false
+			}
+			slowMode = true
+		default:
+			app.serverErrorResponse(w, r, err)
+			return false
+		}
+	}
+
+	if slowMode {
+		var remaining time.Duration
+		remaining, err = app.models.Messages.SendSlowMode(chat, message)
+		if errors.Is(err, data.ErrSlowMode) {
+			seconds := int(math.Ceil(remaining.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			app.errorResponse(
+				w,
+				r,
+				http.StatusTooManyRequests,
+				fmt.Sprintf("slow mode is on, you can send another message in %d seconds", seconds),
+			)
+			return false
+		}
+	} else {
+		err = app.models.Messages.SendMessage(message)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotInChat):
+			app.errorResponse(w, r, http.StatusUnauthorized, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return false
+	}
+	return true
+}
+
+// messageSent broadcasts a freshly stored message to the chat and passes it
+// on to the chat's webhooks.
+func (app *application) messageSent(user *data.User, message *data.Message) {
 	var broadCastMessage NewMessageEvent
 	broadCastMessage.ChatID = message.ChatID
 	broadCastMessage.From = message.UserID
@@ -83,6 +215,10 @@ func (app *application) sendMessageHandler(w http.ResponseWriter, r *http.Reques
 	broadCastMessage.Message = message.Content.NullString.String
 	broadCastMessage.ID = message.ID
 	broadCastMessage.UserName = user.Name
+	broadCastMessage.Type = message.Type.Int.Int32
+	broadCastMessage.DisplayName = message.DisplayName
+	broadCastMessage.DisplayAvatar = message.DisplayAvatar
+	broadCastMessage.Attachments = message.Attachments
 
 	sendData, err := json.Marshal(broadCastMessage)
 	if err != nil {
@@ -98,9 +234,84 @@ func (app *application) sendMessageHandler(w http.ResponseWriter, r *http.Reques
 		Type:    EventNewMessage,
 	}
 
-	if _, ok := app.manager.clients[message.ChatID]; ok {
-		for _, client := range app.manager.clients[message.ChatID] {
-			client.egress <- outGoingEvent
-		}
+	app.manager.broadcastMessage(
+		message.ChatID,
+		message.UserID,
+		outGoingEvent,
+		broadCastMessage.Message,
+	)
+	app.dispatchWebhook(message.ChatID, data.WebhookNewMessage, broadCastMessage)
+
+	err = app.models.Chats.Unarchive(message.ChatID, message.UserID)
+	if err != nil {
+		app.logger.PrintError(
+			err,
+			map[string]string{"error unarchiving chat": err.Error()},
+		)
 	}
 }
+
+// sendSystemMessage records a message of the given type in the chat on behalf
+// of user and broadcasts it to the connected members.
+func (app *application) sendSystemMessage(
+	user *data.User,
+	chatID uuid.UUID,
+	content string,
+	messageType int32,
+) {
+	message := &data.Message{
+		UserID: user.ID,
+		ChatID: chatID,
+		ID:     uuid.New(),
+		Content: data.Content{
+			NullString: sql.NullString{
+				Valid:  true,
+				String: content,
+			},
+		},
+		Type: data.Int32{
+			Int: sql.NullInt32{
+				Valid: true,
+				Int32: messageType,
+			},
+		},
+	}
+	err := app.models.Messages.SendMessage(message)
+	if err != nil {
+		app.logger.PrintError(
+			err,
+			map[string]string{"error sending system message": err.Error()},
+		)
+		return
+	}
+
+	var broadMessage NewMessageEvent
+	broadMessage.Message = message.Content.NullString.String
+	broadMessage.From = message.UserID
+	broadMessage.ChatID = message.ChatID
+	broadMessage.Sent = message.Sent.Sent.Time
+	broadMessage.ID = message.ID
+	broadMessage.UserName = user.Name
+
+	sendData, err := json.Marshal(broadMessage)
+	if err != nil {
+		app.logger.PrintError(
+			err,
+			map[string]string{"error marshaling system message": err.Error()},
+		)
+		return
+	}
+
+	eventType := EventSystemMessage
+	switch messageType {
+	case data.MessageJoined:
+		eventType = EventJoinedMessage
+	case data.MessageLeft:
+		eventType = EventLeftMessage
+	}
+
+	app.manager.broadcast(chatID, Event{
+		Payload: sendData,
+		Type:    eventType,
+	})
+}
@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/tomasen/realip"
 	"golang.org/x/time/rate"
 
@@ -15,6 +16,8 @@ import (
 	"github.com/mf751/gocha/internal/validator"
 )
 
+const sessionTouchInterval = time.Minute
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -38,6 +41,10 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 		headerParts := strings.Split(authorizationHeader, " ")
+		if len(headerParts) == 2 && headerParts[0] == "Bot" {
+			app.authenticateBot(w, r, next, headerParts[1])
+			return
+		}
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
 			app.invalidCredentialsResponse(w, r)
 			return
@@ -52,7 +59,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		session, user, err := app.models.Sessions.GetForToken(token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -63,12 +70,64 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 				return
 			}
 		}
+
+		// only write the last use down once in a while
+		ip := realip.FromRequest(r)
+		if time.Since(session.LastUsedAt) > sessionTouchInterval || session.IP != ip {
+			err = app.models.Sessions.Touch(session.ID, ip)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
 		r = app.contextSetUser(r, user)
+		r = app.contextSetSession(r, session)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// authenticateBot authenticates a request made with the "Bot <key>" scheme
+// as the bot the API key belongs to.
+func (app *application) authenticateBot(
+	w http.ResponseWriter,
+	r *http.Request,
+	next http.Handler,
+	keyPlainText string,
+) {
+	vdtr := validator.New()
+
+	if data.ValidateAPIKeyPlainText(vdtr, keyPlainText); !vdtr.Valid() {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	key, bot, err := app.models.Bots.GetForKey(keyPlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if key.LastUsedAt == nil || time.Since(*key.LastUsedAt) > sessionTouchInterval {
+		err = app.models.Bots.TouchKey(key.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	r = app.contextSetUser(r, bot)
+	r = app.contextSetAPIKey(r, key)
+
+	next.ServeHTTP(w, r)
+}
+
 func (app *application) requireAuthentication(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -77,10 +136,45 @@ func (app *application) requireAuthentication(next http.HandlerFunc) http.Handle
 			return
 		}
 
+		// bots only get through on the routes opened to them with allowBots
+		if app.contextGetAPIKey(r) != nil && !app.contextIsBotRoute(r) {
+			app.botNotPermittedResponse(w, r)
+			return
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
 
+// allowBots opens the route to bots whose API key has the permission, people
+// are let through unchanged.
+func (app *application) allowBots(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := app.contextGetAPIKey(r)
+		if key != nil {
+			if !key.Allows(permission) {
+				app.botNotPermittedResponse(w, r)
+				return
+			}
+			r = app.contextSetBotRoute(r)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authorizeBotChat checks that a bot's API key is scoped to the chat. It
+// writes the error response itself and returns false when it is not, requests
+// made by people always pass.
+func (app *application) authorizeBotChat(w http.ResponseWriter, r *http.Request, chatID uuid.UUID) bool {
+	key := app.contextGetAPIKey(r)
+	if key != nil && !key.AllowsChat(chatID) {
+		app.botNotPermittedResponse(w, r)
+		return false
+	}
+	return true
+}
+
 func (app *application) requireActivation(next http.HandlerFunc) http.HandlerFunc {
 	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -93,6 +187,15 @@ func (app *application) requireActivation(next http.HandlerFunc) http.HandlerFun
 	return app.requireAuthentication(fn)
 }
 
+// requireMessaging guards the routes used to take part in chats, they need
+// an activated account when the server is configured to require one.
+func (app *application) requireMessaging(next http.HandlerFunc) http.HandlerFunc {
+	if app.config.requireActivation {
+		return app.requireActivation(next)
+	}
+	return app.requireAuthentication(next)
+}
+
 func (app *application) enableCORS(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Vary", "Origin")
@@ -105,7 +208,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 			if r.Method == http.MethodOptions &&
 				r.Header.Get("Access-Control-Request-Method") != "" {
 				w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+				w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Expected-Version, Last-Event-ID")
 				w.WriteHeader(http.StatusOK)
 				return
 			}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+const maxMuteMinutes = 30 * 24 * 60
+
+// authorizeChatAdmin loads a group chat and checks that the request user is
+// one of its admins. It writes the error response itself and returns nil when
+// they are not.
+func (app *application) authorizeChatAdmin(
+	w http.ResponseWriter,
+	r *http.Request,
+	chatID uuid.UUID,
+) *data.Chat {
+	chat := &data.Chat{ID: chatID}
+	err := app.models.Chats.GetChat(chat)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrChatNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "Chat not found")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+	if chat.IsPrivate {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "Private chat")
+		return nil
+	}
+
+	user := app.contextGetUser(r)
+	err = app.models.Users.IsAdmin(user.ID, chatID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotInChat):
+			app.errorResponse(w, r, http.StatusUnauthorized, err.Error())
+		case errors.Is(err, data.ErrNotAdmin):
+			app.notPermittedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return chat
+}
+
+// authorizeModeration checks that the request user is an admin of the chat
+// and allowed to act on target. It writes the error response itself and
+// returns nil when the action must not go ahead.
+func (app *application) authorizeModeration(
+	w http.ResponseWriter,
+	r *http.Request,
+	chatID, targetID uuid.UUID,
+) *data.User {
+	user := app.contextGetUser(r)
+	if user.ID == targetID {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "cannot moderate yourself")
+		return nil
+	}
+
+	chat := app.authorizeChatAdmin(w, r, chatID)
+	if chat == nil {
+		return nil
+	}
+
+	if targetID == chat.OwnerID {
+		app.errorResponse(w, r, http.StatusForbidden, "cannot moderate the chat owner")
+		return nil
+	}
+
+	if user.ID != chat.OwnerID {
+		err := app.models.Users.IsAdmin(targetID, chatID)
+		switch {
+		case err == nil:
+			app.errorResponse(w, r, http.StatusForbidden, "only the owner can moderate admins")
+			return nil
+		case errors.Is(err, data.ErrNotAdmin), errors.Is(err, data.ErrNotInChat):
+		default:
+			app.serverErrorResponse(w, r, err)
+			return nil
+		}
+	}
+
+	target, err := app.models.Users.GetByID(targetID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			vdtr := validator.New()
+			vdtr.AddError("user_id", "no user exists with this id")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	return target
+}
+
+func (app *application) kickChatMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID uuid.UUID `json:"chat_id"`
+		UserID uuid.UUID `json:"user_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	target := app.authorizeModeration(w, r, input.ChatID, input.UserID)
+	if target == nil {
+		return
+	}
+
+	err = app.models.Chats.Leave(input.ChatID, target.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotInChat):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ok"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	user := app.contextGetUser(r)
+	app.removeChatMember(input.ChatID, target.ID, user.ID, "kicked")
+	app.sendSystemMessage(
+		user,
+		input.ChatID,
+		target.Name+" Was removed from the chat by "+user.Name+".",
+		data.MessageKicked,
+	)
+}
+
+func (app *application) banChatMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID uuid.UUID `json:"chat_id"`
+		UserID uuid.UUID `json:"user_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	target := app.authorizeModeration(w, r, input.ChatID, input.UserID)
+	if target == nil {
+		return
+	}
+
+	user := app.contextGetUser(r)
+	wasMember, err := app.models.Chats.Ban(input.ChatID, target.ID, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ok"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	if wasMember {
+		app.removeChatMember(input.ChatID, target.ID, user.ID, "banned")
+	}
+	app.sendSystemMessage(
+		user,
+		input.ChatID,
+		target.Name+" Was banned from the chat by "+user.Name+".",
+		data.MessageBanned,
+	)
+}
+
+func (app *application) unbanChatMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID uuid.UUID `json:"chat_id"`
+		UserID uuid.UUID `json:"user_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	target := app.authorizeModeration(w, r, input.ChatID, input.UserID)
+	if target == nil {
+		return
+	}
+
+	err = app.models.Chats.Unban(input.ChatID, target.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotBanned):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ok"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) muteChatMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID  uuid.UUID `json:"chat_id"`
+		UserID  uuid.UUID `json:"user_id"`
+		Minutes int       `json:"minutes"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	vdtr := validator.New()
+	vdtr.Check(input.Minutes > 0, "minutes", "must be more than 0")
+	vdtr.Check(input.Minutes <= maxMuteMinutes, "minutes", "cannot be more than 30 days")
+	if !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	target := app.authorizeModeration(w, r, input.ChatID, input.UserID)
+	if target == nil {
+		return
+	}
+
+	mutedUntil := time.Now().Add(time.Duration(input.Minutes) * time.Minute)
+	err = app.models.Chats.Mute(input.ChatID, target.ID, mutedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotInChat):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"muted_until": mutedUntil}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) unmuteChatMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID uuid.UUID `json:"chat_id"`
+		UserID uuid.UUID `json:"user_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	target := app.authorizeModeration(w, r, input.ChatID, input.UserID)
+	if target == nil {
+		return
+	}
+
+	err = app.models.Chats.Mute(input.ChatID, target.ID, time.Time{})
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotInChat):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ok"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// removeChatMember unsubscribes a removed member from the chat and notifies
+// their connection.
+func (app *application) removeChatMember(chatID, userID, by uuid.UUID, reason string) {
+	event, err := newEvent(EventRemovedFromChat, RemovedFromChatEvent{
+		ChatID: chatID,
+		Reason: reason,
+		By:     by,
+	})
+	if err != nil {
+		app.logger.PrintError(
+			err,
+			map[string]string{"error marshaling removed from chat event": err.Error()},
+		)
+		return
+	}
+	app.manager.removeFromChat(chatID, userID, event)
+	app.dispatchWebhook(chatID, data.WebhookMemberLeft, MemberLeftWebhook{
+		ChatID: chatID,
+		UserID: userID,
+		Reason: reason,
+		By:     by,
+	})
+}
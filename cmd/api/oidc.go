@@ -0,0 +1,217 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/oidc"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+const oidcLoginTTL = 10 * time.Minute
+
+// oidcAuthorizeHandler starts a sign in with the identity provider, the
+// client sends the user to the returned URL and posts the code and state it
+// is redirected back with to /v1/tokens/oidc.
+func (app *application) oidcAuthorizeHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	login := &data.OIDCLogin{Expiry: time.Now().Add(oidcLoginTTL)}
+
+	for _, value := range []*string{&login.State, &login.Nonce, &login.CodeVerifier} {
+		var err error
+		*value, err = oidc.RandomString()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	authorizationURL, err := app.oidc.AuthCodeURL(r.Context(), login.State, login.Nonce, login.CodeVerifier)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Identities.InsertLogin(login)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"authorization_url": authorizationURL,
+		"state":             login.State,
+	}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createOIDCTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if app.oidc == nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	var input struct {
+		Code       string `json:"code"`
+		State      string `json:"state"`
+		DeviceName string `json:"device_name"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	vdtr := validator.New()
+
+	vdtr.Check(input.Code != "", "code", "must be provided")
+	vdtr.Check(input.State != "", "state", "must be provided")
+
+	if !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	login, err := app.models.Identities.ConsumeLogin(input.State)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			vdtr.AddError("state", "invalid or expired sign in state")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	claims, err := app.oidc.Login(r.Context(), input.Code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrCodeRejected), errors.Is(err, oidc.ErrInvalidToken):
+			app.logError(r, err)
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Identities.GetUser(app.oidc.Issuer(), claims.Subject)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			user, err = app.linkIdentity(claims)
+			if err != nil {
+				switch {
+				case errors.Is(err, errEmailNotVerified):
+					app.errorResponse(w, r, http.StatusForbidden, err.Error())
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+		default:
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	enabled, err := app.models.TwoFactor.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if enabled {
+		app.requireSecondFactor(w, r, user)
+		return
+	}
+
+	app.startSession(w, r, user, input.DeviceName)
+}
+
+var errEmailNotVerified = errors.New("the identity provider has not verified your email address")
+
+// linkIdentity attaches a new provider identity to the user with the same
+// verified email, creating the user when there is none yet.
+func (app *application) linkIdentity(claims *oidc.Claims) (*data.User, error) {
+	email, ok := claims.VerifiedEmail()
+	vdtr := validator.New()
+	data.ValidateEmail(vdtr, email)
+	if !ok || !vdtr.Valid() {
+		return nil, errEmailNotVerified
+	}
+
+	user, err := app.models.Users.GetByEmail(email)
+	switch {
+	case err == nil:
+		// the provider proved the address belongs to them, not necessarily
+		// to whoever signed up with it without activating it
+		if !user.Activated {
+			err = app.models.Users.ClaimUnactivated(user.ID)
+			if err != nil {
+				return nil, err
+			}
+			app.manager.closeUser(user.ID)
+			user.Activated = true
+		}
+	case errors.Is(err, data.ErrRecordNotFound):
+		user, err = app.createIdentityUser(claims)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	err = app.models.Identities.Link(user.ID, app.oidc.Issuer(), claims.Subject, claims.Email)
+	if err != nil && !errors.Is(err, data.ErrIdentityLinked) {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (app *application) createIdentityUser(claims *oidc.Claims) (*data.User, error) {
+	name := strings.TrimSpace(claims.Name)
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+	if len(name) > 500 {
+		name = name[:500]
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     claims.Email,
+		Activated: true,
+	}
+
+	// the account can only be signed in to through the provider until the
+	// user sets a password with a password reset
+	password, err := oidc.RandomString()
+	if err != nil {
+		return nil, err
+	}
+
+	err = user.Password.Set(password)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Users.Insert(user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
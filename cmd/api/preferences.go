@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+func (app *application) updateChatPreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID     uuid.UUID `json:"chat_id"`
+		MutedUntil *string   `json:"muted_until"`
+		Notify     *string   `json:"notify"`
+		Hidden     *bool     `json:"hidden"`
+		Pinned     *bool     `json:"pinned"`
+		Archived   *bool     `json:"archived"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	preferences, err := app.models.Chats.GetPreferences(input.ChatID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotInChat):
+			app.errorResponse(w, r, http.StatusUnauthorized, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// drop a mute that already ran out so it does not fail validation
+	if !preferences.IsMuted(time.Now()) {
+		preferences.MutedUntil = nil
+	}
+
+	vdtr := validator.New()
+
+	if input.MutedUntil != nil {
+		// an empty value unmutes the chat
+		if *input.MutedUntil == "" {
+			preferences.MutedUntil = nil
+		} else {
+			mutedUntil, err := time.Parse(time.RFC3339, *input.MutedUntil)
+			if err != nil {
+				vdtr.AddError("muted_until", "must be an RFC 3339 timestamp")
+			}
+			preferences.MutedUntil = &mutedUntil
+		}
+	}
+	if input.Notify != nil {
+		preferences.Notify = *input.Notify
+	}
+	if input.Hidden != nil {
+		preferences.Hidden = *input.Hidden
+	}
+	if input.Archived != nil {
+		preferences.Archived = *input.Archived
+	}
+
+	if input.Pinned != nil {
+		switch {
+		case !*input.Pinned:
+			preferences.PinnedAt = nil
+		case preferences.PinnedAt == nil:
+			pinned, err := app.models.Chats.CountPinned(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			vdtr.Check(pinned < data.MaxPinnedChats, "pinned", "cannot pin more than 10 chats")
+
+			now := time.Now()
+			preferences.PinnedAt = &now
+		}
+	}
+
+	if data.ValidateChatPreferences(vdtr, preferences); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	err = app.models.Chats.UpdatePreferences(input.ChatID, user.ID, preferences)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotInChat):
+			app.errorResponse(w, r, http.StatusUnauthorized, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.manager.setPreferences(user.ID, input.ChatID, *preferences)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"preferences": preferences}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/storage"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if expected := r.Header.Get("X-Expected-Version"); expected != "" {
+		if strconv.Itoa(user.Version) != expected {
+			app.editConflictResponse(w, r)
+			return
+		}
+	}
+
+	var input struct {
+		Name            *string `json:"name"`
+		Email           *string `json:"email"`
+		Username        *string `json:"username"`
+		Discoverability *string `json:"discoverability"`
+		CurrentPassword string  `json:"current_password"`
+		Code            string  `json:"code"`
+		RecoveryCode    string  `json:"recovery_code"`
+		Bio             *string `json:"bio"`
+		Status          *struct {
+			Text      string `json:"text"`
+			Emoji     string `json:"emoji"`
+			ExpiresAt string `json:"expires_at"`
+		} `json:"status"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	vdtr := validator.New()
+
+	if input.Name != nil {
+		user.Name = strings.TrimSpace(*input.Name)
+	}
+	if input.Username != nil {
+		user.Username = data.NormalizeUsername(*input.Username)
+	}
+	if input.Discoverability != nil {
+		user.Discoverability = *input.Discoverability
+	}
+	if input.Bio != nil {
+		user.Bio = strings.TrimSpace(*input.Bio)
+	}
+	if input.Status != nil {
+		user.Status = data.UserStatus{
+			Text:  strings.TrimSpace(input.Status.Text),
+			Emoji: input.Status.Emoji,
+		}
+		if input.Status.ExpiresAt != "" {
+			expiresAt, err := time.Parse(time.RFC3339, input.Status.ExpiresAt)
+			if err != nil {
+				vdtr.AddError("status", "expiry must be an RFC 3339 timestamp")
+				app.failedValidationResponse(w, r, vdtr.Errors)
+				return
+			}
+			user.Status.ExpiresAt = &expiresAt
+		}
+	}
+
+	// a new address has to be confirmed again and is only accepted from
+	// someone who knows the password, accounts without one give their
+	// two-factor code instead when they have it turned on
+	emailChanged := input.Email != nil && !strings.EqualFold(*input.Email, user.Email)
+	if emailChanged {
+		user.Email = *input.Email
+		user.Activated = false
+
+		if user.Password.IsSet() {
+			match, err := user.Password.Matches(input.CurrentPassword)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+			vdtr.Check(match, "current_password", "is incorrect")
+		} else {
+			twoFactor, err := app.models.TwoFactor.Get(user.ID)
+			switch {
+			case errors.Is(err, data.ErrTwoFactorNotEnabled):
+			case err != nil:
+				app.serverErrorResponse(w, r, err)
+				return
+			case twoFactor.Confirmed:
+				ok, err := app.checkSecondFactor(user, twoFactor, input.Code, input.RecoveryCode)
+				if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return
+				}
+				vdtr.Check(ok, "code", "is incorrect")
+			}
+		}
+	}
+
+	if data.ValidateProfile(vdtr, user); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmial):
+			vdtr.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		case errors.Is(err, data.ErrDuplicateUsername):
+			vdtr.AddError("username", "this username is already taken")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if emailChanged {
+		token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.sendEmail(user.Email, "email_change.tmpl", map[string]interface{}{
+			"activationToken": token.PlainText,
+			"name":            user.Name,
+		})
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.userUpdated(user)
+}
+
+func (app *application) uploadUserAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	content := app.readAvatar(w, r)
+	if content == nil {
+		return
+	}
+
+	avatar, err := app.storage.SaveImage("user-avatars", user.ID.String(), content)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrUnsupportedImage):
+			app.errorResponse(w, r, http.StatusUnsupportedMediaType, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	previous := user.Avatar
+	user.Avatar = avatar
+	user.HasAvatar = true
+
+	err = app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	if previous != "" && previous != avatar {
+		err = app.storage.Delete(previous)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.userUpdated(user)
+}
+
+func (app *application) deleteUserAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	if user.Avatar == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	previous := user.Avatar
+	user.Avatar = ""
+	user.HasAvatar = false
+
+	err := app.models.Users.Update(user)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	err = app.storage.Delete(previous)
+	if err != nil {
+		app.logError(r, err)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.userUpdated(user)
+}
+
+func (app *application) getUserAvatarHandler(w http.ResponseWriter, r *http.Request) {
+	userIDString := r.URL.Query().Get("id")
+	userID, err := uuid.Parse(userIDString)
+	if err != nil || userIDString == "" {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "Bad UUID")
+		return
+	}
+
+	user, err := app.models.Users.GetByID(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Avatar == "" {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "private, max-age=300")
+	http.ServeFile(w, r, app.storage.Path(user.Avatar))
+}
+
+// userUpdated tells the user's other devices and everyone sharing a chat
+// with them about a changed profile.
+func (app *application) userUpdated(user *data.User) {
+	chatIDs, err := app.models.Users.GetChatsID(user.ID)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{"user_id": user.ID.String()})
+		return
+	}
+
+	event, err := newEvent(EventUserUpdated, UserUpdatedEvent{
+		ID:        user.ID,
+		Username:  user.Username,
+		Name:      user.Name,
+		Bio:       user.Bio,
+		HasAvatar: user.HasAvatar,
+		Status:    user.Status,
+	})
+	if err != nil {
+		app.logger.PrintError(
+			err,
+			map[string]string{"error marshaling user updated event": err.Error()},
+		)
+		return
+	}
+	app.manager.userUpdated(user, chatIDs, event)
+}
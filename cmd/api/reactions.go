@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+// authorizeReaction looks up the chat of the message and checks that the
+// request user is a member of it. It writes the error response itself and
+// returns uuid.Nil when they are not.
+func (app *application) authorizeReaction(
+	w http.ResponseWriter,
+	r *http.Request,
+	messageID uuid.UUID,
+) uuid.UUID {
+	chatID, err := app.models.Messages.GetChatID(messageID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrMessageNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return uuid.Nil
+	}
+
+	if !app.authorizeBotChat(w, r, chatID) {
+		return uuid.Nil
+	}
+
+	user := app.contextGetUser(r)
+	err = app.models.Users.IsInChat(user.ID, chatID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrNotInChat):
+			app.errorResponse(w, r, http.StatusUnauthorized, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return uuid.Nil
+	}
+
+	return chatID
+}
+
+func (app *application) addReactionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MessageID uuid.UUID `json:"message_id"`
+		Emoji     string    `json:"emoji"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	vdtr := validator.New()
+	if data.ValidateEmoji(vdtr, input.Emoji); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	chatID := app.authorizeReaction(w, r, input.MessageID)
+	if chatID == uuid.Nil {
+		return
+	}
+
+	user := app.contextGetUser(r)
+	err = app.models.Messages.AddReaction(input.MessageID, user.ID, input.Emoji)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrAlreadyReacted):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ok"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.reactionChanged(EventReactionAdded, chatID, input.MessageID, user.ID, input.Emoji)
+}
+
+func (app *application) removeReactionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		MessageID uuid.UUID `json:"message_id"`
+		Emoji     string    `json:"emoji"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	chatID := app.authorizeReaction(w, r, input.MessageID)
+	if chatID == uuid.Nil {
+		return
+	}
+
+	user := app.contextGetUser(r)
+	err = app.models.Messages.RemoveReaction(input.MessageID, user.ID, input.Emoji)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrReactionNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "ok"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+
+	app.reactionChanged(EventReactionRemoved, chatID, input.MessageID, user.ID, input.Emoji)
+}
+
+func (app *application) getReactionsHandler(w http.ResponseWriter, r *http.Request) {
+	messageIDString := r.URL.Query().Get("id")
+	messageID, err := uuid.Parse(messageIDString)
+	if err != nil || messageIDString == "" {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "Bad UUID")
+		return
+	}
+
+	if chatID := app.authorizeReaction(w, r, messageID); chatID == uuid.Nil {
+		return
+	}
+
+	reactions, err := app.models.Messages.GetReactions(messageID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"reactions": reactions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) reactionChanged(
+	eventType string,
+	chatID, messageID, userID uuid.UUID,
+	emoji string,
+) {
+	payload := ReactionEvent{
+		ChatID:    chatID,
+		MessageID: messageID,
+		UserID:    userID,
+		Emoji:     emoji,
+	}
+	event, err := newEvent(eventType, payload)
+	if err != nil {
+		app.logger.PrintError(
+			err,
+			map[string]string{"error marshaling reaction event": err.Error()},
+		)
+		return
+	}
+	app.manager.broadcastFrom(chatID, userID, event)
+
+	webhookEvent := data.WebhookReactionAdded
+	if eventType == EventReactionRemoved {
+		webhookEvent = data.WebhookReactionRemoved
+	}
+	app.dispatchWebhook(chatID, webhookEvent, payload)
+}
@@ -4,6 +4,8 @@ import (
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
+
+	"github.com/mf751/gocha/internal/data"
 )
 
 func (app *application) routes() http.Handler {
@@ -19,17 +21,92 @@ func (app *application) routes() http.Handler {
 		"/v1/users",
 		app.registerUserHandler,
 	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/users/activated",
+		app.activateUserHandler,
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/tokens/activation",
+		app.createActivationTokenHandler,
+	)
 	router.HandlerFunc(
 		http.MethodPost,
 		"/v1/tokens/authentication",
 		app.createAuthenticationTokenHandler,
 	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/oidc/authorize",
+		app.oidcAuthorizeHandler,
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/tokens/oidc",
+		app.createOIDCTokenHandler,
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/tokens/2fa",
+		app.verifySecondFactorHandler,
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/tokens/refresh",
+		app.refreshTokenHandler,
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/tokens/logout",
+		app.requireAuthentication(app.logoutHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/sessions",
+		app.requireAuthentication(app.listSessionsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/sessions",
+		app.requireAuthentication(app.revokeSessionHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/sessions/others",
+		app.requireAuthentication(app.revokeOtherSessionsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/tokens/password-reset",
+		app.createPasswordResetTokenHandler,
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/users/password",
+		app.resetPasswordHandler,
+	)
 
 	router.HandlerFunc(
 		http.MethodPost,
 		"/v1/chats",
 		app.requireAuthentication(app.createChatHandler),
 	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chats/direct",
+		app.requireAuthentication(app.openDirectChatHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chats/group-direct",
+		app.requireAuthentication(app.openGroupDirectHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chats/group-direct/members",
+		app.requireAuthentication(app.addGroupDirectMembersHandler),
+	)
 	router.HandlerFunc(
 		http.MethodDelete,
 		"/v1/chats",
@@ -40,6 +117,56 @@ func (app *application) routes() http.Handler {
 		"/v1/chats",
 		app.requireAuthentication(app.getUserChatsHandler),
 	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/chats/deleted",
+		app.requireAuthentication(app.getDeletedChatsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chats/restore",
+		app.requireAuthentication(app.restoreChatHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chat/transfer",
+		app.requireAuthentication(app.transferChatHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/chats/discover",
+		app.requireAuthentication(app.discoverChatsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chats/folders",
+		app.requireAuthentication(app.createChatFolderHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/chats/folders",
+		app.requireAuthentication(app.listChatFoldersHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPatch,
+		"/v1/chats/folders",
+		app.requireAuthentication(app.updateChatFolderHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/chats/folders",
+		app.requireAuthentication(app.deleteChatFolderHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chats/folders/chats",
+		app.requireAuthentication(app.addChatToFolderHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/chats/folders/chats",
+		app.requireAuthentication(app.removeChatFromFolderHandler),
+	)
 	router.HandlerFunc(
 		http.MethodGet,
 		"/v1/chat/users",
@@ -55,22 +182,278 @@ func (app *application) routes() http.Handler {
 		"/v1/chat/leave",
 		app.requireAuthentication(app.leaveChatHandler),
 	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chat/kick",
+		app.requireAuthentication(app.kickChatMemberHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chat/ban",
+		app.requireAuthentication(app.banChatMemberHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chat/unban",
+		app.requireAuthentication(app.unbanChatMemberHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chat/mute",
+		app.requireAuthentication(app.muteChatMemberHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chat/unmute",
+		app.requireAuthentication(app.unmuteChatMemberHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/chat/join-policy",
+		app.requireAuthentication(app.setJoinPolicyHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chat/invites",
+		app.requireAuthentication(app.createInviteHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/chat/invites",
+		app.requireAuthentication(app.listInvitesHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/chat/invites",
+		app.requireAuthentication(app.revokeInviteHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chat/invites/accept",
+		app.requireAuthentication(app.acceptInviteHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/chat/join-requests",
+		app.requireAuthentication(app.listJoinRequestsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chat/join-requests/approve",
+		app.requireAuthentication(app.approveJoinRequestHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chat/join-requests/reject",
+		app.requireAuthentication(app.rejectJoinRequestHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPatch,
+		"/v1/chat",
+		app.requireAuthentication(app.updateChatHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/chat/avatar",
+		app.requireAuthentication(app.getChatAvatarHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/chat/avatar",
+		app.requireAuthentication(app.uploadChatAvatarHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/chat/avatar",
+		app.requireAuthentication(app.deleteChatAvatarHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/chat/preferences",
+		app.requireAuthentication(app.updateChatPreferencesHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/message/reactions",
+		app.allowBots(data.PermissionReadMessages, app.requireAuthentication(app.getReactionsHandler)),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/message/reactions",
+		app.allowBots(data.PermissionWriteReaction, app.requireMessaging(app.addReactionHandler)),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/message/reactions",
+		app.allowBots(data.PermissionWriteReaction, app.requireMessaging(app.removeReactionHandler)),
+	)
 	router.HandlerFunc(
 		http.MethodPost,
 		"/v1/message",
-		app.requireAuthentication(app.sendMessageHandler),
+		app.allowBots(data.PermissionSendMessages, app.requireMessaging(app.sendMessageHandler)),
 	)
 	router.HandlerFunc(
 		http.MethodGet,
 		"/v1/chat",
-		app.requireAuthentication(app.getChatMessagesHandler),
+		app.allowBots(data.PermissionReadMessages, app.requireAuthentication(app.getChatMessagesHandler)),
 	)
 	router.HandlerFunc(
 		http.MethodGet,
 		"/v1/user",
 		app.requireAuthentication(app.getUserInfoHandler),
 	)
+	router.HandlerFunc(
+		http.MethodPatch,
+		"/v1/user",
+		app.requireAuthentication(app.updateUserHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/user",
+		app.requireAuthentication(app.deleteUserHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/user/export",
+		app.requireAuthentication(app.exportUserHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/user/export/download",
+		app.requireAuthentication(app.downloadExportHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/user/avatar",
+		app.requireAuthentication(app.uploadUserAvatarHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/user/avatar",
+		app.requireAuthentication(app.deleteUserAvatarHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/blocks",
+		app.requireAuthentication(app.listBlocksHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/blocks",
+		app.requireAuthentication(app.blockUserHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/blocks",
+		app.requireAuthentication(app.unblockUserHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/users/search",
+		app.requireAuthentication(app.searchUsersHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/users/avatar",
+		app.requireAuthentication(app.getUserAvatarHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPut,
+		"/v1/user/password",
+		app.requireAuthentication(app.changePasswordHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/user/2fa",
+		app.requireAuthentication(app.enrollTwoFactorHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/user/2fa/confirm",
+		app.requireAuthentication(app.confirmTwoFactorHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/user/2fa",
+		app.requireAuthentication(app.disableTwoFactorHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chat/webhooks",
+		app.requireAuthentication(app.createWebhookHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/chat/webhooks",
+		app.requireAuthentication(app.listWebhooksHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPatch,
+		"/v1/chat/webhooks",
+		app.requireAuthentication(app.updateWebhookHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/chat/webhooks",
+		app.requireAuthentication(app.deleteWebhookHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/chat/webhooks/deliveries",
+		app.requireAuthentication(app.listWebhookDeliveriesHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chat/incoming-webhooks",
+		app.requireAuthentication(app.createIncomingWebhookHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/chat/incoming-webhooks",
+		app.requireAuthentication(app.listIncomingWebhooksHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/chat/incoming-webhooks",
+		app.requireAuthentication(app.deleteIncomingWebhookHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/chat/incoming-webhooks/token",
+		app.requireAuthentication(app.rotateIncomingWebhookTokenHandler),
+	)
+	router.HandlerFunc(http.MethodPost, "/v1/hooks/incoming", app.postIncomingWebhookHandler)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/bots",
+		app.requireAuthentication(app.createBotHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/bots",
+		app.requireAuthentication(app.listBotsHandler),
+	)
+	router.HandlerFunc(
+		http.MethodPost,
+		"/v1/bots/keys",
+		app.requireAuthentication(app.createAPIKeyHandler),
+	)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/bots/keys",
+		app.requireAuthentication(app.listAPIKeysHandler),
+	)
+	router.HandlerFunc(
+		http.MethodDelete,
+		"/v1/bots/keys",
+		app.requireAuthentication(app.deleteAPIKeyHandler),
+	)
 	router.HandlerFunc(http.MethodGet, "/v1/ws", app.manager.serveWS)
+	router.HandlerFunc(
+		http.MethodGet,
+		"/v1/events",
+		app.allowBots(data.PermissionReadMessages, app.requireMessaging(app.manager.serveSSE)),
+	)
 
 	return app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router))))
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/google/uuid"
+	"github.com/tomasen/realip"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+func (app *application) listSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	session := app.contextGetSession(r)
+
+	sessions, err := app.models.Sessions.GetAllForUser(user.ID, session.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"sessions": sessions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) revokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		SessionID uuid.UUID `json:"session_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	err = app.models.Sessions.Delete(input.SessionID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrSessionNotFound):
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.manager.closeSessions(user.ID, input.SessionID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "revoked successfully!"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) revokeOtherSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	session := app.contextGetSession(r)
+
+	sessionIDs, err := app.models.Sessions.DeleteAllForUser(user.ID, session.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	app.manager.closeSessions(user.ID, sessionIDs...)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"revoked": len(sessionIDs)}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	session := app.contextGetSession(r)
+
+	err := app.models.Sessions.Delete(session.ID, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrSessionNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+	app.manager.closeSessions(user.ID, session.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "logged out"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) refreshTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	vdtr := validator.New()
+	if data.ValidateTokenPlainText(vdtr, input.RefreshToken); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	session, token, refreshToken, err := app.models.Sessions.Refresh(
+		input.RefreshToken,
+		realip.FromRequest(r),
+		app.config.tokens.accessTTL,
+		app.config.tokens.refreshTTL,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		case errors.Is(err, data.ErrRefreshTokenReused):
+			app.manager.closeSessions(session.UserID, session.ID)
+			app.errorResponse(
+				w,
+				r,
+				http.StatusUnauthorized,
+				"refresh token was already used, the session has been signed out",
+			)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"authentication_token": token, "refresh_token": refreshToken}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
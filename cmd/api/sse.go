@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+)
+
+const (
+	sseHeartbeat = 15 * time.Second
+	sseRetry     = 3 * time.Second
+)
+
+// serveSSE streams the same events as the websocket as Server-Sent Events,
+// for networks that break websocket upgrades. Every event carries the same
+// JSON a websocket frame would in its data field.
+//
+// A client that reconnects with Last-Event-ID is first sent what it missed,
+// or a resync event when the server no longer has all of it.
+func (manager *Manager) serveSSE(w http.ResponseWriter, r *http.Request) {
+	app := manager.app
+	user := app.contextGetUser(r)
+	key := app.contextGetAPIKey(r)
+
+	chatsID, err := app.models.Users.GetChatsID(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	var client *Client
+	if key != nil {
+		chatsID = slices.DeleteFunc(chatsID, func(chatID uuid.UUID) bool {
+			return !key.AllowsChat(chatID)
+		})
+		client = newClient(
+			nil,
+			manager,
+			user,
+			botSession(user, key),
+			chatsID,
+			map[uuid.UUID]data.ChatPreferences{},
+			map[uuid.UUID]bool{},
+		)
+		client.apiKey = key
+	} else {
+		preferences, err := app.models.Users.GetChatPreferences(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		blocked, err := app.models.Blocks.GetBlockedIDs(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		client = newClient(nil, manager, user, app.contextGetSession(r), chatsID, preferences, blocked)
+	}
+
+	// the header is not available to clients on their first connection
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	rc := http.NewResponseController(w)
+
+	var lastID uint64
+	resume := false
+	if lastEventID != "" {
+		lastID, resume = manager.history.parseID(lastEventID)
+	}
+
+	// the history is read in the same step the client is added, every event
+	// after replayedID reaches it through its queue, in order
+	events, replayedID, ok := manager.subscribe(client, lastID, resume)
+	defer manager.removeClient(client)
+
+	rc.SetWriteDeadline(time.Now().Add(writeWait))
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry.Milliseconds())
+
+	switch {
+	case lastEventID == "":
+		// hand the client an id to resume from even if no event comes
+		fmt.Fprintf(w, "id: %s\n\n", manager.history.formatID(replayedID))
+	case !resume || !ok:
+		// the client has to fetch its chats again, it resumes from here
+		event, err := newEvent(EventResync, struct{}{})
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"error marshaling resync event": err.Error()})
+			return
+		}
+		event.ID = replayedID
+		events = []Event{event}
+	}
+
+	for _, event := range events {
+		if err := manager.writeSSE(w, event); err != nil {
+			return
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(sseHeartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event := <-client.egress:
+			rc.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := manager.writeSSE(w, event); err != nil {
+				return
+			}
+		case now := <-ticker.C:
+			rc.SetWriteDeadline(time.Now().Add(writeWait))
+			if client.expired(now) {
+				event, err := newEvent(EventTokenExpired, struct{}{})
+				if err == nil {
+					manager.writeSSE(w, event)
+					rc.Flush()
+				}
+				return
+			}
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case <-client.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// writeSSE writes the event as one Server-Sent Event, events the manager
+// numbered carry their id.
+func (manager *Manager) writeSSE(w io.Writer, event Event) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		manager.app.logger.PrintError(
+			err,
+			map[string]string{"error marshaling data: ": err.Error()},
+		)
+		return nil
+	}
+
+	if event.ID != 0 {
+		_, err = fmt.Fprintf(w, "id: %s\n", manager.history.formatID(event.ID))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "data: %s\n\n", payload)
+	return err
+}
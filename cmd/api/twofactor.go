@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/totp"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+const (
+	totpIssuer          = "Gocha"
+	twoFactorPendingTTL = 5 * time.Minute
+)
+
+func (app *application) enrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.Enroll(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTwoFactorEnabled):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"secret":           secret,
+		"provisioning_uri": totp.ProvisioningURI(secret, totpIssuer, user.Email),
+	}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	vdtr := validator.New()
+
+	if data.ValidateTwoFactorCode(vdtr, input.Code); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	twoFactor, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTwoFactorNotEnabled):
+			app.errorResponse(w, r, http.StatusConflict, "two-factor authentication was not enrolled")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if twoFactor.Confirmed {
+		app.errorResponse(w, r, http.StatusConflict, data.ErrTwoFactorEnabled.Error())
+		return
+	}
+
+	step, ok := totp.Validate(twoFactor.Secret, input.Code, time.Now())
+	if !ok {
+		vdtr.AddError("code", "is incorrect")
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	codes, hashes, err := data.GenerateRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TwoFactor.Confirm(user.ID, step, hashes)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTwoFactorEnabled):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// disableTwoFactorHandler turns two-factor authentication off. It takes the
+// password and a code, accounts without a password only give the code, which
+// may be a recovery code.
+func (app *application) disableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Password     string `json:"password"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	vdtr := validator.New()
+
+	if user.Password.IsSet() {
+		data.ValidatePasswordPlainText(vdtr, input.Password)
+	}
+	if input.RecoveryCode == "" {
+		data.ValidateTwoFactorCode(vdtr, input.Code)
+	}
+
+	if !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	if user.Password.IsSet() {
+		match, err := user.Password.Matches(input.Password)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !match {
+			vdtr.AddError("password", "is incorrect")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+			return
+		}
+	}
+
+	twoFactor, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTwoFactorNotEnabled):
+			app.errorResponse(w, r, http.StatusConflict, err.Error())
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if twoFactor.Confirmed {
+		ok, err := app.checkSecondFactor(user, twoFactor, input.Code, input.RecoveryCode)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !ok {
+			if input.RecoveryCode != "" {
+				vdtr.AddError("recovery_code", "is incorrect")
+			} else {
+				vdtr.AddError("code", "is incorrect")
+			}
+			app.failedValidationResponse(w, r, vdtr.Errors)
+			return
+		}
+	}
+
+	err = app.models.TwoFactor.Disable(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": "two-factor authentication was disabled"}
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkSecondFactor reports whether the code, or the recovery code when one
+// is given, is good for the user. Either is used up so it cannot be replayed.
+func (app *application) checkSecondFactor(
+	user *data.User,
+	twoFactor *data.TwoFactor,
+	code, recoveryCode string,
+) (bool, error) {
+	if recoveryCode != "" {
+		return app.models.TwoFactor.UseRecoveryCode(user.ID, recoveryCode)
+	}
+
+	step, ok := totp.ValidateAfter(twoFactor.Secret, code, time.Now(), twoFactor.LastUsedStep)
+	if !ok {
+		return false, nil
+	}
+	return app.models.TwoFactor.UseStep(user.ID, step)
+}
+
+// requireSecondFactor answers a correct password with a short lived token
+// that has to be exchanged together with a code for the real session.
+func (app *application) requireSecondFactor(w http.ResponseWriter, r *http.Request, user *data.User) {
+	token, err := app.models.Tokens.New(user.ID, twoFactorPendingTTL, data.Scope2FAPending)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"two_factor_required": true,
+		"two_factor_token":    token,
+	}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) verifySecondFactorHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Token        string `json:"token"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+		DeviceName   string `json:"device_name"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	vdtr := validator.New()
+
+	data.ValidateTokenPlainText(vdtr, input.Token)
+	if input.RecoveryCode == "" {
+		data.ValidateTwoFactorCode(vdtr, input.Code)
+	}
+
+	if !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.Scope2FAPending, input.Token)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			vdtr.AddError("token", "invalid or expired two-factor token")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	twoFactor, err := app.models.TwoFactor.Get(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	ok, err := app.checkSecondFactor(user, twoFactor, input.Code, input.RecoveryCode)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		failedAttempts, err := app.models.TwoFactor.Fail(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// too many guesses, the password has to be entered again
+		if failedAttempts >= data.MaxTwoFactorAttempts {
+			err = app.models.Tokens.DeleteAllForUser(data.Scope2FAPending, user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			err = app.models.TwoFactor.ResetFailures(user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(data.Scope2FAPending, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.startSession(w, r, user, input.DeviceName)
+}
@@ -5,6 +5,9 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/tomasen/realip"
+
 	"github.com/mf751/gocha/internal/data"
 	"github.com/mf751/gocha/internal/validator"
 )
@@ -13,6 +16,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	var input struct {
 		Name     string `json:"name"`
 		Email    string `json:"email"`
+		Username string `json:"username"`
 		Password string `json:"password"`
 	}
 
@@ -25,6 +29,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	user := &data.User{
 		Name:      input.Name,
 		Email:     input.Email,
+		Username:  data.NormalizeUsername(input.Username),
 		Activated: false,
 	}
 
@@ -48,30 +53,27 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 			vdtr.AddError("email", "a user with this email address already exists")
 			app.failedValidationResponse(w, r, vdtr.Errors)
 			return
+		case errors.Is(err, data.ErrDuplicateUsername):
+			vdtr.AddError("username", "this username is already taken")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+			return
 		default:
 			app.serverErrorResponse(w, r, err)
 			return
 		}
 	}
 
-	// --[ Activation Tokens ]--
-
-	// token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
-	// if err != nil {
-	// 	app.serverErrorResponse(w, r, err)
-	// 	return
-	// }
-	//
-	// app.background(func() {
-	// 	data := map[string]interface{}{
-	// 		"activationToken": token.PlainText,
-	// 		"userID":          user.ID,
-	// 	}
-	// 	err = app.mailer.Send(user.Email, "user_welcome.tmpl", data)
-	// 	if err != nil {
-	// 		app.logger.PrintError(err, nil)
-	// 	}
-	// })
+	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendEmail(user.Email, "user_welcome.tmpl", map[string]interface{}{
+		"activationToken": token.PlainText,
+		"userID":          user.ID,
+		"name":            user.Name,
+	})
 
 	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
@@ -81,8 +83,9 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	var input struct {
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		DeviceName string `json:"device_name"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -123,24 +126,53 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeAuthentication, user.ID)
+	enabled, err := app.models.TwoFactor.IsEnabled(user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 2*24*time.Hour, data.ScopeAuthentication)
+	if enabled {
+		app.requireSecondFactor(w, r, user)
+		return
+	}
+
+	app.startSession(w, r, user, input.DeviceName)
+}
+
+// startSession signs the user in on a new device and responds with the
+// session's tokens.
+func (app *application) startSession(w http.ResponseWriter, r *http.Request, user *data.User, deviceName string) {
+	if deviceName == "" {
+		deviceName = r.UserAgent()
+	}
+
+	// signing in again keeps an account that was scheduled for deletion
+	_, err := app.models.Users.CancelDeletion(user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(
-		w,
-		http.StatusCreated,
-		envelope{"authentication_token": token, "user": user},
-		nil,
+	session, token, refreshToken, err := app.models.Sessions.New(
+		user.ID,
+		deviceName,
+		realip.FromRequest(r),
+		app.config.tokens.accessTTL,
+		app.config.tokens.refreshTTL,
 	)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{
+		"authentication_token": token,
+		"refresh_token":        refreshToken,
+		"user":                 user,
+		"session":              session,
+	}
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -148,7 +180,35 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 
 func (app *application) getUserChatsHandler(w http.ResponseWriter, r *http.Request) {
 	user := app.contextGetUser(r)
-	chats, err := app.models.Users.GetChats(user.ID)
+	qs := r.URL.Query()
+
+	filter := data.ChatListFilter{
+		IncludeHidden: qs.Get("include_hidden") == "true",
+		Archived:      qs.Get("archived") == "true",
+	}
+
+	if folderIDString := qs.Get("folder"); folderIDString != "" {
+		folderID, err := uuid.Parse(folderIDString)
+		if err != nil {
+			app.errorResponse(w, r, http.StatusUnprocessableEntity, "Bad UUID")
+			return
+		}
+
+		// make sure the folder is the user's own before listing it
+		_, err = app.models.Folders.Get(folderID, user.ID)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrFolderNotFound):
+				app.errorResponse(w, r, http.StatusUnprocessableEntity, err.Error())
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		filter.FolderID = uuid.NullUUID{UUID: folderID, Valid: true}
+	}
+
+	chats, err := app.models.Users.GetChats(user.ID, filter)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -167,3 +227,138 @@ func (app *application) getUserInfoHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlainText string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	vdtr := validator.New()
+
+	if data.ValidateTokenPlainText(vdtr, input.TokenPlainText); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlainText)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			vdtr.AddError("token", "invalid or expired activation token")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Users.Activate(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+	user.Activated = true
+
+	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	vdtr := validator.New()
+
+	if data.ValidateEmail(vdtr, input.Email); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(input.Email)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			vdtr.AddError("email", "no matching email address found")
+			app.failedValidationResponse(w, r, vdtr.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if user.Activated {
+		vdtr.AddError("email", "user has already been activated")
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.sendEmail(user.Email, "token_activation.tmpl", map[string]interface{}{
+		"activationToken": token.PlainText,
+		"name":            user.Name,
+	})
+
+	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) searchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	vdtr := validator.New()
+
+	search := data.NormalizeUsername(app.readString(qs, "q", ""))
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, vdtr),
+		PageSize:     app.readInt(qs, "page_size", 20, vdtr),
+		Sort:         "relevance",
+		SortSafelist: data.UserSearchSafelist,
+	}
+
+	vdtr.Check(search != "", "q", "must be provided")
+	vdtr.Check(len(search) <= 100, "q", "cannot be more than 100 characters long")
+	if data.ValidateFilters(vdtr, filters); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+	users, metadata, err := app.models.Users.Search(user.ID, search, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": users, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+	"github.com/mf751/gocha/internal/safehttp"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+const (
+	webhookPollInterval = 5 * time.Second
+	webhookBatchSize    = 20
+	webhookTimeout      = 10 * time.Second
+	// webhookLease must outlast webhookTimeout, a claimed delivery is only
+	// handed out again once it runs out.
+	webhookLease        = time.Minute
+	webhookLogRetention = 30 * 24 * time.Hour
+)
+
+// WebhookPayload is the body of every delivery, Data is the same payload the
+// matching websocket event carries.
+type WebhookPayload struct {
+	ID        uuid.UUID   `json:"id"`
+	Event     string      `json:"event"`
+	ChatID    uuid.UUID   `json:"chat_id"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+type MemberJoinedWebhook struct {
+	ChatID   uuid.UUID `json:"chat_id"`
+	UserID   uuid.UUID `json:"user_id"`
+	UserName string    `json:"user_name"`
+}
+
+type MemberLeftWebhook struct {
+	ChatID uuid.UUID `json:"chat_id"`
+	UserID uuid.UUID `json:"user_id"`
+	Reason string    `json:"reason"`
+	By     uuid.UUID `json:"by"`
+}
+
+func (app *application) createWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ChatID uuid.UUID `json:"chat_id"`
+		URL    string    `json:"url"`
+		Events []string  `json:"events"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := &data.Webhook{
+		ChatID:    input.ChatID,
+		CreatedBy: app.contextGetUser(r).ID,
+		URL:       input.URL,
+		Events:    input.Events,
+	}
+
+	vdtr := validator.New()
+
+	if data.ValidateWebhook(vdtr, webhook); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	if chat := app.authorizeChatAdmin(w, r, input.ChatID); chat == nil {
+		return
+	}
+
+	err = app.models.Webhooks.Insert(webhook)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// the secret is only ever shown here
+	err = app.writeJSON(w, http.StatusCreated, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	chatIDString := r.URL.Query().Get("chat_id")
+	chatID, err := uuid.Parse(chatIDString)
+	if err != nil || chatIDString == "" {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "Bad UUID")
+		return
+	}
+
+	if chat := app.authorizeChatAdmin(w, r, chatID); chat == nil {
+		return
+	}
+
+	webhooks, err := app.models.Webhooks.GetAllForChat(chatID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhooks": webhooks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// authorizeWebhook loads the webhook and checks that the request user is an
+// admin of its chat. It writes the error response itself and returns nil
+// when they are not.
+func (app *application) authorizeWebhook(
+	w http.ResponseWriter,
+	r *http.Request,
+	webhookID uuid.UUID,
+) *data.Webhook {
+	webhook, err := app.models.Webhooks.Get(webhookID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrWebhookNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil
+	}
+
+	if chat := app.authorizeChatAdmin(w, r, webhook.ChatID); chat == nil {
+		return nil
+	}
+	return webhook
+}
+
+func (app *application) updateWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		WebhookID uuid.UUID `json:"webhook_id"`
+		URL       *string   `json:"url"`
+		Events    []string  `json:"events"`
+		Enabled   *bool     `json:"enabled"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := app.authorizeWebhook(w, r, input.WebhookID)
+	if webhook == nil {
+		return
+	}
+
+	if input.URL != nil {
+		webhook.URL = *input.URL
+	}
+	if input.Events != nil {
+		webhook.Events = input.Events
+	}
+	if input.Enabled != nil {
+		webhook.Enabled = *input.Enabled
+	}
+
+	vdtr := validator.New()
+
+	if data.ValidateWebhook(vdtr, webhook); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	err = app.models.Webhooks.Update(webhook)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrWebhookNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"webhook": webhook}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		WebhookID uuid.UUID `json:"webhook_id"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	webhook := app.authorizeWebhook(w, r, input.WebhookID)
+	if webhook == nil {
+		return
+	}
+
+	err = app.models.Webhooks.Delete(webhook.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrWebhookNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": "webhook deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) listWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+	vdtr := validator.New()
+
+	webhookIDString := qs.Get("webhook_id")
+	webhookID, err := uuid.Parse(webhookIDString)
+	if err != nil || webhookIDString == "" {
+		app.errorResponse(w, r, http.StatusUnprocessableEntity, "Bad UUID")
+		return
+	}
+
+	status := app.readString(qs, "status", "")
+	filters := data.Filters{
+		Page:         app.readInt(qs, "page", 1, vdtr),
+		PageSize:     app.readInt(qs, "page_size", 20, vdtr),
+		Sort:         app.readString(qs, "sort", "-created_at"),
+		SortSafelist: data.DeliverySortSafelist,
+	}
+
+	vdtr.Check(status == "" || vdtr.In(status, data.DeliveryStatuses...), "status", "invalid status value")
+	if data.ValidateFilters(vdtr, filters); !vdtr.Valid() {
+		app.failedValidationResponse(w, r, vdtr.Errors)
+		return
+	}
+
+	webhook := app.authorizeWebhook(w, r, webhookID)
+	if webhook == nil {
+		return
+	}
+
+	deliveries, metadata, err := app.models.Webhooks.Deliveries(webhook.ID, status, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"data": deliveries, "metadata": metadata}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// dispatchWebhook queues the chat event for the chat's webhooks, it does so
+// in the background so the request does not wait on it.
+func (app *application) dispatchWebhook(chatID uuid.UUID, event string, payload interface{}) {
+	app.background(func() {
+		body, err := json.Marshal(WebhookPayload{
+			ID:        uuid.New(),
+			Event:     event,
+			ChatID:    chatID,
+			CreatedAt: time.Now(),
+			Data:      payload,
+		})
+		if err == nil {
+			err = app.models.Webhooks.Enqueue(chatID, event, body)
+		}
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{
+				"job":     "dispatch webhook",
+				"chat_id": chatID.String(),
+				"event":   event,
+			})
+		}
+	})
+}
+
+// deliverWebhooks works through the delivery queue, several servers can run
+// it side by side as each delivery is only claimed by one of them.
+func (app *application) deliverWebhooks() {
+	// the receivers are picked by chat admins, they must not get to reach
+	// anything on our own network
+	client := safehttp.NewClient(webhookTimeout)
+
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	var lastPurge time.Time
+	for {
+		if time.Since(lastPurge) > time.Hour {
+			err := app.models.Webhooks.PurgeDeliveries(time.Now().Add(-webhookLogRetention))
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{"job": "purge webhook deliveries"})
+			}
+			lastPurge = time.Now()
+		}
+
+		deliveries, err := app.models.Webhooks.Claim(webhookBatchSize, webhookLease)
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"job": "deliver webhooks"})
+		}
+
+		var wg sync.WaitGroup
+		for _, delivery := range deliveries {
+			wg.Add(1)
+			app.background(func() {
+				defer wg.Done()
+				app.deliverWebhook(client, delivery)
+			})
+		}
+		wg.Wait()
+
+		// a full batch means more deliveries may already be due
+		if len(deliveries) == webhookBatchSize {
+			continue
+		}
+		<-ticker.C
+	}
+}
+
+// deliverWebhook posts the delivery once and records how it went.
+func (app *application) deliverWebhook(client *http.Client, delivery *data.WebhookDelivery) {
+	attempt := postWebhook(client, delivery, time.Now())
+
+	disabled, err := app.models.Webhooks.RecordAttempt(delivery, attempt)
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"job":         "deliver webhooks",
+			"delivery_id": delivery.ID.String(),
+		})
+		return
+	}
+	if disabled {
+		app.logger.PrintInfo("webhook disabled after repeated failures", map[string]string{
+			"webhook_id": delivery.WebhookID.String(),
+		})
+	}
+}
+
+// postWebhook sends the delivery to its webhook.
+//
+// Receivers verify a delivery by computing the HMAC-SHA256 of
+// "<X-Gocha-Timestamp>.<body>" with the webhook's secret and comparing it to
+// the hex digest in X-Gocha-Signature.
+func postWebhook(client *http.Client, delivery *data.WebhookDelivery, now time.Time) data.WebhookAttempt {
+	var attempt data.WebhookAttempt
+
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Payload))
+	if err == nil {
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "Gocha-Webhook")
+		req.Header.Set("X-Gocha-Event", delivery.Event)
+		req.Header.Set("X-Gocha-Delivery", delivery.ID.String())
+		req.Header.Set("X-Gocha-Timestamp", timestamp)
+		req.Header.Set("X-Gocha-Signature", "sha256="+signWebhook(delivery.Secret, timestamp, delivery.Payload))
+
+		var res *http.Response
+		res, err = client.Do(req)
+		if err == nil {
+			io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+			res.Body.Close()
+			attempt.ResponseStatus = res.StatusCode
+		}
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	return attempt
+}
+
+func signWebhook(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/data"
+)
+
+// testReceiver is a stand-in webhook receiver that checks every delivery's
+// signature and fails the first few of them.
+type testReceiver struct {
+	secret    string
+	failFirst int
+
+	mu       sync.Mutex
+	requests int
+	badSigs  int
+}
+
+func (receiver *testReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	mac := hmac.New(sha256.New, []byte(receiver.secret))
+	mac.Write([]byte(r.Header.Get("X-Gocha-Timestamp") + "."))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+
+	receiver.requests++
+	if !hmac.Equal([]byte(r.Header.Get("X-Gocha-Signature")), []byte(want)) {
+		receiver.badSigs++
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if receiver.requests <= receiver.failFirst {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newTestDelivery(url, secret string) *data.WebhookDelivery {
+	return &data.WebhookDelivery{
+		ID:        uuid.New(),
+		WebhookID: uuid.New(),
+		Event:     data.WebhookNewMessage,
+		Payload:   []byte(`{"event":"new_message"}`),
+		Status:    data.DeliveryPending,
+		URL:       url,
+		Secret:    secret,
+	}
+}
+
+func TestWebhookDeliveryRetries(t *testing.T) {
+	receiver := &testReceiver{secret: "secret", failFirst: 3}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	delivery := newTestDelivery(server.URL, receiver.secret)
+	now := time.Now()
+
+	wantBackoff := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute}
+	for i, backoff := range wantBackoff {
+		attempt := postWebhook(server.Client(), delivery, now)
+		if attempt.Delivered() {
+			t.Fatalf("attempt %d was delivered, the receiver failed it", i+1)
+		}
+
+		delivery.Record(attempt, now)
+		if delivery.Status != data.DeliveryPending {
+			t.Fatalf("attempt %d: got status %q, want %q", i+1, delivery.Status, data.DeliveryPending)
+		}
+		if got := delivery.NextAttemptAt.Sub(now); got != backoff {
+			t.Errorf("attempt %d: got backoff %s, want %s", i+1, got, backoff)
+		}
+		now = delivery.NextAttemptAt
+	}
+
+	attempt := postWebhook(server.Client(), delivery, now)
+	delivery.Record(attempt, now)
+	if delivery.Status != data.DeliveryDelivered {
+		t.Fatalf("got status %q, want %q: %+v", delivery.Status, data.DeliveryDelivered, attempt)
+	}
+	if delivery.Attempts != 4 {
+		t.Errorf("got %d attempts, want 4", delivery.Attempts)
+	}
+	if receiver.badSigs != 0 {
+		t.Errorf("the receiver saw %d bad signatures", receiver.badSigs)
+	}
+}
+
+func TestWebhookBadSignature(t *testing.T) {
+	receiver := &testReceiver{secret: "secret"}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	attempt := postWebhook(server.Client(), newTestDelivery(server.URL, "other secret"), time.Now())
+	if attempt.Delivered() || receiver.badSigs != 1 {
+		t.Fatalf("a delivery signed with the wrong secret was accepted: %+v", attempt)
+	}
+}
+
+func TestWebhookGivesUpAndDisables(t *testing.T) {
+	receiver := &testReceiver{secret: "secret", failFirst: 1 << 30}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	webhook := &data.Webhook{Enabled: true}
+	now := time.Now()
+
+	attempts := 0
+	for webhook.Enabled {
+		delivery := newTestDelivery(server.URL, receiver.secret)
+		for delivery.Status == data.DeliveryPending && webhook.Enabled {
+			attempt := postWebhook(server.Client(), delivery, now)
+			delivery.Record(attempt, now)
+			disabled := webhook.Record(attempt)
+			attempts++
+
+			if disabled != (attempts == data.WebhookFailureLimit) {
+				t.Fatalf("attempt %d: got disabled %v", attempts, disabled)
+			}
+		}
+		if webhook.Enabled && delivery.Attempts != data.MaxWebhookAttempts {
+			t.Fatalf("delivery given up after %d attempts, want %d", delivery.Attempts, data.MaxWebhookAttempts)
+		}
+		if attempts > data.WebhookFailureLimit {
+			t.Fatal("the webhook was never disabled")
+		}
+	}
+
+	// a success in between starts the count over
+	webhook = &data.Webhook{Enabled: true, FailureCount: data.WebhookFailureLimit - 1}
+	webhook.Record(data.WebhookAttempt{ResponseStatus: http.StatusOK})
+	if webhook.FailureCount != 0 {
+		t.Errorf("got failure count %d after a success, want 0", webhook.FailureCount)
+	}
+}
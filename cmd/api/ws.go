@@ -3,7 +3,10 @@ package main
 import (
 	"errors"
 	"net/http"
+	"slices"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 
 	"github.com/mf751/gocha/internal/data"
@@ -15,9 +18,19 @@ var Upgrader = websocket.Upgrader{
 	WriteBufferSize: 1024,
 }
 
+// botSocketExpiry stands in for the token expiry of sockets opened with API
+// keys that never expire.
+var botSocketExpiry = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
 func (manager *Manager) serveWS(w http.ResponseWriter, r *http.Request) {
+	key := manager.app.contextGetAPIKey(r)
+	if key != nil {
+		manager.serveBotWS(w, r, key)
+		return
+	}
+
 	authToken := r.URL.Query().Get("token")
-	user, err := manager.app.models.Users.GetForToken(data.ScopeAuthentication, authToken)
+	session, user, err := manager.app.models.Sessions.GetForToken(authToken)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -29,6 +42,55 @@ func (manager *Manager) serveWS(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if manager.app.config.requireActivation && !user.Activated {
+		manager.app.inactiveAccountResponse(w, r)
+		return
+	}
+
+	conn, err := Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+
+	chatsID, err := manager.app.models.Users.GetChatsID(user.ID)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	preferences, err := manager.app.models.Users.GetChatPreferences(user.ID)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	blocked, err := manager.app.models.Blocks.GetBlockedIDs(user.ID)
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	client := newClient(conn, manager, user, session, chatsID, preferences, blocked)
+
+	manager.addClient(client)
+
+	go client.readMessages()
+	go client.writeMessages()
+}
+
+// serveBotWS opens a socket for a bot that authenticated with its API key in
+// the Authorization header. The socket only follows the chats the key is
+// scoped to and carries the key's id in place of a session, so revoking the
+// key closes it.
+func (manager *Manager) serveBotWS(w http.ResponseWriter, r *http.Request, key *data.APIKey) {
+	if !key.Allows(data.PermissionReadMessages) {
+		manager.app.botNotPermittedResponse(w, r)
+		return
+	}
+
+	user := manager.app.contextGetUser(r)
+	session := botSession(user, key)
+
 	conn, err := Upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return
@@ -39,10 +101,37 @@ func (manager *Manager) serveWS(w http.ResponseWriter, r *http.Request) {
 		conn.Close()
 		return
 	}
+	chatsID = slices.DeleteFunc(chatsID, func(chatID uuid.UUID) bool {
+		return !key.AllowsChat(chatID)
+	})
 
-	client := newClient(conn, manager, user.ID, chatsID)
+	client := newClient(
+		conn,
+		manager,
+		user,
+		session,
+		chatsID,
+		map[uuid.UUID]data.ChatPreferences{},
+		map[uuid.UUID]bool{},
+	)
+	client.apiKey = key
 
 	manager.addClient(client)
 
+	go client.readMessages()
 	go client.writeMessages()
 }
+
+// botSession stands in for the session of a bot connection, its id is the
+// key's so revoking the key closes the connection.
+func botSession(user *data.User, key *data.APIKey) *data.Session {
+	session := &data.Session{
+		ID:          key.ID,
+		UserID:      user.ID,
+		TokenExpiry: botSocketExpiry,
+	}
+	if key.Expiry != nil {
+		session.TokenExpiry = *key.Expiry
+	}
+	return session
+}
@@ -0,0 +1,168 @@
+package data
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const DeletedUserName = "Deleted account"
+
+// ScheduleDeletion marks the account for deletion, it is anonymized once the
+// grace period is over unless the user signs in again before that.
+func (model UserModel) ScheduleDeletion(userID uuid.UUID) (time.Time, error) {
+	sqlQuery := `
+UPDATE users
+SET deleted_at = NOW(), version = version + 1
+WHERE id = $1
+RETURNING deleted_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var deletedAt time.Time
+	err := model.DB.QueryRowContext(ctx, sqlQuery, userID).Scan(&deletedAt)
+	return deletedAt, err
+}
+
+// CancelDeletion takes back a scheduled deletion that has not been carried
+// out yet, reporting whether there was one.
+func (model UserModel) CancelDeletion(userID uuid.UUID) (bool, error) {
+	sqlQuery := `
+UPDATE users
+SET deleted_at = NULL, version = version + 1
+WHERE id = $1
+AND deleted_at IS NOT NULL
+AND anonymized_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// GetDeletedBefore returns the accounts whose deletion is due.
+func (model UserModel) GetDeletedBefore(deletedBefore time.Time) ([]uuid.UUID, error) {
+	sqlQuery := `
+SELECT id FROM users
+WHERE deleted_at < $1
+AND anonymized_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var userIDs []uuid.UUID
+	for rows.Next() {
+		var userID uuid.UUID
+		err = rows.Scan(&userID)
+		if err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+
+	err = rows.Err()
+	return userIDs, err
+}
+
+// Anonymize strips a deleted account of everything that identifies the
+// person behind it. The row itself stays so the messages they sent keep
+// their place in other people's chats, shown under DeletedUserName. It
+// returns the stored files that belonged to the account.
+func (model UserModel) Anonymize(userID uuid.UUID) ([]string, error) {
+	sqlQuery := `
+SELECT avatar FROM users
+WHERE id = $1
+FOR UPDATE
+	`
+	sqlQuery2 := `
+SELECT file FROM user_exports
+WHERE user_id = $1
+AND file <> ''
+	`
+	sqlQuery3 := `
+UPDATE users
+SET name = $2, email = $3, username = NULL, password_hash = '', activated = false, bio = '',
+	avatar = '', status_text = '', status_emoji = '', status_expires_at = NULL,
+	discoverability = 'nobody', anonymized_at = NOW(), version = version + 1
+WHERE id = $1
+	`
+	cleanup := []string{
+		`DELETE FROM sessions WHERE user_id = $1`,
+		`DELETE FROM tokens WHERE user_id = $1`,
+		`DELETE FROM user_identities WHERE user_id = $1`,
+		`DELETE FROM user_totp WHERE user_id = $1`,
+		`DELETE FROM recovery_codes WHERE user_id = $1`,
+		`DELETE FROM user_blocks WHERE blocker_id = $1 OR blocked_id = $1`,
+		`DELETE FROM chat_folders WHERE user_id = $1`,
+		`DELETE FROM message_reactions WHERE user_id = $1`,
+		`DELETE FROM user_exports WHERE user_id = $1`,
+		`DELETE FROM api_keys WHERE bot_id IN (SELECT id FROM users WHERE bot_owner_id = $1)`,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var files []string
+
+	var avatar string
+	err = tx.QueryRowContext(ctx, sqlQuery, userID).Scan(&avatar)
+	if err != nil {
+		return nil, err
+	}
+	if avatar != "" {
+		files = append(files, avatar)
+	}
+
+	rows, err := tx.QueryContext(ctx, sqlQuery2, userID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var file string
+		err = rows.Scan(&file)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	email := "deleted-" + userID.String() + "@deleted.invalid"
+	_, err = tx.ExecContext(ctx, sqlQuery3, userID, DeletedUserName, email)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, query := range cleanup {
+		_, err = tx.ExecContext(ctx, query, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return files, tx.Commit()
+}
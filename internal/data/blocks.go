@@ -0,0 +1,216 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+var (
+	ErrBlockSelf      = errors.New("cannot block yourself")
+	ErrAlreadyBlocked = errors.New("user is already blocked")
+	ErrNotBlocked     = errors.New("user is not blocked")
+)
+
+type BlockedUser struct {
+	User      PublicProfile `json:"user"`
+	BlockedAt time.Time     `json:"blocked_at"`
+}
+
+type BlockModel struct {
+	DB *sql.DB
+}
+
+func (model BlockModel) Insert(blockerID, blockedID uuid.UUID) error {
+	if blockerID == blockedID {
+		return ErrBlockSelf
+	}
+
+	sqlQuery := `
+INSERT INTO user_blocks(blocker_id, blocked_id)
+VALUES($1, $2)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, sqlQuery, blockerID, blockedID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "user_blocks_pkey"`:
+			return ErrAlreadyBlocked
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (model BlockModel) Delete(blockerID, blockedID uuid.UUID) error {
+	sqlQuery := `
+DELETE FROM user_blocks
+WHERE blocker_id = $1
+AND blocked_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, blockerID, blockedID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotBlocked
+	}
+	return nil
+}
+
+// GetAllForUser lists the users the given user blocked, newest first.
+func (model BlockModel) GetAllForUser(userID uuid.UUID) ([]*BlockedUser, error) {
+	sqlQuery := `
+SELECT user_blocks.created_at, users.id, COALESCE(users.username, ''), users.name, users.bio,
+	users.avatar, users.status_text, users.status_emoji, users.status_expires_at
+FROM user_blocks
+JOIN users ON users.id = user_blocks.blocked_id
+WHERE user_blocks.blocker_id = $1
+ORDER BY user_blocks.created_at DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocked := []*BlockedUser{}
+	for rows.Next() {
+		var user User
+		var blockedUser BlockedUser
+		err = rows.Scan(
+			&blockedUser.BlockedAt,
+			&user.ID,
+			&user.Username,
+			&user.Name,
+			&user.Bio,
+			&user.Avatar,
+			&user.Status.Text,
+			&user.Status.Emoji,
+			&user.Status.ExpiresAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		user.normalizeProfile()
+		blockedUser.User = user.PublicProfile()
+		blocked = append(blocked, &blockedUser)
+	}
+
+	err = rows.Err()
+	return blocked, err
+}
+
+// GetBlockedIDs returns the ids of everyone the user blocked.
+func (model BlockModel) GetBlockedIDs(userID uuid.UUID) (map[uuid.UUID]bool, error) {
+	sqlQuery := `
+SELECT blocked_id FROM user_blocks
+WHERE blocker_id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	blocked := make(map[uuid.UUID]bool)
+	for rows.Next() {
+		var blockedID uuid.UUID
+		err = rows.Scan(&blockedID)
+		if err != nil {
+			return nil, err
+		}
+		blocked[blockedID] = true
+	}
+
+	err = rows.Err()
+	return blocked, err
+}
+
+// Between reports whether the user blocked any of the others or was blocked
+// by one of them.
+func (model BlockModel) Between(userID uuid.UUID, otherIDs ...uuid.UUID) (bool, error) {
+	sqlQuery := `
+SELECT EXISTS(
+  SELECT 1 FROM user_blocks
+  WHERE (blocker_id = $1 AND blocked_id = ANY($2::UUID[]))
+  OR (blocked_id = $1 AND blocker_id = ANY($2::UUID[]))
+)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	ids := make([]string, len(otherIDs))
+	for i, id := range otherIDs {
+		ids[i] = id.String()
+	}
+
+	var blocked bool
+	err := model.DB.QueryRowContext(ctx, sqlQuery, userID, pq.Array(ids)).Scan(&blocked)
+	return blocked, err
+}
+
+// Among reports whether any of the users blocked another one of them.
+func (model BlockModel) Among(userIDs ...uuid.UUID) (bool, error) {
+	sqlQuery := `
+SELECT EXISTS(
+  SELECT 1 FROM user_blocks
+  WHERE blocker_id = ANY($1::UUID[])
+  AND blocked_id = ANY($1::UUID[])
+)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	ids := make([]string, len(userIDs))
+	for i, id := range userIDs {
+		ids[i] = id.String()
+	}
+
+	var blocked bool
+	err := model.DB.QueryRowContext(ctx, sqlQuery, pq.Array(ids)).Scan(&blocked)
+	return blocked, err
+}
+
+// InDirectChat reports whether one side of a one to one chat blocked the
+// other, it is always false for any other kind of chat.
+func (model BlockModel) InDirectChat(chatID uuid.UUID) (bool, error) {
+	sqlQuery := `
+SELECT EXISTS(
+  SELECT 1 FROM chats
+  JOIN user_blocks ON (user_blocks.blocker_id = chats.peer_low AND user_blocks.blocked_id = chats.peer_high)
+    OR (user_blocks.blocker_id = chats.peer_high AND user_blocks.blocked_id = chats.peer_low)
+  WHERE chats.id = $1
+  AND chats.is_private
+  AND NOT chats.is_group_direct
+)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var blocked bool
+	err := model.DB.QueryRowContext(ctx, sqlQuery, chatID).Scan(&blocked)
+	return blocked, err
+}
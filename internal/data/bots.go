@@ -0,0 +1,381 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"github.com/mf751/gocha/internal/validator"
+)
+
+// The permissions an API key can be given, a bot can only use the routes
+// its key has the permission for.
+const (
+	PermissionReadMessages  = "messages:read"
+	PermissionSendMessages  = "messages:send"
+	PermissionWriteReaction = "reactions:write"
+)
+
+var Permissions = []string{
+	PermissionReadMessages,
+	PermissionSendMessages,
+	PermissionWriteReaction,
+}
+
+// secretLength is the length of the base32 encoding of the 32 random bytes
+// of API keys and incoming webhook tokens.
+const secretLength = 52
+
+var (
+	ErrBotNotFound    = errors.New("bot not found")
+	ErrAPIKeyNotFound = errors.New("api key not found")
+)
+
+// Bot is a user account that is driven by another service through API keys
+// instead of signing in, it belongs to the user who created it.
+type Bot struct {
+	ID        uuid.UUID `json:"id"`
+	Name      string    `json:"name"`
+	Username  string    `json:"username"`
+	OwnerID   uuid.UUID `json:"owner_id"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// APIKey authenticates a bot, it only grants its permissions and only in the
+// chats it is scoped to.
+type APIKey struct {
+	ID          uuid.UUID   `json:"id"`
+	BotID       uuid.UUID   `json:"bot_id"`
+	Name        string      `json:"name"`
+	PlainText   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	ChatIDs     []uuid.UUID `json:"chat_ids"`
+	Permissions []string    `json:"permissions"`
+	CreatedAt   time.Time   `json:"created_at"`
+	LastUsedAt  *time.Time  `json:"last_used_at"`
+	Expiry      *time.Time  `json:"expiry"`
+}
+
+func (key *APIKey) Allows(permission string) bool {
+	return slices.Contains(key.Permissions, permission)
+}
+
+func (key *APIKey) AllowsChat(chatID uuid.UUID) bool {
+	return slices.Contains(key.ChatIDs, chatID)
+}
+
+type BotModel struct {
+	DB *sql.DB
+}
+
+func ValidateBot(vdtr *validator.Validator, bot *Bot) {
+	vdtr.Check(bot.Name != "", "name", "must be provided")
+	vdtr.Check(len(bot.Name) <= 500, "name", "must not be more than 500 bytes long")
+	vdtr.Check(bot.Username != "", "username", "must be provided")
+	if bot.Username != "" {
+		ValidateUsername(vdtr, bot.Username)
+	}
+}
+
+func ValidateAPIKey(vdtr *validator.Validator, key *APIKey) {
+	vdtr.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+	vdtr.Check(len(key.ChatIDs) > 0, "chat_ids", "must contain at least one chat")
+	chatIDs := make([]string, len(key.ChatIDs))
+	for i, chatID := range key.ChatIDs {
+		chatIDs[i] = chatID.String()
+	}
+	vdtr.Check(validator.Unique(chatIDs), "chat_ids", "must not contain duplicate values")
+	vdtr.Check(len(key.Permissions) > 0, "permissions", "must contain at least one permission")
+	vdtr.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+	for _, permission := range key.Permissions {
+		vdtr.Check(
+			vdtr.In(permission, Permissions...),
+			"permissions",
+			"must only contain "+strings.Join(Permissions, ", "),
+		)
+	}
+	if key.Expiry != nil {
+		vdtr.Check(key.Expiry.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+func ValidateAPIKeyPlainText(vdtr *validator.Validator, keyPlainText string) {
+	vdtr.Check(keyPlainText != "", "key", "must be provided")
+	vdtr.Check(len(keyPlainText) == secretLength, "key", "must be 52 bytes long")
+}
+
+// generateSecretAndHash is generatePlainTextAndHash for secrets that live
+// long, it uses twice the randomness.
+func generateSecretAndHash() (string, []byte, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	plainText := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	hash := sha256.Sum256([]byte(plainText))
+	return plainText, hash[:], nil
+}
+
+// Insert creates the bot's user account, bots have no email or password to
+// sign in with.
+func (model BotModel) Insert(bot *Bot) error {
+	sqlQuery := `
+INSERT INTO users(id, name, email, password_hash, activated, username, is_bot, bot_owner_id, discoverability)
+VALUES($1, $2, $3, '', true, $4, true, $5, 'everyone')
+RETURNING created_at
+	`
+	bot.ID = uuid.New()
+	args := []interface{}{
+		bot.ID,
+		bot.Name,
+		"bot-" + bot.ID.String() + "@bots.invalid",
+		NormalizeUsername(bot.Username),
+		bot.OwnerID,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(&bot.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_username_key"`:
+			return ErrDuplicateUsername
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+// Get returns the bot if it belongs to the given owner.
+func (model BotModel) Get(botID, ownerID uuid.UUID) (*Bot, error) {
+	sqlQuery := `
+SELECT id, name, COALESCE(username, ''), bot_owner_id, created_at
+FROM users
+WHERE id = $1
+AND bot_owner_id = $2
+AND is_bot = true
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var bot Bot
+	err := model.DB.QueryRowContext(ctx, sqlQuery, botID, ownerID).Scan(
+		&bot.ID,
+		&bot.Name,
+		&bot.Username,
+		&bot.OwnerID,
+		&bot.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrBotNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &bot, nil
+}
+
+func (model BotModel) GetAllForOwner(ownerID uuid.UUID) ([]*Bot, error) {
+	sqlQuery := `
+SELECT id, name, COALESCE(username, ''), bot_owner_id, created_at
+FROM users
+WHERE bot_owner_id = $1
+AND is_bot = true
+ORDER BY created_at DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bots := []*Bot{}
+	for rows.Next() {
+		var bot Bot
+		err = rows.Scan(&bot.ID, &bot.Name, &bot.Username, &bot.OwnerID, &bot.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		bots = append(bots, &bot)
+	}
+	return bots, rows.Err()
+}
+
+// NewKey generates a key for the bot and stores its hash, the plain text is
+// only ever available on the returned key.
+func (model BotModel) NewKey(key *APIKey) error {
+	var err error
+	key.ID = uuid.New()
+	key.PlainText, key.Hash, err = generateSecretAndHash()
+	if err != nil {
+		return err
+	}
+
+	sqlQuery := `
+INSERT INTO api_keys(id, bot_id, name, hash, chat_ids, permissions, expiry)
+VALUES($1, $2, $3, $4, $5::UUID[], $6, $7)
+RETURNING created_at
+	`
+	args := []interface{}{
+		key.ID,
+		key.BotID,
+		key.Name,
+		key.Hash,
+		pq.Array(key.ChatIDs),
+		pq.Array(key.Permissions),
+		key.Expiry,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(&key.CreatedAt)
+}
+
+func (model BotModel) GetKeys(botID uuid.UUID) ([]*APIKey, error) {
+	sqlQuery := `
+SELECT id, bot_id, name, chat_ids, permissions, created_at, last_used_at, expiry
+FROM api_keys
+WHERE bot_id = $1
+ORDER BY created_at DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, botID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+	for rows.Next() {
+		var key APIKey
+		err = rows.Scan(
+			&key.ID,
+			&key.BotID,
+			&key.Name,
+			pq.Array(&key.ChatIDs),
+			pq.Array(&key.Permissions),
+			&key.CreatedAt,
+			&key.LastUsedAt,
+			&key.Expiry,
+		)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &key)
+	}
+	return keys, rows.Err()
+}
+
+func (model BotModel) DeleteKey(keyID, botID uuid.UUID) error {
+	sqlQuery := `
+DELETE FROM api_keys
+WHERE id = $1
+AND bot_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, keyID, botID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// GetForKey returns the API key and the bot it authenticates.
+func (model BotModel) GetForKey(keyPlainText string) (*APIKey, *User, error) {
+	keyHash := sha256.Sum256([]byte(keyPlainText))
+
+	sqlQuery := `
+SELECT api_keys.id, api_keys.name, api_keys.chat_ids, api_keys.permissions, api_keys.created_at,
+	api_keys.last_used_at, api_keys.expiry, users.id, users.created_at, users.name, users.activated,
+	users.bio, users.avatar, users.status_text, users.status_emoji, users.status_expires_at, users.version,
+	COALESCE(users.username, ''), users.discoverability, users.is_bot
+FROM api_keys
+JOIN users ON users.id = api_keys.bot_id
+WHERE api_keys.hash = $1
+AND (api_keys.expiry IS NULL OR api_keys.expiry > NOW())
+AND users.is_bot = true
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var key APIKey
+	var user User
+	err := model.DB.QueryRowContext(ctx, sqlQuery, keyHash[:]).Scan(
+		&key.ID,
+		&key.Name,
+		pq.Array(&key.ChatIDs),
+		pq.Array(&key.Permissions),
+		&key.CreatedAt,
+		&key.LastUsedAt,
+		&key.Expiry,
+		&user.ID,
+		&user.CreateAt.Sent,
+		&user.Name,
+		&user.Activated,
+		&user.Bio,
+		&user.Avatar,
+		&user.Status.Text,
+		&user.Status.Emoji,
+		&user.Status.ExpiresAt,
+		&user.Version,
+		&user.Username,
+		&user.Discoverability,
+		&user.IsBot,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	user.normalizeProfile()
+	key.BotID = user.ID
+	return &key, &user, nil
+}
+
+// TouchKey records that the key was just used.
+func (model BotModel) TouchKey(keyID uuid.UUID) error {
+	sqlQuery := `
+UPDATE api_keys
+SET last_used_at = NOW()
+WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, sqlQuery, keyID)
+	return err
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -18,6 +19,18 @@ var (
 	ErrPrivateChat    = errors.New("Private Chat")
 	ErrAlreadyMember  = errors.New("Already a member of chat")
 	ErrNotInChat      = errors.New("Not a membor of chat")
+	ErrBannedFromChat = errors.New("Banned from chat")
+	ErrNotBanned      = errors.New("User is not banned from chat")
+	ErrInviteOnly     = errors.New("Chat can only be joined with an invite")
+	ErrJoinRequired   = errors.New("Chat requires approval to join")
+	ErrNotOwner       = errors.New("User is not the owner of chat")
+	ErrNotRestorable  = errors.New("Chat cannot be restored")
+)
+
+const (
+	JoinPolicyOpen       = "open"
+	JoinPolicyInviteOnly = "invite_only"
+	JoinPolicyRequest    = "request"
 )
 
 type ChatModel struct {
@@ -25,11 +38,26 @@ type ChatModel struct {
 }
 
 type Chat struct {
-	ID        uuid.UUID `json:"id"`
-	Name      string    `json:"name"`
-	CreatedAt time.Time `json:"created_at"`
-	OwnerID   uuid.UUID `json:"owner_id"`
-	IsPrivate bool      `json:"is_private"`
+	ID         uuid.UUID  `json:"id"`
+	Name       string     `json:"name"`
+	CreatedAt  time.Time  `json:"created_at"`
+	OwnerID    uuid.UUID  `json:"owner_id"`
+	IsPrivate  bool       `json:"is_private"`
+	JoinPolicy string     `json:"join_policy"`
+	PeerID     *uuid.UUID `json:"peer_id,omitempty"`
+
+	IsGroupDirect bool `json:"is_group_direct"`
+
+	Description string `json:"description"`
+	Topic       string `json:"topic"`
+	Avatar      string `json:"-"`
+	HasAvatar   bool   `json:"has_avatar"`
+	IsListed    bool   `json:"is_listed"`
+
+	SlowModeSeconds  int  `json:"slow_mode_seconds"`
+	AnnouncementOnly bool `json:"announcement_only"`
+
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 type ChatUser struct {
@@ -42,6 +70,7 @@ type ChatWithLastMessage struct {
 	Chat        Chat            `json:"chat"`
 	LastMessage MessageWithUser `json:"last_message"`
 	Members     int             `json:"members"`
+	Preferences ChatPreferences `json:"preferences"`
 }
 
 func ValidateChatName(vdtr *validator.Validator, name string) {
@@ -49,21 +78,42 @@ func ValidateChatName(vdtr *validator.Validator, name string) {
 	vdtr.Check(name != "", "name", "must be provided")
 }
 
+func ValidateChatDescription(vdtr *validator.Validator, description string) {
+	vdtr.Check(
+		len(description) <= 500,
+		"description",
+		"cannot be more than 500 characters long",
+	)
+}
+
+func ValidateChatTopic(vdtr *validator.Validator, topic string) {
+	vdtr.Check(len(topic) <= 100, "topic", "cannot be more than 100 characters long")
+	vdtr.Check(!strings.ContainsAny(topic, "\r\n"), "topic", "must be a single line")
+}
+
+func ValidateJoinPolicy(vdtr *validator.Validator, joinPolicy string) {
+	vdtr.Check(
+		vdtr.In(joinPolicy, JoinPolicyOpen, JoinPolicyInviteOnly, JoinPolicyRequest),
+		"join_policy",
+		"must be one of open, invite_only or request",
+	)
+}
+
 func (model ChatModel) Insert(chat *Chat) (time.Time, error) {
 	sqlQuery := `
-INSERT INTO chats(id, name, owner_id, is_private)
-VALUES( $1, $2, $3, $4)
-RETURNING created_at
-	`
-	sqlQuery2 := `
-INSERT INTO users_chats(user_id, chat_id, is_admin)
-VALUES($1, $2, true)
+INSERT INTO chats(id, name, owner_id, is_private, join_policy)
+VALUES( $1, $2, $3, $4, $5)
+RETURNING created_at, is_listed
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	args := []interface{}{chat.ID, chat.Name, chat.OwnerID, chat.IsPrivate}
-	err := model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(&chat.CreatedAt)
+	if chat.JoinPolicy == "" {
+		chat.JoinPolicy = JoinPolicyOpen
+	}
+
+	args := []interface{}{chat.ID, chat.Name, chat.OwnerID, chat.IsPrivate, chat.JoinPolicy}
+	err := model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(&chat.CreatedAt, &chat.IsListed)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "chats_pkey"`:
@@ -72,35 +122,210 @@ VALUES($1, $2, true)
 			return time.Time{}, err
 		}
 	}
-	if chat.IsPrivate {
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-		model.DB.QueryRowContext(ctx, sqlQuery2, chat.OwnerID, chat.ID)
-	}
 	return chat.CreatedAt, nil
 }
 
-func (model ChatModel) Delete(userID, chatID uuid.UUID) error {
+// Delete marks the chat as deleted, it stays restorable by its owner until it
+// is purged.
+func (model ChatModel) Delete(userID, chatID uuid.UUID) (time.Time, error) {
 	sqlQuery := `
-DELETE FROM chats 
+UPDATE chats
+SET deleted_at = NOW()
 WHERE id = $1
 AND owner_id = $2
-RETURNING id
+AND deleted_at IS NULL
+RETURNING deleted_at
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := model.DB.QueryRowContext(ctx, sqlQuery, chatID, userID).Scan(&chatID)
+	var deletedAt time.Time
+	err := model.DB.QueryRowContext(ctx, sqlQuery, chatID, userID).Scan(&deletedAt)
 	if err == sql.ErrNoRows {
-		return ErrDeletionFailed
+		return time.Time{}, ErrDeletionFailed
 	}
-	return err
+	return deletedAt, err
+}
+
+// Restore brings back a chat deleted after the given time. A conversation
+// whose members already started a new one cannot be restored.
+func (model ChatModel) Restore(userID, chatID uuid.UUID, deletedAfter time.Time) error {
+	sqlQuery := `
+UPDATE chats
+SET deleted_at = NULL
+WHERE id = $1
+AND owner_id = $2
+AND deleted_at > $3
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, chatID, userID, deletedAfter)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "chats_direct_peers_idx"`:
+			return ErrDuplicateChat
+		case err.Error() == `pq: duplicate key value violates unique constraint "chats_member_key_idx"`:
+			return ErrDuplicateMembers
+		default:
+			return err
+		}
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotRestorable
+	}
+	return nil
+}
+
+func (model ChatModel) GetDeleted(ownerID uuid.UUID) ([]*Chat, error) {
+	sqlQuery := `
+SELECT id, name, created_at, is_private, deleted_at FROM chats
+WHERE owner_id = $1
+AND deleted_at IS NOT NULL
+ORDER BY deleted_at DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chats []*Chat
+
+	for rows.Next() {
+		chat := Chat{OwnerID: ownerID}
+		err = rows.Scan(&chat.ID, &chat.Name, &chat.CreatedAt, &chat.IsPrivate, &chat.DeletedAt)
+		if err != nil {
+			return nil, err
+		}
+		chats = append(chats, &chat)
+	}
+
+	err = rows.Err()
+	return chats, err
+}
+
+// Purge removes the chats deleted before the given time for good and returns
+// the avatar files they leave behind.
+func (model ChatModel) Purge(deletedBefore time.Time) ([]string, error) {
+	sqlQuery := `
+DELETE FROM chats
+WHERE deleted_at < $1
+RETURNING avatar
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, deletedBefore)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var avatars []string
+
+	for rows.Next() {
+		var avatar string
+		err = rows.Scan(&avatar)
+		if err != nil {
+			return nil, err
+		}
+		if avatar != "" {
+			avatars = append(avatars, avatar)
+		}
+	}
+
+	err = rows.Err()
+	return avatars, err
+}
+
+func (model ChatModel) TransferOwnership(chatID, ownerID, newOwnerID uuid.UUID) error {
+	sqlQuery := `
+UPDATE users_chats
+SET is_admin = true
+WHERE chat_id = $1
+AND user_id = $2
+	`
+	sqlQuery2 := `
+UPDATE chats
+SET owner_id = $3
+WHERE id = $1
+AND owner_id = $2
+AND deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, sqlQuery, chatID, newOwnerID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotInChat
+	}
+
+	result, err = tx.ExecContext(ctx, sqlQuery2, chatID, ownerID, newOwnerID)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err = result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotOwner
+	}
+
+	return tx.Commit()
+}
+
+// NextOwner picks who inherits a chat when its owner leaves: the longest
+// standing admin, or else the longest standing member. It returns uuid.Nil
+// when nobody is left.
+func (model ChatModel) NextOwner(chatID uuid.UUID) (uuid.UUID, error) {
+	sqlQuery := `
+SELECT user_id FROM users_chats
+WHERE chat_id = $1
+ORDER BY is_admin DESC, joined_at, user_id
+LIMIT 1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID uuid.UUID
+	err := model.DB.QueryRowContext(ctx, sqlQuery, chatID).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, nil
+	}
+	return userID, err
 }
 
 func (model ChatModel) GetChat(chat *Chat) error {
 	sqlQuery := `
-SELECT name, owner_id, created_at, is_private FROM chats 
+SELECT name, owner_id, created_at, is_private, join_policy, is_group_direct, description, topic, avatar,
+	is_listed, slow_mode_seconds, announcement_only
+FROM chats
 WHERE id = $1
+AND deleted_at IS NULL
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -110,7 +335,16 @@ WHERE id = $1
 		&chat.OwnerID,
 		&chat.CreatedAt,
 		&chat.IsPrivate,
+		&chat.JoinPolicy,
+		&chat.IsGroupDirect,
+		&chat.Description,
+		&chat.Topic,
+		&chat.Avatar,
+		&chat.IsListed,
+		&chat.SlowModeSeconds,
+		&chat.AnnouncementOnly,
 	)
+	chat.HasAvatar = chat.Avatar != ""
 
 	if err == sql.ErrNoRows {
 		return ErrChatNotFound
@@ -118,7 +352,71 @@ WHERE id = $1
 	return err
 }
 
-func (model ChatModel) GetUsers(chatID uuid.UUID) ([]*ChatUser, error) {
+func (model ChatModel) UpdateProfile(chat *Chat) error {
+	sqlQuery := `
+UPDATE chats
+SET name = $2, description = $3, topic = $4, is_listed = $5, slow_mode_seconds = $6,
+	announcement_only = $7
+WHERE id = $1
+AND deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{
+		chat.ID,
+		chat.Name,
+		chat.Description,
+		chat.Topic,
+		chat.IsListed,
+		chat.SlowModeSeconds,
+		chat.AnnouncementOnly,
+	}
+	result, err := model.DB.ExecContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrChatNotFound
+	}
+	return nil
+}
+
+func (model ChatModel) SetAvatar(chatID uuid.UUID, avatar string) error {
+	sqlQuery := `
+UPDATE chats
+SET avatar = $2
+WHERE id = $1
+AND deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, chatID, avatar)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrChatNotFound
+	}
+	return nil
+}
+
+// GetUsers lists the members of a chat, private chats are only listed to
+// their own members.
+func (model ChatModel) GetUsers(chatID, requesterID uuid.UUID) ([]*ChatUser, error) {
 	chat := Chat{ID: chatID}
 	err := model.GetChat(&chat)
 	if err != nil {
@@ -126,7 +424,13 @@ func (model ChatModel) GetUsers(chatID uuid.UUID) ([]*ChatUser, error) {
 	}
 
 	if chat.IsPrivate {
-		return nil, ErrPrivateChat
+		err = UserModel{DB: model.DB}.IsInChat(requesterID, chatID)
+		switch {
+		case errors.Is(err, ErrNotInChat):
+			return nil, ErrPrivateChat
+		case err != nil:
+			return nil, err
+		}
 	}
 
 	sqlQuery := `
@@ -170,6 +474,29 @@ func (model ChatModel) Join(chatID, userID uuid.UUID, isAdmin bool) error {
 		return ErrPrivateChat
 	}
 
+	if !isAdmin {
+		switch chat.JoinPolicy {
+		case JoinPolicyInviteOnly:
+			return ErrInviteOnly
+		case JoinPolicyRequest:
+			return ErrJoinRequired
+		}
+	}
+
+	return model.AddMember(chatID, userID, isAdmin)
+}
+
+// AddMember inserts the membership without looking at the join policy, it is
+// used once an invite or a join request has been accepted.
+func (model ChatModel) AddMember(chatID, userID uuid.UUID, isAdmin bool) error {
+	banned, err := model.IsBanned(chatID, userID)
+	if err != nil {
+		return err
+	}
+	if banned {
+		return ErrBannedFromChat
+	}
+
 	sqlQuery := `
 INSERT INTO users_chats(user_id, chat_id, is_admin)
 VALUES($1, $2, $3)
@@ -189,16 +516,55 @@ VALUES($1, $2, $3)
 	return nil
 }
 
+func (model ChatModel) SetJoinPolicy(chatID uuid.UUID, joinPolicy string) error {
+	sqlQuery := `
+UPDATE chats
+SET join_policy = $2
+WHERE id = $1
+AND deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, chatID, joinPolicy)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrChatNotFound
+	}
+	return nil
+}
+
 func (model ChatModel) Leave(chatID, userID uuid.UUID) error {
 	sqlQuery := `
 DELETE FROM users_chats
 WHERE user_id = $1
 AND chat_id = $2
+	`
+	// a group conversation no longer matches the member set it was opened for
+	sqlQuery2 := `
+UPDATE chats
+SET member_key = NULL
+WHERE id = $1
+AND member_key IS NOT NULL
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	result, err := model.DB.ExecContext(ctx, sqlQuery, userID, chatID)
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, sqlQuery, userID, chatID)
 	if err != nil {
 		return err
 	}
@@ -211,18 +577,63 @@ AND chat_id = $2
 	if rowsAffected == 0 {
 		return ErrNotInChat
 	}
-	return nil
+
+	_, err = tx.ExecContext(ctx, sqlQuery2, chatID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (model ChatModel) GetMemberIDs(chatID uuid.UUID) ([]uuid.UUID, error) {
+	sqlQuery := `
+SELECT user_id FROM users_chats
+WHERE chat_id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usersID []uuid.UUID
+
+	for rows.Next() {
+		var userID uuid.UUID
+		err = rows.Scan(&userID)
+		if err != nil {
+			return nil, err
+		}
+		usersID = append(usersID, userID)
+	}
+
+	err = rows.Err()
+
+	return usersID, err
 }
 
+// GetChatMessage pages through the chat's history as seen by viewerID,
+// leaving out messages from users they blocked.
 func (model ChatModel) GetChatMessage(
-	chatID uuid.UUID,
+	chatID, viewerID uuid.UUID,
 	size, start int,
 ) ([]*MessageWithUser, error) {
 	sqlQuery := `
-SELECT messages.id, messages.user_id, messages.content, messages.sent, messages.type, users.name FROM messages
-JOIN users ON users.id = messages.user_id 
+SELECT messages.id, messages.user_id, messages.content, messages.sent, messages.type, users.name,
+	users.is_bot, messages.display_name, messages.display_avatar, messages.attachments
+FROM messages
+JOIN users ON users.id = messages.user_id
 WHERE chat_id = $1
 AND deleted = false
+AND NOT EXISTS (
+  SELECT 1 FROM user_blocks
+  WHERE user_blocks.blocker_id = $4
+  AND user_blocks.blocked_id = messages.user_id
+)
 ORDER BY sent DESC
 LIMIT $2
 OFFSET $3
@@ -230,7 +641,7 @@ OFFSET $3
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := model.DB.QueryContext(ctx, sqlQuery, chatID, size, start)
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, chatID, size, start, viewerID)
 	if err != nil {
 		return nil, err
 	}
@@ -247,6 +658,10 @@ OFFSET $3
 			&message.Message.Sent.Sent,
 			&message.Message.Type.Int,
 			&message.User.Name,
+			&message.User.IsBot,
+			&message.Message.DisplayName,
+			&message.Message.DisplayAvatar,
+			&message.Message.Attachments,
 		)
 		if err != nil {
 			return nil, err
@@ -0,0 +1,249 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/validator"
+)
+
+const (
+	MinGroupDirectMembers = 3
+	MaxGroupDirectMembers = 10
+)
+
+var (
+	ErrDirectWithSelf   = errors.New("cannot create chat with self")
+	ErrNotGroupDirect   = errors.New("Chat is not a group conversation")
+	ErrDuplicateMembers = errors.New("a conversation with these members already exists")
+)
+
+func ValidateGroupDirectMembers(vdtr *validator.Validator, memberIDs []uuid.UUID) {
+	ids := make([]string, len(memberIDs))
+	for i, id := range memberIDs {
+		ids[i] = id.String()
+	}
+	vdtr.Check(validator.Unique(ids), "user_ids", "must not contain duplicate values")
+	vdtr.Check(
+		len(memberIDs) >= MinGroupDirectMembers,
+		"user_ids",
+		"must make up at least 3 members with you",
+	)
+	vdtr.Check(
+		len(memberIDs) <= MaxGroupDirectMembers,
+		"user_ids",
+		"cannot make up more than 10 members with you",
+	)
+}
+
+// groupDirectKey identifies a group conversation by its member set.
+func groupDirectKey(memberIDs []uuid.UUID) string {
+	ids := make([]string, len(memberIDs))
+	for i, id := range memberIDs {
+		ids[i] = id.String()
+	}
+	slices.Sort(ids)
+	return strings.Join(ids, ",")
+}
+
+// directPeers orders the two participants the way they are stored in
+// chats.peer_low and chats.peer_high so a pair maps to a single row.
+func directPeers(userID, peerID uuid.UUID) (uuid.UUID, uuid.UUID) {
+	if userID.String() < peerID.String() {
+		return userID, peerID
+	}
+	return peerID, userID
+}
+
+// OpenDirect returns the private chat between the two users, creating it if
+// it does not exist yet, and makes sure both of them are members. A deleted
+// chat is left alone, the two start over in a new one. The returned bool
+// reports whether the chat was created by this call.
+func (model ChatModel) OpenDirect(userID, peerID uuid.UUID) (*Chat, bool, error) {
+	if userID == peerID {
+		return nil, false, ErrDirectWithSelf
+	}
+	peerLow, peerHigh := directPeers(userID, peerID)
+
+	sqlQuery := `
+INSERT INTO chats(id, name, owner_id, is_private, peer_low, peer_high)
+VALUES($1, '', $2, true, $3, $4)
+ON CONFLICT (peer_low, peer_high) WHERE is_private AND deleted_at IS NULL DO NOTHING
+RETURNING created_at
+	`
+	sqlQuery2 := `
+SELECT id, name, owner_id, created_at, join_policy FROM chats
+WHERE is_private = true
+AND peer_low = $1
+AND peer_high = $2
+AND deleted_at IS NULL
+	`
+	sqlQuery3 := `
+INSERT INTO users_chats(user_id, chat_id, is_admin)
+VALUES($1, $3, false), ($2, $3, false)
+ON CONFLICT (chat_id, user_id) DO NOTHING
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	chat := &Chat{
+		ID:         uuid.New(),
+		OwnerID:    userID,
+		IsPrivate:  true,
+		JoinPolicy: JoinPolicyOpen,
+		PeerID:     &peerID,
+	}
+	created := true
+
+	err = tx.QueryRowContext(ctx, sqlQuery, chat.ID, userID, peerLow, peerHigh).Scan(&chat.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		created = false
+		err = tx.QueryRowContext(ctx, sqlQuery2, peerLow, peerHigh).Scan(
+			&chat.ID,
+			&chat.Name,
+			&chat.OwnerID,
+			&chat.CreatedAt,
+			&chat.JoinPolicy,
+		)
+		if errors.Is(err, sql.ErrNoRows) {
+			// it was deleted after the insert ran into it
+			return nil, false, ErrEditConflict
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	_, err = tx.ExecContext(ctx, sqlQuery3, peerLow, peerHigh, chat.ID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return chat, created, tx.Commit()
+}
+
+// OpenGroupDirect returns the group conversation made up of exactly the given
+// members, creating it on first use or when the last one was deleted. The
+// returned bool reports whether the chat was created by this call.
+func (model ChatModel) OpenGroupDirect(ownerID uuid.UUID, memberIDs []uuid.UUID) (*Chat, bool, error) {
+	sqlQuery := `
+INSERT INTO chats(id, name, owner_id, is_private, is_group_direct, member_key)
+VALUES($1, '', $2, true, true, $3)
+ON CONFLICT (member_key) WHERE member_key IS NOT NULL AND deleted_at IS NULL DO NOTHING
+RETURNING created_at
+	`
+	sqlQuery2 := `
+SELECT id, owner_id, created_at FROM chats
+WHERE member_key = $1
+AND deleted_at IS NULL
+	`
+	sqlQuery3 := `
+INSERT INTO users_chats(user_id, chat_id, is_admin)
+VALUES($1, $2, false)
+ON CONFLICT (chat_id, user_id) DO NOTHING
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	chat := &Chat{
+		ID:            uuid.New(),
+		OwnerID:       ownerID,
+		IsPrivate:     true,
+		IsGroupDirect: true,
+		JoinPolicy:    JoinPolicyOpen,
+	}
+	key := groupDirectKey(memberIDs)
+
+	err = tx.QueryRowContext(ctx, sqlQuery, chat.ID, ownerID, key).Scan(&chat.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = tx.QueryRowContext(ctx, sqlQuery2, key).Scan(&chat.ID, &chat.OwnerID, &chat.CreatedAt)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, false, ErrEditConflict
+		case err != nil:
+			return nil, false, err
+		}
+		return chat, false, tx.Commit()
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	for _, memberID := range memberIDs {
+		_, err = tx.ExecContext(ctx, sqlQuery3, memberID, chat.ID)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return chat, true, tx.Commit()
+}
+
+// ConvertGroupDirect adds members to an existing group conversation in place,
+// re-keying it by the new member set.
+func (model ChatModel) ConvertGroupDirect(chatID uuid.UUID, memberIDs []uuid.UUID) error {
+	sqlQuery := `
+UPDATE chats
+SET member_key = $2
+WHERE id = $1
+AND is_group_direct = true
+	`
+	sqlQuery2 := `
+INSERT INTO users_chats(user_id, chat_id, is_admin)
+VALUES($1, $2, false)
+ON CONFLICT (chat_id, user_id) DO NOTHING
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, sqlQuery, chatID, groupDirectKey(memberIDs))
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "chats_member_key_idx"`:
+			return ErrDuplicateMembers
+		default:
+			return err
+		}
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotGroupDirect
+	}
+
+	for _, memberID := range memberIDs {
+		_, err = tx.ExecContext(ctx, sqlQuery2, memberID, chatID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
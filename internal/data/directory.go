@@ -0,0 +1,171 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PublicProfile is what other users get to see of a user.
+type PublicProfile struct {
+	ID        uuid.UUID  `json:"id"`
+	Username  string     `json:"username"`
+	Name      string     `json:"name"`
+	Bio       string     `json:"bio"`
+	HasAvatar bool       `json:"has_avatar"`
+	Status    UserStatus `json:"status"`
+	IsBot     bool       `json:"is_bot"`
+}
+
+func (user *User) PublicProfile() PublicProfile {
+	return PublicProfile{
+		ID:        user.ID,
+		Username:  user.Username,
+		Name:      user.Name,
+		Bio:       user.Bio,
+		HasAvatar: user.HasAvatar,
+		Status:    user.Status,
+		IsBot:     user.IsBot,
+	}
+}
+
+// UserSearchSafelist only allows ranking by relevance, it exists so the
+// search can share Filters with the other listings.
+var UserSearchSafelist = []string{"relevance"}
+
+func (model UserModel) GetByUsername(username string) (*User, error) {
+	sqlQuery := `
+SELECT id FROM users
+WHERE username = $1
+AND deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var userID uuid.UUID
+	err := model.DB.QueryRowContext(ctx, sqlQuery, NormalizeUsername(username)).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return model.GetByID(userID)
+}
+
+// discoverableBy is the condition for users that want to be found by the
+// user whose id is in the given placeholder.
+func discoverableBy(userIDPlaceholder string) string {
+	return `(
+  users.discoverability = 'everyone'
+  OR (users.discoverability = 'contacts' AND EXISTS(
+    SELECT 1 FROM users_chats mine
+    JOIN users_chats theirs ON theirs.chat_id = mine.chat_id
+    WHERE mine.user_id = ` + userIDPlaceholder + `
+    AND theirs.user_id = users.id
+  ))
+)`
+}
+
+// GetDiscoverableByUsername looks a user up by username like GetByUsername,
+// but only finds the ones that want to be found by userID, the same as
+// Search.
+func (model UserModel) GetDiscoverableByUsername(userID uuid.UUID, username string) (*User, error) {
+	sqlQuery := `
+SELECT id FROM users
+WHERE username = $1
+AND deleted_at IS NULL
+AND ` + discoverableBy("$2")
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var foundID uuid.UUID
+	err := model.DB.QueryRowContext(ctx, sqlQuery, NormalizeUsername(username), userID).Scan(&foundID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return model.GetByID(foundID)
+}
+
+// Search finds users by username prefix or by a fuzzy match on their
+// username or name, leaving out the ones who do not want to be found by
+// the searching user.
+func (model UserModel) Search(
+	userID uuid.UUID,
+	search string,
+	filters Filters,
+) ([]*PublicProfile, Metadata, error) {
+	sqlQuery := `
+SELECT COUNT(*) OVER(), users.id, COALESCE(users.username, ''), users.name, users.bio, users.avatar,
+	users.status_text, users.status_emoji, users.status_expires_at, users.is_bot
+FROM users
+WHERE users.id <> $2
+AND users.activated = true
+AND users.deleted_at IS NULL
+AND (
+  users.username::TEXT ILIKE $1::TEXT || '%'
+  OR users.username::TEXT % $3::TEXT
+  OR users.name % $3::TEXT
+  OR users.name ILIKE '%' || $1::TEXT || '%'
+)
+AND ` + discoverableBy("$2") + `
+ORDER BY users.username = $3::CITEXT DESC NULLS LAST,
+  users.username ILIKE $1::TEXT || '%' DESC NULLS LAST,
+  GREATEST(similarity(users.username::TEXT, $3::TEXT), similarity(users.name, $3::TEXT)) DESC,
+  users.id
+LIMIT $4
+OFFSET $5
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{escapeLike(search), userID, search, filters.limit(), filters.offset()}
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	profiles := []*PublicProfile{}
+
+	for rows.Next() {
+		var user User
+		err = rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.Username,
+			&user.Name,
+			&user.Bio,
+			&user.Avatar,
+			&user.Status.Text,
+			&user.Status.Emoji,
+			&user.Status.ExpiresAt,
+			&user.IsBot,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		user.normalizeProfile()
+		profile := user.PublicProfile()
+		profiles = append(profiles, &profile)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return profiles, metadata, nil
+}
@@ -0,0 +1,123 @@
+package data
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type DiscoveredChat struct {
+	Chat           Chat       `json:"chat"`
+	Members        int        `json:"members"`
+	RecentMessages int        `json:"recent_messages"`
+	LastActivity   *time.Time `json:"last_activity,omitempty"`
+	IsMember       bool       `json:"is_member"`
+}
+
+var discoverSortColumns = map[string]string{
+	"activity": "recent_messages DESC, last_activity DESC NULLS LAST",
+	"members":  "member_count DESC",
+	"newest":   "chats.created_at DESC",
+	"name":     "chats.name ASC",
+}
+
+var DiscoverSortSafelist = []string{"activity", "members", "newest", "name"}
+
+// escapeLike makes user input match literally inside an ILIKE pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// Discover lists the public chats that have not opted out of the directory,
+// ranked by the filter's sort and matched against name and description.
+func (model ChatModel) Discover(
+	userID uuid.UUID,
+	search string,
+	filters Filters,
+) ([]*DiscoveredChat, Metadata, error) {
+	sqlQuery := fmt.Sprintf(`
+WITH %s, activity AS (
+  SELECT chat_id, COUNT(*) AS recent_messages
+  FROM messages
+  WHERE sent > NOW() - INTERVAL '7 days'
+  AND deleted = false
+  GROUP BY chat_id
+)
+SELECT COUNT(*) OVER(), chats.id, chats.name, chats.owner_id, chats.created_at, chats.join_policy,
+  chats.description, chats.topic, chats.avatar,
+  COALESCE(mc.member_count, 0) AS member_count,
+  COALESCE(activity.recent_messages, 0) AS recent_messages,
+  latest.sent AS last_activity,
+  EXISTS(
+    SELECT 1 FROM users_chats
+    WHERE users_chats.chat_id = chats.id
+    AND users_chats.user_id = $2
+  )
+FROM chats
+LEFT JOIN member_counts mc ON mc.chat_id = chats.id
+LEFT JOIN activity ON activity.chat_id = chats.id
+LEFT JOIN LATERAL (
+  SELECT sent FROM messages
+  WHERE messages.chat_id = chats.id
+  AND messages.deleted = false
+  ORDER BY sent DESC
+  LIMIT 1
+) latest ON TRUE
+WHERE chats.is_private = false
+AND chats.is_listed = true
+AND chats.deleted_at IS NULL
+AND ($1 = '' OR chats.name ILIKE '%%' || $1 || '%%' OR chats.description ILIKE '%%' || $1 || '%%')
+ORDER BY %s, chats.id
+LIMIT $3
+OFFSET $4
+	`, memberCounts, discoverSortColumns[filters.Sort])
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{escapeLike(search), userID, filters.limit(), filters.offset()}
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	chats := []*DiscoveredChat{}
+
+	for rows.Next() {
+		var chat DiscoveredChat
+		err = rows.Scan(
+			&totalRecords,
+			&chat.Chat.ID,
+			&chat.Chat.Name,
+			&chat.Chat.OwnerID,
+			&chat.Chat.CreatedAt,
+			&chat.Chat.JoinPolicy,
+			&chat.Chat.Description,
+			&chat.Chat.Topic,
+			&chat.Chat.Avatar,
+			&chat.Members,
+			&chat.RecentMessages,
+			&chat.LastActivity,
+			&chat.IsMember,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		chat.Chat.HasAvatar = chat.Chat.Avatar != ""
+		chat.Chat.IsListed = true
+		chats = append(chats, &chat)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+	return chats, metadata, nil
+}
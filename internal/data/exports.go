@@ -0,0 +1,313 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+var ErrExportNotFound = errors.New("export not found")
+
+// Export is an archive of a user's data that is built in the background.
+type Export struct {
+	ID          uuid.UUID  `json:"id"`
+	UserID      uuid.UUID  `json:"-"`
+	Status      string     `json:"status"`
+	File        string     `json:"-"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+}
+
+type ExportedMessage struct {
+	ID       uuid.UUID `json:"id"`
+	ChatID   uuid.UUID `json:"chat_id"`
+	ChatName string    `json:"chat_name"`
+	Content  string    `json:"content"`
+	Type     int32     `json:"type"`
+	Sent     time.Time `json:"sent"`
+	Deleted  bool      `json:"deleted"`
+}
+
+type ExportedReaction struct {
+	MessageID uuid.UUID `json:"message_id"`
+	ChatID    uuid.UUID `json:"chat_id"`
+	Emoji     string    `json:"emoji"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportModel struct {
+	DB *sql.DB
+}
+
+func (model ExportModel) Insert(export *Export) error {
+	sqlQuery := `
+INSERT INTO user_exports(id, user_id, expires_at)
+VALUES($1, $2, $3)
+RETURNING status, created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{export.ID, export.UserID, export.ExpiresAt}
+	return model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(&export.Status, &export.CreatedAt)
+}
+
+// GetLatest returns the user's newest export that has not expired or failed.
+func (model ExportModel) GetLatest(userID uuid.UUID) (*Export, error) {
+	sqlQuery := `
+SELECT id, status, file, created_at, completed_at, expires_at FROM user_exports
+WHERE user_id = $1
+AND status <> 'failed'
+AND expires_at > NOW()
+ORDER BY created_at DESC
+LIMIT 1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	export := Export{UserID: userID}
+	err := model.DB.QueryRowContext(ctx, sqlQuery, userID).Scan(
+		&export.ID,
+		&export.Status,
+		&export.File,
+		&export.CreatedAt,
+		&export.CompletedAt,
+		&export.ExpiresAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrExportNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &export, nil
+}
+
+func (model ExportModel) Get(exportID, userID uuid.UUID) (*Export, error) {
+	sqlQuery := `
+SELECT status, file, created_at, completed_at, expires_at FROM user_exports
+WHERE id = $1
+AND user_id = $2
+AND expires_at > NOW()
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	export := Export{ID: exportID, UserID: userID}
+	err := model.DB.QueryRowContext(ctx, sqlQuery, exportID, userID).Scan(
+		&export.Status,
+		&export.File,
+		&export.CreatedAt,
+		&export.CompletedAt,
+		&export.ExpiresAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrExportNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &export, nil
+}
+
+// Finish records the outcome of building the export, file is empty when it
+// failed.
+func (model ExportModel) Finish(export *Export) error {
+	sqlQuery := `
+UPDATE user_exports
+SET status = $2, file = $3, completed_at = NOW()
+WHERE id = $1
+RETURNING completed_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{export.ID, export.Status, export.File}
+	return model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(&export.CompletedAt)
+}
+
+// FailStale marks the user's exports still pending since before the given
+// time as failed.
+func (model ExportModel) FailStale(userID uuid.UUID, createdBefore time.Time) error {
+	sqlQuery := `
+UPDATE user_exports
+SET status = 'failed', completed_at = NOW()
+WHERE user_id = $1
+AND status = 'pending'
+AND created_at < $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, sqlQuery, userID, createdBefore)
+	return err
+}
+
+// PurgeExpired removes expired exports and returns their files.
+func (model ExportModel) PurgeExpired() ([]string, error) {
+	sqlQuery := `
+DELETE FROM user_exports
+WHERE expires_at < NOW()
+RETURNING file
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []string
+	for rows.Next() {
+		var file string
+		err = rows.Scan(&file)
+		if err != nil {
+			return nil, err
+		}
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+
+	err = rows.Err()
+	return files, err
+}
+
+// Messages returns every message the user sent, oldest first.
+func (model ExportModel) Messages(userID uuid.UUID) ([]*ExportedMessage, error) {
+	sqlQuery := `
+SELECT messages.id, messages.chat_id, chats.name, messages.content, messages.type, messages.sent,
+	COALESCE(messages.deleted, false)
+FROM messages
+JOIN chats ON chats.id = messages.chat_id
+WHERE messages.user_id = $1
+ORDER BY messages.sent
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []*ExportedMessage{}
+	for rows.Next() {
+		var message ExportedMessage
+		err = rows.Scan(
+			&message.ID,
+			&message.ChatID,
+			&message.ChatName,
+			&message.Content,
+			&message.Type,
+			&message.Sent,
+			&message.Deleted,
+		)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, &message)
+	}
+
+	err = rows.Err()
+	return messages, err
+}
+
+// OwnedChats returns the chats the user owns, deleted ones included.
+func (model ExportModel) OwnedChats(userID uuid.UUID) ([]*Chat, error) {
+	sqlQuery := `
+SELECT id, name, created_at, is_private, join_policy, is_group_direct, description, topic, avatar,
+	is_listed, deleted_at
+FROM chats
+WHERE owner_id = $1
+ORDER BY created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chats := []*Chat{}
+	for rows.Next() {
+		chat := Chat{OwnerID: userID}
+		err = rows.Scan(
+			&chat.ID,
+			&chat.Name,
+			&chat.CreatedAt,
+			&chat.IsPrivate,
+			&chat.JoinPolicy,
+			&chat.IsGroupDirect,
+			&chat.Description,
+			&chat.Topic,
+			&chat.Avatar,
+			&chat.IsListed,
+			&chat.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		chat.HasAvatar = chat.Avatar != ""
+		chats = append(chats, &chat)
+	}
+
+	err = rows.Err()
+	return chats, err
+}
+
+func (model ExportModel) Reactions(userID uuid.UUID) ([]*ExportedReaction, error) {
+	sqlQuery := `
+SELECT message_reactions.message_id, messages.chat_id, message_reactions.emoji,
+	message_reactions.created_at
+FROM message_reactions
+JOIN messages ON messages.id = message_reactions.message_id
+WHERE message_reactions.user_id = $1
+ORDER BY message_reactions.created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := []*ExportedReaction{}
+	for rows.Next() {
+		var reaction ExportedReaction
+		err = rows.Scan(
+			&reaction.MessageID,
+			&reaction.ChatID,
+			&reaction.Emoji,
+			&reaction.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		reactions = append(reactions, &reaction)
+	}
+
+	err = rows.Err()
+	return reactions, err
+}
@@ -0,0 +1,57 @@
+package data
+
+import (
+	"math"
+	"slices"
+
+	"github.com/mf751/gocha/internal/validator"
+)
+
+type Filters struct {
+	Page         int
+	PageSize     int
+	Sort         string
+	SortSafelist []string
+}
+
+type Metadata struct {
+	CurrentPage  int `json:"current_page,omitempty"`
+	PageSize     int `json:"page_size,omitempty"`
+	FirstPage    int `json:"first_page,omitempty"`
+	LastPage     int `json:"last_page,omitempty"`
+	TotalRecords int `json:"total_records,omitempty"`
+}
+
+func ValidateFilters(vdtr *validator.Validator, filters Filters) {
+	vdtr.Check(filters.Page > 0, "page", "must be greater than zero")
+	vdtr.Check(filters.Page <= 10_000_000, "page", "must be a maximum of 10 million")
+	vdtr.Check(filters.PageSize > 0, "page_size", "must be greater than zero")
+	vdtr.Check(filters.PageSize <= 100, "page_size", "must be a maximum of 100")
+	vdtr.Check(
+		slices.Contains(filters.SortSafelist, filters.Sort),
+		"sort",
+		"invalid sort value",
+	)
+}
+
+func (filters Filters) limit() int {
+	return filters.PageSize
+}
+
+func (filters Filters) offset() int {
+	return (filters.Page - 1) * filters.PageSize
+}
+
+func calculateMetadata(totalRecords, page, pageSize int) Metadata {
+	if totalRecords == 0 {
+		return Metadata{}
+	}
+
+	return Metadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		FirstPage:    1,
+		LastPage:     int(math.Ceil(float64(totalRecords) / float64(pageSize))),
+		TotalRecords: totalRecords,
+	}
+}
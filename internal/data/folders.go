@@ -0,0 +1,323 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/validator"
+)
+
+const MaxChatFolders = 20
+
+var (
+	ErrFolderNotFound  = errors.New("folder not found")
+	ErrTooManyFolders  = errors.New("cannot have more than 20 folders")
+	ErrAlreadyInFolder = errors.New("chat is already in this folder")
+	ErrNotInFolder     = errors.New("chat is not in this folder")
+)
+
+// ChatFolder groups a user's chats. Chats can be added to it by hand, and the
+// include rules pull in every chat of that kind while the exclude rules drop
+// chats from both.
+type ChatFolder struct {
+	ID              uuid.UUID   `json:"id"`
+	UserID          uuid.UUID   `json:"-"`
+	Name            string      `json:"name"`
+	IncludeDirect   bool        `json:"include_direct"`
+	IncludeGroups   bool        `json:"include_groups"`
+	IncludePublic   bool        `json:"include_public"`
+	ExcludeMuted    bool        `json:"exclude_muted"`
+	ExcludeArchived bool        `json:"exclude_archived"`
+	ChatIDs         []uuid.UUID `json:"chat_ids"`
+	CreatedAt       time.Time   `json:"created_at"`
+}
+
+type FolderModel struct {
+	DB *sql.DB
+}
+
+func ValidateChatFolder(vdtr *validator.Validator, folder *ChatFolder) {
+	vdtr.Check(folder.Name != "", "name", "must be provided")
+	vdtr.Check(len(folder.Name) <= 30, "name", "cannot be more than 30 characters long")
+}
+
+func (model FolderModel) Insert(folder *ChatFolder) error {
+	sqlQuery := `
+SELECT COUNT(*) FROM chat_folders
+WHERE user_id = $1
+	`
+	sqlQuery2 := `
+INSERT INTO chat_folders(id, user_id, name, include_direct, include_groups, include_public, exclude_muted, exclude_archived)
+VALUES($1, $2, $3, $4, $5, $6, $7, $8)
+RETURNING created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	err := model.DB.QueryRowContext(ctx, sqlQuery, folder.UserID).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count >= MaxChatFolders {
+		return ErrTooManyFolders
+	}
+
+	folder.ID = uuid.New()
+	folder.ChatIDs = []uuid.UUID{}
+	args := []interface{}{
+		folder.ID,
+		folder.UserID,
+		folder.Name,
+		folder.IncludeDirect,
+		folder.IncludeGroups,
+		folder.IncludePublic,
+		folder.ExcludeMuted,
+		folder.ExcludeArchived,
+	}
+	return model.DB.QueryRowContext(ctx, sqlQuery2, args...).Scan(&folder.CreatedAt)
+}
+
+func (model FolderModel) Get(folderID, userID uuid.UUID) (*ChatFolder, error) {
+	sqlQuery := `
+SELECT name, include_direct, include_groups, include_public, exclude_muted, exclude_archived, created_at FROM chat_folders
+WHERE id = $1
+AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	folder := ChatFolder{ID: folderID, UserID: userID}
+	err := model.DB.QueryRowContext(ctx, sqlQuery, folderID, userID).Scan(
+		&folder.Name,
+		&folder.IncludeDirect,
+		&folder.IncludeGroups,
+		&folder.IncludePublic,
+		&folder.ExcludeMuted,
+		&folder.ExcludeArchived,
+		&folder.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrFolderNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	folder.ChatIDs, err = model.getChatIDs(folder.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &folder, nil
+}
+
+func (model FolderModel) GetAllForUser(userID uuid.UUID) ([]*ChatFolder, error) {
+	sqlQuery := `
+SELECT id, name, include_direct, include_groups, include_public, exclude_muted, exclude_archived, created_at FROM chat_folders
+WHERE user_id = $1
+ORDER BY created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var folders []*ChatFolder
+
+	for rows.Next() {
+		folder := ChatFolder{UserID: userID}
+		err = rows.Scan(
+			&folder.ID,
+			&folder.Name,
+			&folder.IncludeDirect,
+			&folder.IncludeGroups,
+			&folder.IncludePublic,
+			&folder.ExcludeMuted,
+			&folder.ExcludeArchived,
+			&folder.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, &folder)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, folder := range folders {
+		folder.ChatIDs, err = model.getChatIDs(folder.ID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return folders, nil
+}
+
+// getChatIDs returns the chats that were added to the folder by hand.
+func (model FolderModel) getChatIDs(folderID uuid.UUID) ([]uuid.UUID, error) {
+	sqlQuery := `
+SELECT chat_id FROM chat_folder_chats
+WHERE folder_id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, folderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chatIDs := []uuid.UUID{}
+
+	for rows.Next() {
+		var chatID uuid.UUID
+		err = rows.Scan(&chatID)
+		if err != nil {
+			return nil, err
+		}
+		chatIDs = append(chatIDs, chatID)
+	}
+
+	err = rows.Err()
+	return chatIDs, err
+}
+
+func (model FolderModel) Update(folder *ChatFolder) error {
+	sqlQuery := `
+UPDATE chat_folders
+SET name = $3, include_direct = $4, include_groups = $5, include_public = $6, exclude_muted = $7, exclude_archived = $8
+WHERE id = $1
+AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{
+		folder.ID,
+		folder.UserID,
+		folder.Name,
+		folder.IncludeDirect,
+		folder.IncludeGroups,
+		folder.IncludePublic,
+		folder.ExcludeMuted,
+		folder.ExcludeArchived,
+	}
+	result, err := model.DB.ExecContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrFolderNotFound
+	}
+	return nil
+}
+
+func (model FolderModel) Delete(folderID, userID uuid.UUID) error {
+	sqlQuery := `
+DELETE FROM chat_folders
+WHERE id = $1
+AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, folderID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrFolderNotFound
+	}
+	return nil
+}
+
+// AddChat puts a chat the user is a member of into one of their folders.
+func (model FolderModel) AddChat(folderID, userID, chatID uuid.UUID) error {
+	sqlQuery := `
+INSERT INTO chat_folder_chats(folder_id, chat_id)
+SELECT chat_folders.id, users_chats.chat_id FROM chat_folders
+JOIN users_chats ON users_chats.user_id = chat_folders.user_id
+WHERE chat_folders.id = $1
+AND chat_folders.user_id = $2
+AND users_chats.chat_id = $3
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.Get(folderID, userID)
+	if err != nil {
+		return err
+	}
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, folderID, userID, chatID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "chat_folder_chats_pkey"`:
+			return ErrAlreadyInFolder
+		default:
+			return err
+		}
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotInChat
+	}
+	return nil
+}
+
+func (model FolderModel) RemoveChat(folderID, userID, chatID uuid.UUID) error {
+	sqlQuery := `
+DELETE FROM chat_folder_chats
+WHERE folder_id = $1
+AND chat_id = $3
+AND folder_id IN (SELECT id FROM chat_folders WHERE user_id = $2)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, folderID, userID, chatID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotInFolder
+	}
+	return nil
+}
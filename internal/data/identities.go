@@ -0,0 +1,148 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrIdentityLinked = errors.New("identity is already linked to a user")
+
+// OIDCLogin is a sign in started with an identity provider that has not come
+// back yet.
+type OIDCLogin struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Expiry       time.Time
+}
+
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+func (model IdentityModel) InsertLogin(login *OIDCLogin) error {
+	sqlQuery := `
+DELETE FROM oidc_logins
+WHERE expiry < NOW()
+	`
+	sqlQuery2 := `
+INSERT INTO oidc_logins(state_hash, nonce, code_verifier, expiry)
+VALUES($1, $2, $3, $4)
+	`
+	stateHash := sha256.Sum256([]byte(login.State))
+	args := []interface{}{stateHash[:], login.Nonce, login.CodeVerifier, login.Expiry}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, sqlQuery)
+	if err != nil {
+		return err
+	}
+
+	_, err = model.DB.ExecContext(ctx, sqlQuery2, args...)
+	return err
+}
+
+// ConsumeLogin returns the pending sign in for the state and removes it, so
+// a state can only be used once.
+func (model IdentityModel) ConsumeLogin(state string) (*OIDCLogin, error) {
+	sqlQuery := `
+DELETE FROM oidc_logins
+WHERE state_hash = $1
+RETURNING nonce, code_verifier, expiry
+	`
+	stateHash := sha256.Sum256([]byte(state))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	login := OIDCLogin{State: state}
+	err := model.DB.QueryRowContext(ctx, sqlQuery, stateHash[:]).Scan(
+		&login.Nonce,
+		&login.CodeVerifier,
+		&login.Expiry,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	if login.Expiry.Before(time.Now()) {
+		return nil, ErrRecordNotFound
+	}
+	return &login, nil
+}
+
+func (model IdentityModel) GetUser(issuer, subject string) (*User, error) {
+	sqlQuery := `
+SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated,
+	users.bio, users.avatar, users.status_text, users.status_emoji, users.status_expires_at, users.version,
+	COALESCE(users.username, ''), users.discoverability, users.is_bot
+FROM users
+INNER JOIN user_identities
+ON users.id = user_identities.user_id
+WHERE user_identities.issuer = $1
+AND user_identities.subject = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var user User
+	err := model.DB.QueryRowContext(ctx, sqlQuery, issuer, subject).Scan(
+		&user.ID,
+		&user.CreateAt.Sent,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Bio,
+		&user.Avatar,
+		&user.Status.Text,
+		&user.Status.Emoji,
+		&user.Status.ExpiresAt,
+		&user.Version,
+		&user.Username,
+		&user.Discoverability,
+		&user.IsBot,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	user.normalizeProfile()
+	return &user, nil
+}
+
+func (model IdentityModel) Link(userID uuid.UUID, issuer, subject, email string) error {
+	sqlQuery := `
+INSERT INTO user_identities(issuer, subject, user_id, email)
+VALUES($1, $2, $3, $4)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, sqlQuery, issuer, subject, userID, email)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "user_identities_pkey"`:
+			return ErrIdentityLinked
+		default:
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,286 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/validator"
+)
+
+var ErrIncomingWebhookNotFound = errors.New("incoming webhook not found")
+
+// IncomingWebhook lets outside services post into a chat with a secret
+// token, the messages are sent by a bot account of its own.
+type IncomingWebhook struct {
+	ID         uuid.UUID  `json:"id"`
+	ChatID     uuid.UUID  `json:"chat_id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	CreatedBy  uuid.UUID  `json:"created_by"`
+	Name       string     `json:"name"`
+	Token      string     `json:"token,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+type IncomingWebhookModel struct {
+	DB *sql.DB
+}
+
+func ValidateIncomingWebhook(vdtr *validator.Validator, webhook *IncomingWebhook) {
+	vdtr.Check(webhook.Name != "", "name", "must be provided")
+	vdtr.Check(len(webhook.Name) <= 100, "name", "must not be more than 100 bytes long")
+}
+
+func ValidateIncomingWebhookToken(vdtr *validator.Validator, tokenPlainText string) {
+	vdtr.Check(tokenPlainText != "", "token", "must be provided")
+	vdtr.Check(len(tokenPlainText) == secretLength, "token", "must be 52 bytes long")
+}
+
+// Insert creates the webhook along with its bot account and adds the bot to
+// the chat.
+func (model IncomingWebhookModel) Insert(webhook *IncomingWebhook) error {
+	sqlQuery := `
+INSERT INTO users(id, name, email, password_hash, activated, is_bot, discoverability)
+VALUES($1, $2, $3, '', true, true, 'nobody')
+	`
+	sqlQuery2 := `
+INSERT INTO users_chats(user_id, chat_id, is_admin)
+VALUES($1, $2, false)
+	`
+	sqlQuery3 := `
+INSERT INTO incoming_webhooks(id, chat_id, user_id, created_by, name, token_hash)
+VALUES($1, $2, $3, $4, $5, $6)
+RETURNING created_at
+	`
+	token, hash, err := generateSecretAndHash()
+	if err != nil {
+		return err
+	}
+	webhook.ID = uuid.New()
+	webhook.UserID = uuid.New()
+	webhook.Token = token
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	args := []interface{}{
+		webhook.UserID,
+		webhook.Name,
+		"webhook-" + webhook.ID.String() + "@bots.invalid",
+	}
+	_, err = tx.ExecContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, sqlQuery2, webhook.UserID, webhook.ChatID)
+	if err != nil {
+		return err
+	}
+
+	args = []interface{}{
+		webhook.ID,
+		webhook.ChatID,
+		webhook.UserID,
+		webhook.CreatedBy,
+		webhook.Name,
+		hash,
+	}
+	err = tx.QueryRowContext(ctx, sqlQuery3, args...).Scan(&webhook.CreatedAt)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (model IncomingWebhookModel) Get(webhookID uuid.UUID) (*IncomingWebhook, error) {
+	sqlQuery := `
+SELECT id, chat_id, user_id, COALESCE(created_by, '00000000-0000-0000-0000-000000000000'), name,
+	created_at, last_used_at
+FROM incoming_webhooks
+WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var webhook IncomingWebhook
+	err := model.DB.QueryRowContext(ctx, sqlQuery, webhookID).Scan(
+		&webhook.ID,
+		&webhook.ChatID,
+		&webhook.UserID,
+		&webhook.CreatedBy,
+		&webhook.Name,
+		&webhook.CreatedAt,
+		&webhook.LastUsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrIncomingWebhookNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &webhook, nil
+}
+
+func (model IncomingWebhookModel) GetAllForChat(chatID uuid.UUID) ([]*IncomingWebhook, error) {
+	sqlQuery := `
+SELECT id, chat_id, user_id, COALESCE(created_by, '00000000-0000-0000-0000-000000000000'), name,
+	created_at, last_used_at
+FROM incoming_webhooks
+WHERE chat_id = $1
+ORDER BY created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*IncomingWebhook{}
+	for rows.Next() {
+		var webhook IncomingWebhook
+		err = rows.Scan(
+			&webhook.ID,
+			&webhook.ChatID,
+			&webhook.UserID,
+			&webhook.CreatedBy,
+			&webhook.Name,
+			&webhook.CreatedAt,
+			&webhook.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// GetForToken returns the webhook the token belongs to and notes that it was
+// just used.
+func (model IncomingWebhookModel) GetForToken(tokenPlainText string) (*IncomingWebhook, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+
+	sqlQuery := `
+UPDATE incoming_webhooks
+SET last_used_at = NOW()
+WHERE token_hash = $1
+RETURNING id, chat_id, user_id, COALESCE(created_by, '00000000-0000-0000-0000-000000000000'), name,
+	created_at, last_used_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var webhook IncomingWebhook
+	err := model.DB.QueryRowContext(ctx, sqlQuery, tokenHash[:]).Scan(
+		&webhook.ID,
+		&webhook.ChatID,
+		&webhook.UserID,
+		&webhook.CreatedBy,
+		&webhook.Name,
+		&webhook.CreatedAt,
+		&webhook.LastUsedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &webhook, nil
+}
+
+// RotateToken replaces the webhook's token, the old one stops working right
+// away.
+func (model IncomingWebhookModel) RotateToken(webhook *IncomingWebhook) error {
+	sqlQuery := `
+UPDATE incoming_webhooks
+SET token_hash = $2
+WHERE id = $1
+	`
+	token, hash, err := generateSecretAndHash()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, webhook.ID, hash)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrIncomingWebhookNotFound
+	}
+	webhook.Token = token
+	return nil
+}
+
+// Delete removes the webhook and takes its bot out of the chat, the bot
+// account stays behind for the messages it sent.
+func (model IncomingWebhookModel) Delete(webhook *IncomingWebhook) error {
+	sqlQuery := `
+DELETE FROM incoming_webhooks
+WHERE id = $1
+	`
+	sqlQuery2 := `
+DELETE FROM users_chats
+WHERE user_id = $1
+AND chat_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, sqlQuery, webhook.ID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrIncomingWebhookNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, sqlQuery2, webhook.UserID, webhook.ChatID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,368 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/validator"
+)
+
+var (
+	ErrInvalidInvite    = errors.New("invalid or expired invite")
+	ErrInviteNotFound   = errors.New("invite not found")
+	ErrDuplicateRequest = errors.New("join request already sent")
+	ErrRequestNotFound  = errors.New("join request not found")
+)
+
+type Invite struct {
+	ID        uuid.UUID  `json:"id"`
+	PlainText string     `json:"token,omitempty"`
+	Hash      []byte     `json:"-"`
+	ChatID    uuid.UUID  `json:"chat_id"`
+	CreatedBy uuid.UUID  `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	Expiry    *time.Time `json:"expiry,omitempty"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	Revoked   bool       `json:"revoked"`
+}
+
+type JoinRequest struct {
+	UserID    uuid.UUID `json:"user_id"`
+	UserName  string    `json:"user_name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type InviteModel struct {
+	DB *sql.DB
+}
+
+func ValidateInvite(vdtr *validator.Validator, invite *Invite) {
+	vdtr.Check(invite.MaxUses >= 0, "max_uses", "cannot be negative")
+	vdtr.Check(invite.MaxUses <= 10_000, "max_uses", "cannot be more than 10000")
+	if invite.Expiry != nil {
+		vdtr.Check(invite.Expiry.After(time.Now()), "expires_in_hours", "must be in the future")
+		vdtr.Check(
+			invite.Expiry.Before(time.Now().Add(30*24*time.Hour)),
+			"expires_in_hours",
+			"cannot be more than 30 days",
+		)
+	}
+}
+
+func (model InviteModel) New(invite *Invite) error {
+	var err error
+	invite.ID = uuid.New()
+	invite.PlainText, invite.Hash, err = generatePlainTextAndHash()
+	if err != nil {
+		return err
+	}
+
+	sqlQuery := `
+INSERT INTO chat_invites(id, hash, chat_id, created_by, expiry, max_uses)
+VALUES($1, $2, $3, $4, $5, $6)
+RETURNING created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{
+		invite.ID,
+		invite.Hash,
+		invite.ChatID,
+		invite.CreatedBy,
+		invite.Expiry,
+		invite.MaxUses,
+	}
+	return model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(&invite.CreatedAt)
+}
+
+func (model InviteModel) GetAllForChat(chatID uuid.UUID) ([]*Invite, error) {
+	sqlQuery := `
+SELECT id, created_by, created_at, expiry, max_uses, uses, revoked FROM chat_invites
+WHERE chat_id = $1
+ORDER BY created_at DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invites []*Invite
+
+	for rows.Next() {
+		invite := Invite{ChatID: chatID}
+		var expiry sql.NullTime
+		err = rows.Scan(
+			&invite.ID,
+			&invite.CreatedBy,
+			&invite.CreatedAt,
+			&expiry,
+			&invite.MaxUses,
+			&invite.Uses,
+			&invite.Revoked,
+		)
+		if err != nil {
+			return nil, err
+		}
+		if expiry.Valid {
+			invite.Expiry = &expiry.Time
+		}
+		invites = append(invites, &invite)
+	}
+
+	err = rows.Err()
+	return invites, err
+}
+
+func (model InviteModel) Revoke(chatID, inviteID uuid.UUID) error {
+	sqlQuery := `
+UPDATE chat_invites
+SET revoked = true
+WHERE id = $1
+AND chat_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, inviteID, chatID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrInviteNotFound
+	}
+	return nil
+}
+
+// Redeem adds the user to the invite's chat and counts the use, it returns
+// the id of the joined chat.
+func (model InviteModel) Redeem(tokenPlainText string, userID uuid.UUID) (uuid.UUID, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+
+	sqlQuery := `
+SELECT id, chat_id FROM chat_invites
+WHERE hash = $1
+AND chat_id IN (SELECT id FROM chats WHERE deleted_at IS NULL)
+AND revoked = false
+AND (expiry IS NULL OR expiry > NOW())
+AND (max_uses = 0 OR uses < max_uses)
+FOR UPDATE
+	`
+	sqlQuery2 := `
+SELECT TRUE FROM chat_bans
+WHERE chat_id = $1
+AND user_id = $2
+	`
+	sqlQuery3 := `
+INSERT INTO users_chats(user_id, chat_id, is_admin)
+VALUES($1, $2, false)
+	`
+	sqlQuery4 := `
+UPDATE chat_invites
+SET uses = uses + 1
+WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	defer tx.Rollback()
+
+	var inviteID, chatID uuid.UUID
+	err = tx.QueryRowContext(ctx, sqlQuery, tokenHash[:]).Scan(&inviteID, &chatID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return uuid.Nil, ErrInvalidInvite
+		default:
+			return uuid.Nil, err
+		}
+	}
+
+	var temp bool
+	err = tx.QueryRowContext(ctx, sqlQuery2, chatID, userID).Scan(&temp)
+	switch {
+	case err == nil:
+		return uuid.Nil, ErrBannedFromChat
+	case !errors.Is(err, sql.ErrNoRows):
+		return uuid.Nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, sqlQuery3, userID, chatID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_chats_pkey"`:
+			return uuid.Nil, ErrAlreadyMember
+		default:
+			return uuid.Nil, err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, sqlQuery4, inviteID)
+	if err != nil {
+		return uuid.Nil, err
+	}
+
+	return chatID, tx.Commit()
+}
+
+func (model ChatModel) RequestJoin(chatID, userID uuid.UUID) error {
+	sqlQuery := `
+INSERT INTO chat_join_requests(chat_id, user_id)
+VALUES($1, $2)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, sqlQuery, chatID, userID)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "chat_join_requests_pkey"`:
+			return ErrDuplicateRequest
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (model ChatModel) GetJoinRequests(chatID uuid.UUID) ([]*JoinRequest, error) {
+	sqlQuery := `
+SELECT users.id, users.name, chat_join_requests.created_at FROM chat_join_requests
+JOIN users ON users.id = chat_join_requests.user_id
+WHERE chat_join_requests.chat_id = $1
+ORDER BY chat_join_requests.created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var requests []*JoinRequest
+
+	for rows.Next() {
+		var request JoinRequest
+		err = rows.Scan(&request.UserID, &request.UserName, &request.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, &request)
+	}
+
+	err = rows.Err()
+	return requests, err
+}
+
+func (model ChatModel) DeleteJoinRequest(chatID, userID uuid.UUID) error {
+	sqlQuery := `
+DELETE FROM chat_join_requests
+WHERE chat_id = $1
+AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, chatID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRequestNotFound
+	}
+	return nil
+}
+
+// ApproveJoinRequest makes the user who asked to join a member, the request
+// is only used up when they could be added or already are one.
+func (model ChatModel) ApproveJoinRequest(chatID, userID uuid.UUID) error {
+	sqlQuery := `
+DELETE FROM chat_join_requests
+WHERE chat_id = $1
+AND user_id = $2
+	`
+	sqlQuery2 := `
+SELECT TRUE FROM chat_bans
+WHERE chat_id = $1
+AND user_id = $2
+	`
+	sqlQuery3 := `
+INSERT INTO users_chats(user_id, chat_id, is_admin)
+VALUES($1, $2, false)
+ON CONFLICT (chat_id, user_id) DO NOTHING
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, sqlQuery, chatID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrRequestNotFound
+	}
+
+	var temp bool
+	err = tx.QueryRowContext(ctx, sqlQuery2, chatID, userID).Scan(&temp)
+	switch {
+	case err == nil:
+		return ErrBannedFromChat
+	case !errors.Is(err, sql.ErrNoRows):
+		return err
+	}
+
+	result, err = tx.ExecContext(ctx, sqlQuery3, userID, chatID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err = result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit()
+	if err == nil && rowsAffected == 0 {
+		return ErrAlreadyMember
+	}
+	return err
+}
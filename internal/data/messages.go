@@ -3,9 +3,14 @@ package data
 import (
 	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 
@@ -19,6 +24,43 @@ type Message struct {
 	UserID  uuid.UUID `json:"user_id"`
 	Content Content   `json:"content"`
 	Type    Int32     `json:"type"`
+	// DisplayName and DisplayAvatar replace the sender's name and avatar,
+	// they are set by incoming webhooks.
+	DisplayName   string      `json:"display_name,omitempty"`
+	DisplayAvatar string      `json:"display_avatar,omitempty"`
+	Attachments   Attachments `json:"attachments,omitempty"`
+}
+
+// Attachment is a card shown under the message text.
+type Attachment struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+	URL   string `json:"url,omitempty"`
+	Color string `json:"color,omitempty"`
+}
+
+// Attachments is stored as a JSON array.
+type Attachments []Attachment
+
+func (attachments Attachments) Value() (driver.Value, error) {
+	if attachments == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(attachments)
+}
+
+func (attachments *Attachments) Scan(src interface{}) error {
+	switch src := src.(type) {
+	case []byte:
+		return json.Unmarshal(src, attachments)
+	case string:
+		return json.Unmarshal([]byte(src), attachments)
+	case nil:
+		*attachments = nil
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into attachments", src)
+	}
 }
 
 type MessageWithUser struct {
@@ -55,9 +97,22 @@ type MessagesModel struct {
 }
 
 const (
-	MessageJoined = int32(50)
-	MessageLeft   = int32(51)
-	MessageNormal = int32(1)
+	MaxAttachments          = 10
+	MaxDisplayNameLength    = 80
+	MaxAttachmentTextLength = 2000
+)
+
+var ColorRX = regexp.MustCompile("^#[0-9a-fA-F]{6}$")
+
+const (
+	MessageJoined  = int32(50)
+	MessageLeft    = int32(51)
+	MessageKicked  = int32(52)
+	MessageBanned  = int32(53)
+	MessageUpdated = int32(54)
+	MessageNormal  = int32(1)
+	// MessageAction is sent with /me, clients show it after the sender's name.
+	MessageAction = int32(2)
 )
 
 var ErrMessageDeletionFailed = errors.New("failed to delete message")
@@ -69,16 +124,60 @@ func ValidateMessage(vdtr *validator.Validator, message *Message, userModel *Use
 		"content",
 		"cannot be more than 500 characters long")
 	vdtr.Check(
-		message.Type.Int.Int32 == MessageNormal,
+		message.Type.Int.Int32 == MessageNormal || message.Type.Int.Int32 == MessageAction,
 		"type",
 		"unsupported message type",
 	)
 }
 
+// ValidateAttachments checks the attachments and display overrides of a
+// message posted through an incoming webhook.
+func ValidateAttachments(vdtr *validator.Validator, message *Message) {
+	vdtr.Check(
+		utf8.RuneCountInString(message.DisplayName) <= MaxDisplayNameLength,
+		"username",
+		fmt.Sprintf("must not be more than %d characters long", MaxDisplayNameLength),
+	)
+	if message.DisplayAvatar != "" {
+		vdtr.Check(validHTTPURL(message.DisplayAvatar), "avatar_url", "must be an absolute http or https URL")
+	}
+
+	vdtr.Check(
+		len(message.Attachments) <= MaxAttachments,
+		"attachments",
+		fmt.Sprintf("must not contain more than %d attachments", MaxAttachments),
+	)
+	for _, attachment := range message.Attachments {
+		vdtr.Check(
+			attachment.Title != "" || attachment.Text != "",
+			"attachments",
+			"must each have a title or a text",
+		)
+		vdtr.Check(len(attachment.Title) <= 200, "attachments", "titles must not be more than 200 bytes long")
+		vdtr.Check(
+			len(attachment.Text) <= MaxAttachmentTextLength,
+			"attachments",
+			fmt.Sprintf("texts must not be more than %d bytes long", MaxAttachmentTextLength),
+		)
+		if attachment.URL != "" {
+			vdtr.Check(validHTTPURL(attachment.URL), "attachments", "urls must be absolute http or https URLs")
+		}
+		if attachment.Color != "" {
+			vdtr.Check(validator.Matches(attachment.Color, ColorRX), "attachments", "colors must look like #rrggbb")
+		}
+	}
+}
+
+func validHTTPURL(rawURL string) bool {
+	target, err := url.Parse(rawURL)
+	return err == nil && (target.Scheme == "http" || target.Scheme == "https") && target.Host != "" &&
+		len(rawURL) <= 2000
+}
+
 func (model MessagesModel) SendMessage(message *Message) error {
 	sqlQuery := `
-INSERT INTO messages(id, chat_id, user_id, content, type)
-VALUES ($1, $2, $3, $4, $5)
+INSERT INTO messages(id, chat_id, user_id, content, type, display_name, display_avatar, attachments)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
 RETURNING sent
 	`
 	message.ID = uuid.New()
@@ -91,6 +190,9 @@ RETURNING sent
 		message.UserID,
 		message.Content.NullString,
 		message.Type.Int,
+		message.DisplayName,
+		message.DisplayAvatar,
+		message.Attachments,
 	}
 
 	err := model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(&message.Sent.Sent)
@@ -11,17 +11,37 @@ var (
 )
 
 type Modles struct {
-	Users    UserModel
-	Tokens   TokenModel
-	Chats    ChatModel
-	Messages MessagesModel
+	Users      UserModel
+	Tokens     TokenModel
+	Chats      ChatModel
+	Messages   MessagesModel
+	Invites    InviteModel
+	Folders    FolderModel
+	Sessions   SessionModel
+	TwoFactor  TwoFactorModel
+	Identities IdentityModel
+	Blocks     BlockModel
+	Exports    ExportModel
+	Bots       BotModel
+	Webhooks   WebhookModel
+	Incoming   IncomingWebhookModel
 }
 
 func NewModels(db *sql.DB) Modles {
 	return Modles{
-		Users:    UserModel{DB: db},
-		Tokens:   TokenModel{DB: db},
-		Chats:    ChatModel{DB: db},
-		Messages: MessagesModel{DB: db},
+		Users:      UserModel{DB: db},
+		Tokens:     TokenModel{DB: db},
+		Chats:      ChatModel{DB: db},
+		Messages:   MessagesModel{DB: db},
+		Invites:    InviteModel{DB: db},
+		Folders:    FolderModel{DB: db},
+		Sessions:   SessionModel{DB: db},
+		TwoFactor:  TwoFactorModel{DB: db},
+		Identities: IdentityModel{DB: db},
+		Blocks:     BlockModel{DB: db},
+		Exports:    ExportModel{DB: db},
+		Bots:       BotModel{DB: db},
+		Webhooks:   WebhookModel{DB: db},
+		Incoming:   IncomingWebhookModel{DB: db},
 	}
 }
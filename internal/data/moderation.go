@@ -0,0 +1,151 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+func (model ChatModel) IsBanned(chatID, userID uuid.UUID) (bool, error) {
+	sqlQuery := `
+SELECT TRUE FROM chat_bans
+WHERE chat_id = $1
+AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var temp bool
+	err := model.DB.QueryRowContext(ctx, sqlQuery, chatID, userID).Scan(&temp)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Ban records the ban and removes the user from the chat in one transaction.
+// The returned bool reports whether the user was a member at the time.
+func (model ChatModel) Ban(chatID, userID, bannedBy uuid.UUID) (bool, error) {
+	sqlQuery := `
+INSERT INTO chat_bans(chat_id, user_id, banned_by)
+VALUES($1, $2, $3)
+ON CONFLICT (chat_id, user_id) DO NOTHING
+	`
+	sqlQuery2 := `
+DELETE FROM users_chats
+WHERE chat_id = $1
+AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, sqlQuery, chatID, userID, bannedBy)
+	if err != nil {
+		return false, err
+	}
+
+	result, err := tx.ExecContext(ctx, sqlQuery2, chatID, userID)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected > 0, tx.Commit()
+}
+
+func (model ChatModel) Unban(chatID, userID uuid.UUID) error {
+	sqlQuery := `
+DELETE FROM chat_bans
+WHERE chat_id = $1
+AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, chatID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotBanned
+	}
+	return nil
+}
+
+// Mute silences a member until the given time, a zero time lifts the mute.
+func (model ChatModel) Mute(chatID, userID uuid.UUID, until time.Time) error {
+	sqlQuery := `
+UPDATE users_chats
+SET muted_until = $3
+WHERE chat_id = $1
+AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	mutedUntil := sql.NullTime{Time: until, Valid: !until.IsZero()}
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, chatID, userID, mutedUntil)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotInChat
+	}
+	return nil
+}
+
+// MutedUntil returns the end of an active mute, or a zero time if the member
+// is free to post.
+func (model ChatModel) MutedUntil(chatID, userID uuid.UUID) (time.Time, error) {
+	sqlQuery := `
+SELECT muted_until FROM users_chats
+WHERE chat_id = $1
+AND user_id = $2
+AND muted_until > NOW()
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var mutedUntil time.Time
+	err := model.DB.QueryRowContext(ctx, sqlQuery, chatID, userID).Scan(&mutedUntil)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return time.Time{}, nil
+		default:
+			return time.Time{}, err
+		}
+	}
+	return mutedUntil, nil
+}
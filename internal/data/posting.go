@@ -0,0 +1,116 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/validator"
+)
+
+const MaxSlowModeSeconds = 60 * 60
+
+var ErrSlowMode = errors.New("slow mode is on")
+
+func ValidateSlowMode(vdtr *validator.Validator, seconds int) {
+	vdtr.Check(seconds >= 0, "slow_mode_seconds", "cannot be negative")
+	vdtr.Check(seconds <= MaxSlowModeSeconds, "slow_mode_seconds", "cannot be more than an hour")
+}
+
+// SlowModeRemaining returns how long the user still has to wait before they
+// can post again, it is zero when slow mode is off or the cooldown is over.
+func (chat *Chat) SlowModeRemaining(lastSent, now time.Time) time.Duration {
+	if chat.SlowModeSeconds == 0 || lastSent.IsZero() {
+		return 0
+	}
+
+	remaining := lastSent.Add(time.Duration(chat.SlowModeSeconds) * time.Second).Sub(now)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// SendSlowMode stores the message unless the user is still cooling down from
+// their last one, in which case it returns ErrSlowMode and how long is left.
+// The member's row stays locked until the message is in, so two messages sent
+// at once cannot both get past the check.
+func (model MessagesModel) SendSlowMode(chat *Chat, message *Message) (time.Duration, error) {
+	sqlQuery := `
+SELECT TRUE FROM users_chats
+WHERE chat_id = $1
+AND user_id = $2
+FOR UPDATE
+	`
+	sqlQuery2 := `
+SELECT sent FROM messages
+WHERE chat_id = $1
+AND user_id = $2
+AND type IN ($3, $4)
+ORDER BY sent DESC
+LIMIT 1
+	`
+	sqlQuery3 := `
+INSERT INTO messages(id, chat_id, user_id, content, type, display_name, display_avatar, attachments)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+RETURNING sent
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var temp bool
+	err = tx.QueryRowContext(ctx, sqlQuery, message.ChatID, message.UserID).Scan(&temp)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrNotInChat
+		default:
+			return 0, err
+		}
+	}
+
+	var lastSent time.Time
+	err = tx.QueryRowContext(
+		ctx,
+		sqlQuery2,
+		message.ChatID,
+		message.UserID,
+		MessageNormal,
+		MessageAction,
+	).Scan(&lastSent)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+
+	remaining := chat.SlowModeRemaining(lastSent, time.Now())
+	if remaining > 0 {
+		return remaining, ErrSlowMode
+	}
+
+	message.ID = uuid.New()
+	args := []interface{}{
+		message.ID,
+		message.ChatID,
+		message.UserID,
+		message.Content.NullString,
+		message.Type.Int,
+		message.DisplayName,
+		message.DisplayAvatar,
+		message.Attachments,
+	}
+	err = tx.QueryRowContext(ctx, sqlQuery3, args...).Scan(&message.Sent.Sent)
+	if err != nil {
+		return 0, err
+	}
+
+	return 0, tx.Commit()
+}
@@ -0,0 +1,219 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/validator"
+)
+
+const MaxPinnedChats = 10
+
+const (
+	NotifyAll      = "all"
+	NotifyMentions = "mentions"
+	NotifyNothing  = "nothing"
+)
+
+// ChatPreferences are a member's own settings for one chat.
+type ChatPreferences struct {
+	MutedUntil *time.Time `json:"muted_until,omitempty"`
+	Notify     string     `json:"notify"`
+	Hidden     bool       `json:"hidden"`
+	PinnedAt   *time.Time `json:"pinned_at,omitempty"`
+	Archived   bool       `json:"archived"`
+}
+
+func DefaultChatPreferences() ChatPreferences {
+	return ChatPreferences{Notify: NotifyAll}
+}
+
+func ValidateChatPreferences(vdtr *validator.Validator, preferences *ChatPreferences) {
+	vdtr.Check(
+		vdtr.In(preferences.Notify, NotifyAll, NotifyMentions, NotifyNothing),
+		"notify",
+		"must be one of all, mentions or nothing",
+	)
+	if preferences.MutedUntil != nil {
+		vdtr.Check(preferences.MutedUntil.After(time.Now()), "muted_until", "must be in the future")
+	}
+}
+
+// IsMuted reports whether notifications are muted at the given time.
+func (preferences ChatPreferences) IsMuted(now time.Time) bool {
+	return preferences.MutedUntil != nil && preferences.MutedUntil.After(now)
+}
+
+// ShouldNotify decides whether a message with the given content should alert
+// the member named userName.
+func (preferences ChatPreferences) ShouldNotify(content, userName string, now time.Time) bool {
+	if preferences.IsMuted(now) {
+		return false
+	}
+
+	switch preferences.Notify {
+	case NotifyNothing:
+		return false
+	case NotifyMentions:
+		return Mentions(content, userName)
+	default:
+		return true
+	}
+}
+
+// Mentions reports whether the content mentions the given name with an @.
+func Mentions(content, name string) bool {
+	if name == "" {
+		return false
+	}
+	return strings.Contains(strings.ToLower(content), "@"+strings.ToLower(name))
+}
+
+func (model ChatModel) GetPreferences(chatID, userID uuid.UUID) (*ChatPreferences, error) {
+	sqlQuery := `
+SELECT notifications_muted_until, notify, hidden, pinned_at, archived FROM users_chats
+WHERE chat_id = $1
+AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var preferences ChatPreferences
+	err := model.DB.QueryRowContext(ctx, sqlQuery, chatID, userID).Scan(
+		&preferences.MutedUntil,
+		&preferences.Notify,
+		&preferences.Hidden,
+		&preferences.PinnedAt,
+		&preferences.Archived,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrNotInChat
+		default:
+			return nil, err
+		}
+	}
+	return &preferences, nil
+}
+
+func (model ChatModel) UpdatePreferences(
+	chatID, userID uuid.UUID,
+	preferences *ChatPreferences,
+) error {
+	sqlQuery := `
+UPDATE users_chats
+SET notifications_muted_until = $3, notify = $4, hidden = $5, pinned_at = $6, archived = $7
+WHERE chat_id = $1
+AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	args := []interface{}{
+		chatID,
+		userID,
+		preferences.MutedUntil,
+		preferences.Notify,
+		preferences.Hidden,
+		preferences.PinnedAt,
+		preferences.Archived,
+	}
+	result, err := model.DB.ExecContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrNotInChat
+	}
+	return nil
+}
+
+// GetChatPreferences returns the user's preferences keyed by chat id.
+func (model UserModel) GetChatPreferences(userID uuid.UUID) (map[uuid.UUID]ChatPreferences, error) {
+	sqlQuery := `
+SELECT chat_id, notifications_muted_until, notify, hidden, pinned_at, archived FROM users_chats
+WHERE user_id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	preferences := make(map[uuid.UUID]ChatPreferences)
+
+	for rows.Next() {
+		var chatID uuid.UUID
+		var chatPreferences ChatPreferences
+		err = rows.Scan(
+			&chatID,
+			&chatPreferences.MutedUntil,
+			&chatPreferences.Notify,
+			&chatPreferences.Hidden,
+			&chatPreferences.PinnedAt,
+			&chatPreferences.Archived,
+		)
+		if err != nil {
+			return nil, err
+		}
+		preferences[chatID] = chatPreferences
+	}
+
+	err = rows.Err()
+	return preferences, err
+}
+
+// CountPinned returns how many chats the user has pinned.
+func (model ChatModel) CountPinned(userID uuid.UUID) (int, error) {
+	sqlQuery := `
+SELECT COUNT(*) FROM users_chats
+JOIN chats ON chats.id = users_chats.chat_id
+WHERE users_chats.user_id = $1
+AND users_chats.pinned_at IS NOT NULL
+AND chats.deleted_at IS NULL
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var count int
+	err := model.DB.QueryRowContext(ctx, sqlQuery, userID).Scan(&count)
+	return count, err
+}
+
+// Unarchive brings the chat back out of the archive of every member who is
+// not muting it or blocking the sender, it is called whenever there is new
+// activity in the chat.
+func (model ChatModel) Unarchive(chatID, senderID uuid.UUID) error {
+	sqlQuery := `
+UPDATE users_chats
+SET archived = false
+WHERE chat_id = $1
+AND archived = true
+AND (notifications_muted_until IS NULL OR notifications_muted_until <= NOW())
+AND NOT EXISTS (
+  SELECT 1 FROM user_blocks
+  WHERE user_blocks.blocker_id = users_chats.user_id
+  AND user_blocks.blocked_id = $2
+)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, sqlQuery, chatID, senderID)
+	return err
+}
@@ -0,0 +1,148 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"slices"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/validator"
+)
+
+var (
+	ErrMessageNotFound  = errors.New("message not found")
+	ErrAlreadyReacted   = errors.New("already reacted with this emoji")
+	ErrReactionNotFound = errors.New("reaction not found")
+)
+
+type Reaction struct {
+	Emoji string      `json:"emoji"`
+	Count int         `json:"count"`
+	Users []uuid.UUID `json:"users"`
+}
+
+func ValidateEmoji(vdtr *validator.Validator, emoji string) {
+	vdtr.Check(emoji != "", "emoji", "must be provided")
+	vdtr.Check(utf8.RuneCountInString(emoji) <= 8, "emoji", "must be a single emoji")
+}
+
+// GetChatID returns the chat a message that was not deleted belongs to.
+func (model MessagesModel) GetChatID(messageID uuid.UUID) (uuid.UUID, error) {
+	sqlQuery := `
+SELECT chat_id FROM messages
+WHERE id = $1
+AND deleted = false
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var chatID uuid.UUID
+	err := model.DB.QueryRowContext(ctx, sqlQuery, messageID).Scan(&chatID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return uuid.Nil, ErrMessageNotFound
+		default:
+			return uuid.Nil, err
+		}
+	}
+	return chatID, nil
+}
+
+func (model MessagesModel) AddReaction(messageID, userID uuid.UUID, emoji string) error {
+	sqlQuery := `
+INSERT INTO message_reactions(message_id, user_id, emoji)
+VALUES($1, $2, $3)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, sqlQuery, messageID, userID, emoji)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "message_reactions_pkey"`:
+			return ErrAlreadyReacted
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (model MessagesModel) RemoveReaction(messageID, userID uuid.UUID, emoji string) error {
+	sqlQuery := `
+DELETE FROM message_reactions
+WHERE message_id = $1
+AND user_id = $2
+AND emoji = $3
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, messageID, userID, emoji)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrReactionNotFound
+	}
+	return nil
+}
+
+// GetReactions groups the reactions on a message by emoji, most used first.
+func (model MessagesModel) GetReactions(messageID uuid.UUID) ([]*Reaction, error) {
+	sqlQuery := `
+SELECT emoji, user_id FROM message_reactions
+WHERE message_id = $1
+ORDER BY created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reactions := []*Reaction{}
+	byEmoji := make(map[string]*Reaction)
+
+	for rows.Next() {
+		var emoji string
+		var userID uuid.UUID
+		err = rows.Scan(&emoji, &userID)
+		if err != nil {
+			return nil, err
+		}
+
+		reaction, ok := byEmoji[emoji]
+		if !ok {
+			reaction = &Reaction{Emoji: emoji}
+			byEmoji[emoji] = reaction
+			reactions = append(reactions, reaction)
+		}
+		reaction.Count++
+		reaction.Users = append(reaction.Users, userID)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortStableFunc(reactions, func(a, b *Reaction) int {
+		return b.Count - a.Count
+	})
+	return reactions, nil
+}
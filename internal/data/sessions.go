@@ -0,0 +1,405 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const maxDeviceNameLength = 100
+
+var (
+	ErrSessionNotFound    = errors.New("session not found")
+	ErrRefreshTokenReused = errors.New("refresh token was already used")
+)
+
+// Session is one signed in device, every authentication token belongs to
+// one and revoking the session revokes its tokens.
+type Session struct {
+	ID         uuid.UUID `json:"id"`
+	UserID     uuid.UUID `json:"-"`
+	DeviceName string    `json:"device_name"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	Current    bool      `json:"current"`
+
+	// TokenExpiry is when the access token the session was looked up by
+	// runs out.
+	TokenExpiry time.Time `json:"-"`
+}
+
+type SessionModel struct {
+	DB *sql.DB
+}
+
+// New signs the user in on a new device, it returns the session with its
+// access and refresh tokens.
+func (model SessionModel) New(
+	userID uuid.UUID,
+	deviceName, ip string,
+	accessTTL, refreshTTL time.Duration,
+) (*Session, *Token, *Token, error) {
+	// sessions whose tokens all ran out are dead, clear them on the way
+	sqlQuery := `
+DELETE FROM sessions
+WHERE user_id = $1
+AND NOT EXISTS (SELECT TRUE FROM tokens WHERE tokens.session_id = sessions.id AND tokens.expiry > NOW())
+	`
+	sqlQuery2 := `
+INSERT INTO sessions(id, user_id, device_name, ip)
+VALUES($1, $2, $3, $4)
+RETURNING created_at, last_used_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	if len(deviceName) > maxDeviceNameLength {
+		deviceName = deviceName[:maxDeviceNameLength]
+	}
+	session := &Session{
+		ID:         uuid.New(),
+		UserID:     userID,
+		DeviceName: deviceName,
+		IP:         ip,
+		Current:    true,
+	}
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	args := []interface{}{session.ID, userID, session.DeviceName, session.IP}
+	err = tx.QueryRowContext(ctx, sqlQuery2, args...).Scan(&session.CreatedAt, &session.LastUsedAt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	access, refresh, err := issueSessionTokens(ctx, tx, session, accessTTL, refreshTTL)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return session, access, refresh, tx.Commit()
+}
+
+// Refresh trades a refresh token for a new access and refresh token pair.
+// Refresh tokens are single use, presenting one a second time means it was
+// stolen so the whole session is revoked and ErrRefreshTokenReused returned
+// along with the session.
+func (model SessionModel) Refresh(
+	tokenPlainText, ip string,
+	accessTTL, refreshTTL time.Duration,
+) (*Session, *Token, *Token, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+
+	sqlQuery := `
+SELECT sessions.id, sessions.user_id, sessions.device_name, sessions.created_at, tokens.used_at
+FROM tokens
+JOIN sessions ON sessions.id = tokens.session_id
+WHERE tokens.hash = $1
+AND tokens.scope = $2
+AND tokens.expiry > NOW()
+FOR UPDATE
+	`
+	sqlQuery2 := `
+DELETE FROM sessions
+WHERE id = $1
+	`
+	sqlQuery3 := `
+UPDATE tokens
+SET used_at = NOW()
+WHERE hash = $1
+	`
+	// access tokens of the previous pair are no longer needed
+	sqlQuery4 := `
+DELETE FROM tokens
+WHERE session_id = $1
+AND scope = $2
+	`
+	sqlQuery5 := `
+UPDATE sessions
+SET last_used_at = NOW(), ip = $2
+WHERE id = $1
+RETURNING last_used_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tx.Rollback()
+
+	session := Session{IP: ip, Current: true}
+	var usedAt sql.NullTime
+	err = tx.QueryRowContext(ctx, sqlQuery, tokenHash[:], ScopeRefresh).Scan(
+		&session.ID,
+		&session.UserID,
+		&session.DeviceName,
+		&session.CreatedAt,
+		&usedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, nil, err
+		}
+	}
+
+	if usedAt.Valid {
+		_, err = tx.ExecContext(ctx, sqlQuery2, session.ID)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		return &session, nil, nil, ErrRefreshTokenReused
+	}
+
+	_, err = tx.ExecContext(ctx, sqlQuery3, tokenHash[:])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, sqlQuery4, session.ID, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	err = tx.QueryRowContext(ctx, sqlQuery5, session.ID, ip).Scan(&session.LastUsedAt)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	access, refresh, err := issueSessionTokens(ctx, tx, &session, accessTTL, refreshTTL)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	return &session, access, refresh, tx.Commit()
+}
+
+// issueSessionTokens stores a new access and refresh token for the session.
+func issueSessionTokens(
+	ctx context.Context,
+	tx *sql.Tx,
+	session *Session,
+	accessTTL, refreshTTL time.Duration,
+) (*Token, *Token, error) {
+	sqlQuery := `
+INSERT INTO tokens (hash, user_id, expiry, scope, session_id)
+VALUES($1, $2, $3, $4, $5)
+	`
+
+	issue := func(timeToLive time.Duration, scope string) (*Token, error) {
+		token, err := generateToken(session.UserID, timeToLive, scope)
+		if err != nil {
+			return nil, err
+		}
+		token.SessionID = &session.ID
+
+		args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.SessionID}
+		_, err = tx.ExecContext(ctx, sqlQuery, args...)
+		return token, err
+	}
+
+	access, err := issue(accessTTL, ScopeAuthentication)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	refresh, err := issue(refreshTTL, ScopeRefresh)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return access, refresh, nil
+}
+
+// GetForToken returns the session and user an authentication token belongs
+// to.
+func (model SessionModel) GetForToken(tokenPlainText string) (*Session, *User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlainText))
+
+	sqlQuery := `
+SELECT sessions.id, sessions.device_name, sessions.ip, sessions.created_at, sessions.last_used_at,
+	tokens.expiry, users.id, users.created_at, users.name, users.email, users.password_hash, users.activated,
+	users.bio, users.avatar, users.status_text, users.status_emoji, users.status_expires_at, users.version,
+	COALESCE(users.username, ''), users.discoverability, users.is_bot
+FROM tokens
+JOIN sessions ON sessions.id = tokens.session_id
+JOIN users ON users.id = tokens.user_id
+WHERE tokens.hash = $1
+AND tokens.scope = $2
+AND tokens.expiry > NOW()
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var session Session
+	var user User
+	err := model.DB.QueryRowContext(ctx, sqlQuery, tokenHash[:], ScopeAuthentication).Scan(
+		&session.ID,
+		&session.DeviceName,
+		&session.IP,
+		&session.CreatedAt,
+		&session.LastUsedAt,
+		&session.TokenExpiry,
+		&user.ID,
+		&user.CreateAt.Sent,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Bio,
+		&user.Avatar,
+		&user.Status.Text,
+		&user.Status.Emoji,
+		&user.Status.ExpiresAt,
+		&user.Version,
+		&user.Username,
+		&user.Discoverability,
+		&user.IsBot,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+	user.normalizeProfile()
+	session.UserID = user.ID
+	session.Current = true
+	return &session, &user, nil
+}
+
+// Touch records that the session was just used from the given address.
+func (model SessionModel) Touch(sessionID uuid.UUID, ip string) error {
+	sqlQuery := `
+UPDATE sessions
+SET last_used_at = NOW(), ip = $2
+WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, sqlQuery, sessionID, ip)
+	return err
+}
+
+// GetAllForUser lists the user's live sessions, most recently used first.
+func (model SessionModel) GetAllForUser(userID, currentID uuid.UUID) ([]*Session, error) {
+	sqlQuery := `
+SELECT id, device_name, ip, created_at, last_used_at FROM sessions
+WHERE user_id = $1
+AND EXISTS (SELECT TRUE FROM tokens WHERE tokens.session_id = sessions.id AND tokens.expiry > NOW())
+ORDER BY last_used_at DESC
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []*Session
+
+	for rows.Next() {
+		session := Session{UserID: userID}
+		err = rows.Scan(
+			&session.ID,
+			&session.DeviceName,
+			&session.IP,
+			&session.CreatedAt,
+			&session.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		session.Current = session.ID == currentID
+		sessions = append(sessions, &session)
+	}
+
+	err = rows.Err()
+	return sessions, err
+}
+
+// Delete signs a session out, its tokens go with it.
+func (model SessionModel) Delete(sessionID, userID uuid.UUID) error {
+	sqlQuery := `
+DELETE FROM sessions
+WHERE id = $1
+AND user_id = $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, sessionID, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// DeleteAllForUser signs every session of the user out except keepID, pass
+// uuid.Nil to sign out of all of them. It returns the removed session ids.
+func (model SessionModel) DeleteAllForUser(userID, keepID uuid.UUID) ([]uuid.UUID, error) {
+	sqlQuery := `
+DELETE FROM sessions
+WHERE user_id = $1
+AND id <> $2
+RETURNING id
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, userID, keepID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessionIDs []uuid.UUID
+
+	for rows.Next() {
+		var sessionID uuid.UUID
+		err = rows.Scan(&sessionID)
+		if err != nil {
+			return nil, err
+		}
+		sessionIDs = append(sessionIDs, sessionID)
+	}
+
+	err = rows.Err()
+	return sessionIDs, err
+}
@@ -16,14 +16,18 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopePasswordReset  = "password-reset"
+	ScopeRefresh        = "refresh"
+	Scope2FAPending     = "2fa-pending"
 )
 
 type Token struct {
-	PlainText string    `json:"token"`
-	Hash      []byte    `json:"-"`
-	UserID    uuid.UUID `json:""`
-	Expiry    time.Time `json:"expiry"`
-	Scope     string    `json:"-"`
+	PlainText string     `json:"token"`
+	Hash      []byte     `json:"-"`
+	UserID    uuid.UUID  `json:""`
+	Expiry    time.Time  `json:"expiry"`
+	Scope     string     `json:"-"`
+	SessionID *uuid.UUID `json:"-"`
 }
 
 type TokenModel struct {
@@ -42,19 +46,27 @@ func generateToken(userID uuid.UUID, timeToLive time.Duration, scope string) (*T
 		Scope:  scope,
 	}
 
+	var err error
+	token.PlainText, token.Hash, err = generatePlainTextAndHash()
+	if err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+
+func generatePlainTextAndHash() (string, []byte, error) {
 	// generate random 16 bytes
 	randomBytes := make([]byte, 16)
 	_, err := rand.Read(randomBytes)
 	if err != nil {
-		return nil, err
+		return "", nil, err
 	}
 
-	token.PlainText = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+	plainText := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
 
-	hash := sha256.Sum256([]byte(token.PlainText))
-	token.Hash = hash[:]
-
-	return token, nil
+	hash := sha256.Sum256([]byte(plainText))
+	return plainText, hash[:], nil
 }
 
 func (model TokenModel) New(
@@ -73,11 +85,11 @@ func (model TokenModel) New(
 
 func (model TokenModel) Insert(token *Token) error {
 	sqlQuery := `
-INSERT INTO tokens (hash, user_id, expiry, scope)
-VALUES($1, $2, $3, $4)
+INSERT INTO tokens (hash, user_id, expiry, scope, session_id)
+VALUES($1, $2, $3, $4, $5)
 	`
 
-	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.SessionID}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
@@ -0,0 +1,310 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/mf751/gocha/internal/validator"
+)
+
+const (
+	RecoveryCodeCount = 10
+
+	// MaxTwoFactorAttempts wrong codes in a row void the pending sign in.
+	MaxTwoFactorAttempts = 5
+)
+
+var (
+	ErrTwoFactorEnabled    = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled = errors.New("two-factor authentication is not enabled")
+)
+
+type TwoFactor struct {
+	UserID         uuid.UUID
+	Secret         string
+	Confirmed      bool
+	LastUsedStep   int64
+	FailedAttempts int
+}
+
+type TwoFactorModel struct {
+	DB *sql.DB
+}
+
+func ValidateTwoFactorCode(vdtr *validator.Validator, code string) {
+	vdtr.Check(code != "", "code", "must be provided")
+	vdtr.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+// GenerateRecoveryCodes returns new single use recovery codes along with
+// the hashes to store.
+func GenerateRecoveryCodes() ([]string, [][]byte, error) {
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+
+	codes := make([]string, RecoveryCodeCount)
+	hashes := make([][]byte, RecoveryCodeCount)
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(encoding.EncodeToString(randomBytes))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// Enroll stores a new secret waiting to be confirmed, replacing any earlier
+// unconfirmed one.
+func (model TwoFactorModel) Enroll(userID uuid.UUID, secret string) error {
+	sqlQuery := `
+INSERT INTO user_totp(user_id, secret)
+VALUES($1, $2)
+ON CONFLICT (user_id) DO UPDATE
+SET secret = EXCLUDED.secret, last_used_step = 0, failed_attempts = 0, created_at = NOW()
+WHERE user_totp.confirmed = false
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTwoFactorEnabled
+	}
+	return nil
+}
+
+func (model TwoFactorModel) Get(userID uuid.UUID) (*TwoFactor, error) {
+	sqlQuery := `
+SELECT secret, confirmed, last_used_step, failed_attempts FROM user_totp
+WHERE user_id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	twoFactor := TwoFactor{UserID: userID}
+	err := model.DB.QueryRowContext(ctx, sqlQuery, userID).Scan(
+		&twoFactor.Secret,
+		&twoFactor.Confirmed,
+		&twoFactor.LastUsedStep,
+		&twoFactor.FailedAttempts,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrTwoFactorNotEnabled
+		default:
+			return nil, err
+		}
+	}
+	return &twoFactor, nil
+}
+
+// IsEnabled reports whether the user has confirmed two-factor
+// authentication.
+func (model TwoFactorModel) IsEnabled(userID uuid.UUID) (bool, error) {
+	twoFactor, err := model.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrTwoFactorNotEnabled):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+	return twoFactor.Confirmed, nil
+}
+
+// Confirm turns two-factor authentication on and replaces the recovery
+// codes.
+func (model TwoFactorModel) Confirm(userID uuid.UUID, step int64, recoveryHashes [][]byte) error {
+	sqlQuery := `
+UPDATE user_totp
+SET confirmed = true, last_used_step = $2
+WHERE user_id = $1
+AND confirmed = false
+	`
+	sqlQuery2 := `
+DELETE FROM recovery_codes
+WHERE user_id = $1
+	`
+	sqlQuery3 := `
+INSERT INTO recovery_codes(user_id, hash)
+VALUES($1, $2)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, sqlQuery, userID, step)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrTwoFactorEnabled
+	}
+
+	_, err = tx.ExecContext(ctx, sqlQuery2, userID)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range recoveryHashes {
+		_, err = tx.ExecContext(ctx, sqlQuery3, userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UseStep records a successful code for the step, it returns false when a
+// code for that step or a later one was already used.
+func (model TwoFactorModel) UseStep(userID uuid.UUID, step int64) (bool, error) {
+	sqlQuery := `
+UPDATE user_totp
+SET last_used_step = $2, failed_attempts = 0
+WHERE user_id = $1
+AND last_used_step < $2
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	return rowsAffected > 0, err
+}
+
+// UseRecoveryCode spends one of the user's recovery codes, it returns false
+// if the code is unknown or was used before.
+func (model TwoFactorModel) UseRecoveryCode(userID uuid.UUID, code string) (bool, error) {
+	sqlQuery := `
+UPDATE recovery_codes
+SET used_at = NOW()
+WHERE user_id = $1
+AND hash = $2
+AND used_at IS NULL
+	`
+	sqlQuery2 := `
+UPDATE user_totp
+SET failed_attempts = 0
+WHERE user_id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return false, err
+	}
+
+	_, err = model.DB.ExecContext(ctx, sqlQuery2, userID)
+	return true, err
+}
+
+// Fail counts a wrong code and returns how many were entered in a row.
+func (model TwoFactorModel) Fail(userID uuid.UUID) (int, error) {
+	sqlQuery := `
+UPDATE user_totp
+SET failed_attempts = failed_attempts + 1
+WHERE user_id = $1
+RETURNING failed_attempts
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var failedAttempts int
+	err := model.DB.QueryRowContext(ctx, sqlQuery, userID).Scan(&failedAttempts)
+	return failedAttempts, err
+}
+
+func (model TwoFactorModel) ResetFailures(userID uuid.UUID) error {
+	sqlQuery := `
+UPDATE user_totp
+SET failed_attempts = 0
+WHERE user_id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, sqlQuery, userID)
+	return err
+}
+
+// Disable turns two-factor authentication off and drops the recovery codes.
+func (model TwoFactorModel) Disable(userID uuid.UUID) error {
+	sqlQuery := `
+DELETE FROM user_totp
+WHERE user_id = $1
+	`
+	sqlQuery2 := `
+DELETE FROM recovery_codes
+WHERE user_id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, sqlQuery2, userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -5,7 +5,11 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"regexp"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"golang.org/x/crypto/bcrypt"
@@ -14,25 +18,63 @@ import (
 )
 
 type User struct {
-	ID        uuid.UUID `json:"id"`
-	CreateAt  Sent      `json:"created_at"`
-	Name      string    `json:"name"`
-	Email     string    `json:"email,omitempty"`
-	Password  password  `json:"-"`
-	Activated bool      `json:"activated,omitempty"`
-	// Version   int       `json:"-"`
+	ID        uuid.UUID  `json:"id"`
+	CreateAt  Sent       `json:"created_at"`
+	Name      string     `json:"name"`
+	Username  string     `json:"username"`
+	Email     string     `json:"email,omitempty"`
+	Password  password   `json:"-"`
+	Activated bool       `json:"activated,omitempty"`
+	Bio       string     `json:"bio"`
+	Avatar    string     `json:"-"`
+	HasAvatar bool       `json:"has_avatar"`
+	Status    UserStatus `json:"status"`
+	Version   int        `json:"version"`
+	IsBot     bool       `json:"is_bot"`
+	// Discoverability decides who finds the user through the user search.
+	Discoverability string `json:"discoverability"`
 }
 
+// UserStatus is a custom status shown next to the user's name, it clears
+// itself once ExpiresAt has passed.
+type UserStatus struct {
+	Text      string     `json:"text"`
+	Emoji     string     `json:"emoji"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+const (
+	DiscoverableByEveryone = "everyone"
+	DiscoverableByContacts = "contacts"
+	DiscoverableByNobody   = "nobody"
+)
+
+var UsernameRX = regexp.MustCompile("^[a-zA-Z0-9_]{3,32}$")
+
+const (
+	MaxBioLength        = 500
+	MaxStatusTextLength = 100
+)
+
 var (
-	ErrDuplicateEmial = errors.New("duplicate email")
-	AnonymousUser     = &User{}
-	ErrNotAdmin       = errors.New("User is not admin in chat")
+	ErrDuplicateEmial    = errors.New("duplicate email")
+	AnonymousUser        = &User{}
+	ErrNotAdmin          = errors.New("User is not admin in chat")
+	ErrDuplicateUsername = errors.New("duplicate username")
 )
 
 func (user *User) IsAnonymous() bool {
 	return user == AnonymousUser
 }
 
+// normalizeProfile fills in the fields derived from a freshly loaded row.
+func (user *User) normalizeProfile() {
+	user.HasAvatar = user.Avatar != ""
+	if user.Status.ExpiresAt != nil && !user.Status.ExpiresAt.After(time.Now()) {
+		user.Status = UserStatus{}
+	}
+}
+
 type password struct {
 	plainText *string
 	hash      []byte
@@ -54,7 +96,18 @@ func (psd *password) Set(plainTextPassword string) error {
 	return nil
 }
 
+// IsSet reports whether the account has a password, accounts created through
+// an identity provider have none.
+func (psd *password) IsSet() bool {
+	return len(psd.hash) > 0
+}
+
 func (psd *password) Matches(plainTextPassword string) (bool, error) {
+	// bots and anonymized accounts have no password to sign in with
+	if len(psd.hash) == 0 {
+		return false, nil
+	}
+
 	err := bcrypt.CompareHashAndPassword(psd.hash, []byte(plainTextPassword))
 	if err != nil {
 		switch {
@@ -86,6 +139,9 @@ func ValidateUser(vdtr *validator.Validator, user *User) {
 	vdtr.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
 
 	ValidateEmail(vdtr, user.Email)
+	if user.Username != "" {
+		ValidateUsername(vdtr, user.Username)
+	}
 	if user.Password.plainText != nil {
 		ValidatePasswordPlainText(vdtr, *user.Password.plainText)
 	}
@@ -95,11 +151,57 @@ func ValidateUser(vdtr *validator.Validator, user *User) {
 	}
 }
 
+// NormalizeUsername drops the @ users tend to type in front of a username.
+func NormalizeUsername(username string) string {
+	return strings.TrimPrefix(strings.TrimSpace(username), "@")
+}
+
+func ValidateUsername(vdtr *validator.Validator, username string) {
+	vdtr.Check(
+		validator.Matches(username, UsernameRX),
+		"username",
+		"must be 3 to 32 letters, digits or underscores",
+	)
+}
+
+func ValidateProfile(vdtr *validator.Validator, user *User) {
+	vdtr.Check(user.Name != "", "name", "must be provided")
+	vdtr.Check(len(user.Name) <= 500, "name", "must not be more than 500 bytes long")
+	ValidateEmail(vdtr, user.Email)
+	if user.Username != "" {
+		ValidateUsername(vdtr, user.Username)
+	}
+	vdtr.Check(
+		vdtr.In(
+			user.Discoverability,
+			DiscoverableByEveryone,
+			DiscoverableByContacts,
+			DiscoverableByNobody,
+		),
+		"discoverability",
+		"must be everyone, contacts or nobody",
+	)
+	vdtr.Check(
+		utf8.RuneCountInString(user.Bio) <= MaxBioLength,
+		"bio",
+		fmt.Sprintf("must not be more than %d characters long", MaxBioLength),
+	)
+	vdtr.Check(
+		utf8.RuneCountInString(user.Status.Text) <= MaxStatusTextLength,
+		"status",
+		fmt.Sprintf("text must not be more than %d characters long", MaxStatusTextLength),
+	)
+	vdtr.Check(utf8.RuneCountInString(user.Status.Emoji) <= 8, "status", "emoji must be a single emoji")
+	if user.Status.ExpiresAt != nil {
+		vdtr.Check(user.Status.ExpiresAt.After(time.Now()), "status", "expiry must be in the future")
+	}
+}
+
 func (model UserModel) Insert(user *User) error {
 	sqlQuery := `
-INSERT INTO users(id, name, email, password_hash, activated)
-VALUES($1, $2, $3, $4, $5)
-RETURNING id, created_at
+INSERT INTO users(id, name, email, password_hash, activated, username)
+VALUES($1, $2, $3, $4, $5, NULLIF($6, ''))
+RETURNING id, created_at, version, discoverability, is_bot
 	`
 	args := []interface{}{
 		uuid.New().String(),
@@ -107,15 +209,24 @@ RETURNING id, created_at
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Username,
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(&user.ID, &user.CreateAt.Sent)
+	err := model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(
+		&user.ID,
+		&user.CreateAt.Sent,
+		&user.Version,
+		&user.Discoverability,
+		&user.IsBot,
+	)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmial
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_username_key"`:
+			return ErrDuplicateUsername
 		default:
 			return err
 		}
@@ -125,7 +236,9 @@ RETURNING id, created_at
 
 func (model UserModel) GetByEmail(email string) (*User, error) {
 	sqlQuery := `
-SELECT id, created_at, name, email, password_hash, activated
+SELECT id, created_at, name, email, password_hash, activated,
+	bio, avatar, status_text, status_emoji, status_expires_at, version,
+	COALESCE(username, ''), discoverability, is_bot
 FROM users
 WHERE email = $1
 	`
@@ -140,6 +253,15 @@ WHERE email = $1
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Bio,
+		&user.Avatar,
+		&user.Status.Text,
+		&user.Status.Emoji,
+		&user.Status.ExpiresAt,
+		&user.Version,
+		&user.Username,
+		&user.Discoverability,
+		&user.IsBot,
 	)
 	if err != nil {
 		switch {
@@ -149,31 +271,48 @@ WHERE email = $1
 			return nil, err
 		}
 	}
+	user.normalizeProfile()
 	return &user, nil
 }
 
+// Update saves the user as long as nobody changed it since it was loaded,
+// otherwise ErrEditConflict is returned.
 func (model UserModel) Update(user *User) error {
 	sqlQuery := `
 UPDATE users
-SET name = $1, email = $2, password_hash = $3, activated = $4
-WHERE id = $5
+SET name = $1, email = $2, password_hash = $3, activated = $4, bio = $5, avatar = $6,
+	status_text = $7, status_emoji = $8, status_expires_at = $9, username = NULLIF($12, ''),
+	discoverability = $13, version = version + 1
+WHERE id = $10
+AND version = $11
+RETURNING version
 	`
 	args := []interface{}{
 		user.Name,
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Bio,
+		user.Avatar,
+		user.Status.Text,
+		user.Status.Emoji,
+		user.Status.ExpiresAt,
 		user.ID,
+		user.Version,
+		user.Username,
+		user.Discoverability,
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	err := model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(&user.Name)
+	err := model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmial
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_username_key"`:
+			return ErrDuplicateUsername
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
@@ -183,11 +322,112 @@ WHERE id = $5
 	return nil
 }
 
+func (model UserModel) Activate(userID uuid.UUID) error {
+	sqlQuery := `
+UPDATE users
+SET activated = true, version = version + 1
+WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// ClaimUnactivated activates an account whose email was just proven by an
+// identity provider. Whoever registered the address first never proved it,
+// so their password, sessions, tokens and two-factor setup are dropped.
+func (model UserModel) ClaimUnactivated(userID uuid.UUID) error {
+	sqlQuery := `
+UPDATE users
+SET activated = true, password_hash = '', version = version + 1
+WHERE id = $1
+AND activated = false
+	`
+	sqlQueries := []string{
+		`DELETE FROM sessions WHERE user_id = $1`,
+		`DELETE FROM tokens WHERE user_id = $1`,
+		`DELETE FROM user_totp WHERE user_id = $1`,
+		`DELETE FROM recovery_codes WHERE user_id = $1`,
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, sqlQuery, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	for _, sqlQuery := range sqlQueries {
+		_, err = tx.ExecContext(ctx, sqlQuery, userID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (model UserModel) UpdatePassword(user *User) error {
+	sqlQuery := `
+UPDATE users
+SET password_hash = $2, version = version + 1
+WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, user.ID, user.Password.hash)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
 func (model UserModel) GetForToken(tokenScope, tokenPlainText string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlainText))
 
 	sqlQuery := `
-SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated
+SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated,
+	users.bio, users.avatar, users.status_text, users.status_emoji, users.status_expires_at, users.version,
+	COALESCE(users.username, ''), users.discoverability, users.is_bot
 FROM users
 INNER JOIN tokens
 ON users.id = tokens.user_id
@@ -210,6 +450,15 @@ AND tokens.expiry > $3
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Bio,
+		&user.Avatar,
+		&user.Status.Text,
+		&user.Status.Emoji,
+		&user.Status.ExpiresAt,
+		&user.Version,
+		&user.Username,
+		&user.Discoverability,
+		&user.IsBot,
 	)
 	if err != nil {
 		switch {
@@ -219,12 +468,16 @@ AND tokens.expiry > $3
 			return nil, err
 		}
 	}
+	user.normalizeProfile()
 	return &user, nil
 }
 
 func (model UserModel) GetByID(ID uuid.UUID) (*User, error) {
 	sqlQuery := `
-SELECT name, created_at, password_hash, email, activated FROM users
+SELECT name, created_at, password_hash, email, activated,
+	bio, avatar, status_text, status_emoji, status_expires_at, version,
+	COALESCE(username, ''), discoverability, is_bot
+FROM users
 WHERE id = $1
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -239,6 +492,15 @@ WHERE id = $1
 		&user.Password.hash,
 		&user.Email,
 		&user.Activated,
+		&user.Bio,
+		&user.Avatar,
+		&user.Status.Text,
+		&user.Status.Emoji,
+		&user.Status.ExpiresAt,
+		&user.Version,
+		&user.Username,
+		&user.Discoverability,
+		&user.IsBot,
 	)
 	if err != nil {
 		switch {
@@ -248,34 +510,84 @@ WHERE id = $1
 			return nil, err
 		}
 	}
+	user.normalizeProfile()
 	return &user, nil
 }
 
-func (model UserModel) GetChats(UserID uuid.UUID) ([]*ChatWithLastMessage, error) {
-	sqlQuery := `
-WITH member_counts AS (
+// ChatListFilter picks which of the user's chats GetChats lists.
+type ChatListFilter struct {
+	IncludeHidden bool
+	// Archived lists the archive instead of the main list, it is ignored
+	// when listing a folder which applies its own rules.
+	Archived bool
+	FolderID uuid.NullUUID
+}
+
+// memberCounts is a query to put in a WITH clause, it names the number of
+// members of every chat member_counts.
+const memberCounts = `member_counts AS (
   SELECT chat_id, COUNT(*) AS member_count
   FROM users_chats
   GROUP BY chat_id
-)
-SELECT users.name,mc.member_count, chats.id, chats.name, chats.owner_id, chats.created_at, chats.is_private, messages.id, messages.sent, messages.user_id, messages.type, messages.content FROM users_chats
+)`
+
+// GetChats lists the user's chats with their latest message, pinned chats
+// come first.
+func (model UserModel) GetChats(
+	UserID uuid.UUID,
+	filter ChatListFilter,
+) ([]*ChatWithLastMessage, error) {
+	sqlQuery := `
+WITH ` + memberCounts + `
+SELECT users.name,mc.member_count, chats.id, COALESCE(peers.name, NULLIF(chats.name, ''), member_names.names, ''), chats.owner_id, chats.created_at, chats.is_private, chats.join_policy, peers.id, chats.is_group_direct, chats.description, chats.topic, chats.avatar, chats.is_listed, users_chats.notifications_muted_until, users_chats.notify, users_chats.hidden, users_chats.pinned_at, users_chats.archived, messages.id, messages.sent, messages.user_id, messages.type, messages.content FROM users_chats
 JOIN chats ON chats.id = users_chats.chat_id
 JOIN users ON users.id = users_chats.user_id
 JOIN member_counts mc ON mc.chat_id = chats.id
+LEFT JOIN users peers ON chats.is_private
+	AND peers.id = CASE WHEN chats.peer_low = $1 THEN chats.peer_high ELSE chats.peer_low END
+LEFT JOIN LATERAL(
+	SELECT string_agg(others.name, ', ' ORDER BY others.name) AS names FROM users_chats others_chats
+	JOIN users others ON others.id = others_chats.user_id
+	WHERE others_chats.chat_id = chats.id
+	AND others_chats.user_id <> $1
+	AND chats.is_group_direct
+	) member_names ON TRUE
 LEFT JOIN LATERAL(
 	SELECT * FROM messages
 	WHERE messages.chat_id = chats.id
 	AND messages.deleted = false
+	AND NOT EXISTS (
+		SELECT 1 FROM user_blocks
+		WHERE user_blocks.blocker_id = $1
+		AND user_blocks.blocked_id = messages.user_id
+	)
 	ORDER BY messages.sent DESC
 	LIMIT 1
 	) messages ON TRUE
 WHERE users_chats.user_id = $1
-ORDER BY messages.sent DESC NULLS LAST
+AND chats.deleted_at IS NULL
+AND (users_chats.hidden = false OR $2)
+AND ($4::uuid IS NOT NULL OR users_chats.archived = $3)
+AND ($4::uuid IS NULL OR EXISTS (
+	SELECT TRUE FROM chat_folders folders
+	WHERE folders.id = $4
+	AND folders.user_id = $1
+	AND (
+		chats.id IN (SELECT chat_id FROM chat_folder_chats WHERE folder_id = folders.id)
+		OR (folders.include_direct AND chats.is_private AND NOT chats.is_group_direct)
+		OR (folders.include_groups AND chats.is_group_direct)
+		OR (folders.include_public AND NOT chats.is_private)
+	)
+	AND NOT (folders.exclude_muted AND COALESCE(users_chats.notifications_muted_until > NOW(), false))
+	AND NOT (folders.exclude_archived AND users_chats.archived)
+	))
+ORDER BY users_chats.pinned_at ASC NULLS LAST, messages.sent DESC NULLS LAST
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
 
-	rows, err := model.DB.QueryContext(ctx, sqlQuery, UserID)
+	args := []interface{}{UserID, filter.IncludeHidden, filter.Archived, filter.FolderID}
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -285,6 +597,7 @@ ORDER BY messages.sent DESC NULLS LAST
 
 	for rows.Next() {
 		var chatWithLastMessage ChatWithLastMessage
+		var peerID uuid.NullUUID
 		err = rows.Scan(
 			&chatWithLastMessage.LastMessage.User.Name,
 			&chatWithLastMessage.Members,
@@ -293,6 +606,18 @@ ORDER BY messages.sent DESC NULLS LAST
 			&chatWithLastMessage.Chat.OwnerID,
 			&chatWithLastMessage.Chat.CreatedAt,
 			&chatWithLastMessage.Chat.IsPrivate,
+			&chatWithLastMessage.Chat.JoinPolicy,
+			&peerID,
+			&chatWithLastMessage.Chat.IsGroupDirect,
+			&chatWithLastMessage.Chat.Description,
+			&chatWithLastMessage.Chat.Topic,
+			&chatWithLastMessage.Chat.Avatar,
+			&chatWithLastMessage.Chat.IsListed,
+			&chatWithLastMessage.Preferences.MutedUntil,
+			&chatWithLastMessage.Preferences.Notify,
+			&chatWithLastMessage.Preferences.Hidden,
+			&chatWithLastMessage.Preferences.PinnedAt,
+			&chatWithLastMessage.Preferences.Archived,
 			&chatWithLastMessage.LastMessage.Message.ID,
 			&chatWithLastMessage.LastMessage.Message.Sent.Sent,
 			&chatWithLastMessage.LastMessage.Message.UserID,
@@ -303,6 +628,10 @@ ORDER BY messages.sent DESC NULLS LAST
 			return nil, err
 		}
 		chatWithLastMessage.LastMessage.Message.ChatID = chatWithLastMessage.Chat.ID
+		if peerID.Valid {
+			chatWithLastMessage.Chat.PeerID = &peerID.UUID
+		}
+		chatWithLastMessage.Chat.HasAvatar = chatWithLastMessage.Chat.Avatar != ""
 		chatsWithLastMessage = append(chatsWithLastMessage, &chatWithLastMessage)
 	}
 
@@ -314,8 +643,10 @@ ORDER BY messages.sent DESC NULLS LAST
 func (model UserModel) IsInChat(userID, chatID uuid.UUID) error {
 	sqlQuery := `
 SELECT TRUE FROM users_chats
-WHERE user_id = $1
-AND chat_id = $2
+JOIN chats ON chats.id = users_chats.chat_id
+WHERE users_chats.user_id = $1
+AND users_chats.chat_id = $2
+AND chats.deleted_at IS NULL
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -332,7 +663,7 @@ AND chat_id = $2
 func (model UserModel) IsAdmin(userID, chatID uuid.UUID) error {
 	sqlQuery := `
 SELECT is_admin FROM users_chats
-WHERE users_id = $1
+WHERE user_id = $1
 AND chat_id = $2
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
@@ -340,20 +671,27 @@ AND chat_id = $2
 
 	var isAdmin bool
 	err := model.DB.QueryRowContext(ctx, sqlQuery, userID, chatID).Scan(&isAdmin)
-	if errors.Is(err, sql.ErrNoRows) {
-		return ErrNotInChat
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrNotInChat
+		default:
+			return err
+		}
 	}
 	if !isAdmin {
 		return ErrNotAdmin
 	}
 
-	return err
+	return nil
 }
 
 func (model UserModel) GetChatsID(UserID uuid.UUID) ([]uuid.UUID, error) {
 	sqlQuery := `
 SELECT chat_id FROM users_chats
-WHERE user_id = $1
+JOIN chats ON chats.id = users_chats.chat_id
+WHERE users_chats.user_id = $1
+AND chats.deleted_at IS NULL
 	`
 	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
 	defer cancel()
@@ -0,0 +1,606 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+
+	"github.com/mf751/gocha/internal/safehttp"
+	"github.com/mf751/gocha/internal/validator"
+)
+
+// The chat events a webhook can subscribe to.
+const (
+	WebhookNewMessage      = "new_message"
+	WebhookMemberJoined    = "member_joined"
+	WebhookMemberLeft      = "member_left"
+	WebhookReactionAdded   = "reaction_added"
+	WebhookReactionRemoved = "reaction_removed"
+)
+
+var WebhookEvents = []string{
+	WebhookNewMessage,
+	WebhookMemberJoined,
+	WebhookMemberLeft,
+	WebhookReactionAdded,
+	WebhookReactionRemoved,
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	// MaxWebhookAttempts is how many times a delivery is tried before it is
+	// given up on.
+	MaxWebhookAttempts = 10
+	// WebhookFailureLimit is how many attempts in a row may fail before the
+	// webhook is disabled.
+	WebhookFailureLimit = 20
+
+	webhookFirstRetry = 30 * time.Second
+	webhookMaxRetry   = 6 * time.Hour
+)
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// Webhook posts the chat's events it subscribed to to an outside URL, the
+// deliveries are signed with its secret.
+type Webhook struct {
+	ID           uuid.UUID  `json:"id"`
+	ChatID       uuid.UUID  `json:"chat_id"`
+	CreatedBy    uuid.UUID  `json:"created_by"`
+	URL          string     `json:"url"`
+	Secret       string     `json:"secret,omitempty"`
+	Events       []string   `json:"events"`
+	Enabled      bool       `json:"enabled"`
+	FailureCount int        `json:"failure_count"`
+	DisabledAt   *time.Time `json:"disabled_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// WebhookDelivery is one event queued for a webhook along with the outcome
+// of its latest attempt.
+type WebhookDelivery struct {
+	ID             uuid.UUID       `json:"id"`
+	WebhookID      uuid.UUID       `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time      `json:"last_attempt_at"`
+	ResponseStatus *int            `json:"response_status"`
+	Error          string          `json:"error"`
+	CreatedAt      time.Time       `json:"created_at"`
+
+	// URL and Secret are those of the webhook, they are only loaded for
+	// sending.
+	URL    string `json:"-"`
+	Secret string `json:"-"`
+}
+
+// WebhookAttempt is the outcome of sending a delivery once.
+type WebhookAttempt struct {
+	ResponseStatus int
+	Error          string
+}
+
+func (attempt WebhookAttempt) Delivered() bool {
+	return attempt.Error == "" && attempt.ResponseStatus >= 200 && attempt.ResponseStatus < 300
+}
+
+// Record notes the outcome of an attempt on the delivery and schedules the
+// next one, backing off further after every failure.
+func (delivery *WebhookDelivery) Record(attempt WebhookAttempt, now time.Time) {
+	delivery.Attempts++
+	delivery.LastAttemptAt = &now
+	delivery.Error = attempt.Error
+	if attempt.ResponseStatus != 0 {
+		delivery.ResponseStatus = &attempt.ResponseStatus
+	}
+	switch {
+	case attempt.Delivered():
+		delivery.Status = DeliveryDelivered
+	case delivery.Attempts >= MaxWebhookAttempts:
+		delivery.Status = DeliveryFailed
+	default:
+		delivery.NextAttemptAt = now.Add(WebhookBackoff(delivery.Attempts))
+	}
+	if delivery.Status != DeliveryPending {
+		delivery.NextAttemptAt = now
+	}
+}
+
+// Record counts the attempt towards the webhook's failures in a row, it
+// reports true when that disabled the webhook.
+func (webhook *Webhook) Record(attempt WebhookAttempt) bool {
+	if attempt.Delivered() {
+		webhook.FailureCount = 0
+		return false
+	}
+
+	webhook.FailureCount++
+	if webhook.Enabled && webhook.FailureCount >= WebhookFailureLimit {
+		webhook.Enabled = false
+		return true
+	}
+	return false
+}
+
+var DeliveryStatuses = []string{DeliveryPending, DeliveryDelivered, DeliveryFailed}
+
+var DeliverySortSafelist = []string{"-created_at", "created_at"}
+
+var deliverySortDirections = map[string]string{
+	"-created_at": "DESC",
+	"created_at":  "ASC",
+}
+
+type WebhookModel struct {
+	DB *sql.DB
+}
+
+func ValidateWebhook(vdtr *validator.Validator, webhook *Webhook) {
+	vdtr.Check(webhook.URL != "", "url", "must be provided")
+	vdtr.Check(len(webhook.URL) <= 2000, "url", "must not be more than 2000 bytes long")
+	if webhook.URL != "" {
+		vdtr.Check(validHTTPURL(webhook.URL), "url", "must be an absolute http or https URL")
+		if target, err := url.Parse(webhook.URL); err == nil {
+			vdtr.Check(safehttp.PublicHost(target.Hostname()), "url", "must not point at a private address")
+		}
+	}
+
+	vdtr.Check(len(webhook.Events) > 0, "events", "must contain at least one event")
+	vdtr.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate values")
+	for _, event := range webhook.Events {
+		vdtr.Check(
+			vdtr.In(event, WebhookEvents...),
+			"events",
+			"must only contain "+strings.Join(WebhookEvents, ", "),
+		)
+	}
+}
+
+// WebhookBackoff is how long to wait before trying a delivery again after
+// the given number of attempts, the wait doubles every time.
+func WebhookBackoff(attempts int) time.Duration {
+	backoff := webhookFirstRetry
+	for range attempts - 1 {
+		backoff *= 2
+		if backoff >= webhookMaxRetry {
+			return webhookMaxRetry
+		}
+	}
+	return backoff
+}
+
+func generateWebhookSecret() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
+// Insert stores the webhook with a freshly generated secret.
+func (model WebhookModel) Insert(webhook *Webhook) error {
+	var err error
+	webhook.ID = uuid.New()
+	webhook.Enabled = true
+	webhook.Secret, err = generateWebhookSecret()
+	if err != nil {
+		return err
+	}
+
+	sqlQuery := `
+INSERT INTO webhooks(id, chat_id, created_by, url, secret, events)
+VALUES($1, $2, $3, $4, $5, $6)
+RETURNING created_at
+	`
+	args := []interface{}{
+		webhook.ID,
+		webhook.ChatID,
+		webhook.CreatedBy,
+		webhook.URL,
+		webhook.Secret,
+		pq.Array(webhook.Events),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(&webhook.CreatedAt)
+}
+
+func (model WebhookModel) Get(webhookID uuid.UUID) (*Webhook, error) {
+	sqlQuery := `
+SELECT id, chat_id, COALESCE(created_by, '00000000-0000-0000-0000-000000000000'), url, events,
+	enabled, failure_count, disabled_at, created_at
+FROM webhooks
+WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var webhook Webhook
+	err := model.DB.QueryRowContext(ctx, sqlQuery, webhookID).Scan(
+		&webhook.ID,
+		&webhook.ChatID,
+		&webhook.CreatedBy,
+		&webhook.URL,
+		pq.Array(&webhook.Events),
+		&webhook.Enabled,
+		&webhook.FailureCount,
+		&webhook.DisabledAt,
+		&webhook.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrWebhookNotFound
+		default:
+			return nil, err
+		}
+	}
+	return &webhook, nil
+}
+
+func (model WebhookModel) GetAllForChat(chatID uuid.UUID) ([]*Webhook, error) {
+	sqlQuery := `
+SELECT id, chat_id, COALESCE(created_by, '00000000-0000-0000-0000-000000000000'), url, events,
+	enabled, failure_count, disabled_at, created_at
+FROM webhooks
+WHERE chat_id = $1
+ORDER BY created_at
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+	for rows.Next() {
+		var webhook Webhook
+		err = rows.Scan(
+			&webhook.ID,
+			&webhook.ChatID,
+			&webhook.CreatedBy,
+			&webhook.URL,
+			pq.Array(&webhook.Events),
+			&webhook.Enabled,
+			&webhook.FailureCount,
+			&webhook.DisabledAt,
+			&webhook.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, &webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+// Update saves the webhook's url, events and enabled flag, enabling it
+// again clears its failures.
+func (model WebhookModel) Update(webhook *Webhook) error {
+	sqlQuery := `
+UPDATE webhooks
+SET url = $2, events = $3, enabled = $4,
+	failure_count = CASE WHEN $4 AND NOT enabled THEN 0 ELSE failure_count END,
+	disabled_at = CASE WHEN $4 THEN NULL ELSE COALESCE(disabled_at, NOW()) END
+WHERE id = $1
+RETURNING failure_count, disabled_at
+	`
+	args := []interface{}{webhook.ID, webhook.URL, pq.Array(webhook.Events), webhook.Enabled}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := model.DB.QueryRowContext(ctx, sqlQuery, args...).Scan(
+		&webhook.FailureCount,
+		&webhook.DisabledAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrWebhookNotFound
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (model WebhookModel) Delete(webhookID uuid.UUID) error {
+	sqlQuery := `
+DELETE FROM webhooks
+WHERE id = $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := model.DB.ExecContext(ctx, sqlQuery, webhookID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// Enqueue queues the event for every enabled webhook of the chat that
+// subscribed to it.
+func (model WebhookModel) Enqueue(chatID uuid.UUID, event string, payload []byte) error {
+	sqlQuery := `
+SELECT id FROM webhooks
+WHERE chat_id = $1
+AND enabled = true
+AND $2 = ANY(events)
+	`
+	sqlQuery2 := `
+INSERT INTO webhook_deliveries(id, webhook_id, event, payload)
+VALUES($1, $2, $3, $4)
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, sqlQuery, chatID, event)
+	if err != nil {
+		return err
+	}
+
+	var webhookIDs []uuid.UUID
+	for rows.Next() {
+		var webhookID uuid.UUID
+		err = rows.Scan(&webhookID)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		webhookIDs = append(webhookIDs, webhookID)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, webhookID := range webhookIDs {
+		_, err = tx.ExecContext(ctx, sqlQuery2, uuid.New(), webhookID, event, payload)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Claim takes up to limit deliveries that are due. Claimed deliveries are
+// pushed back by lease so that other workers skip them, and so that they are
+// tried again should this worker die before recording the attempt.
+func (model WebhookModel) Claim(limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	sqlQuery := `
+WITH due AS (
+  SELECT webhook_deliveries.id
+  FROM webhook_deliveries
+  JOIN webhooks ON webhooks.id = webhook_deliveries.webhook_id
+  WHERE webhook_deliveries.status = 'pending'
+  AND webhook_deliveries.next_attempt_at <= NOW()
+  AND webhooks.enabled = true
+  ORDER BY webhook_deliveries.next_attempt_at
+  LIMIT $1
+  FOR UPDATE OF webhook_deliveries SKIP LOCKED
+)
+UPDATE webhook_deliveries
+SET next_attempt_at = NOW() + make_interval(secs => $2)
+FROM due, webhooks
+WHERE webhook_deliveries.id = due.id
+AND webhooks.id = webhook_deliveries.webhook_id
+RETURNING webhook_deliveries.id, webhook_deliveries.webhook_id, webhook_deliveries.event,
+	webhook_deliveries.payload, webhook_deliveries.attempts, webhook_deliveries.created_at,
+	webhooks.url, webhooks.secret
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, limit, lease.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		delivery := WebhookDelivery{Status: DeliveryPending}
+		err = rows.Scan(
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.Payload,
+			&delivery.Attempts,
+			&delivery.CreatedAt,
+			&delivery.URL,
+			&delivery.Secret,
+		)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+// RecordAttempt writes down the outcome of sending the delivery and
+// schedules the next try when it failed. Failed attempts count against the
+// webhook, which is disabled once too many fail in a row, the returned bool
+// reports that it just was.
+func (model WebhookModel) RecordAttempt(delivery *WebhookDelivery, attempt WebhookAttempt) (bool, error) {
+	sqlQuery := `
+UPDATE webhook_deliveries
+SET status = $2, attempts = $3, next_attempt_at = $4, last_attempt_at = NOW(),
+	response_status = NULLIF($5, 0), error = $6
+WHERE id = $1
+	`
+	sqlQuery2 := `
+SELECT failure_count, enabled
+FROM webhooks
+WHERE id = $1
+FOR UPDATE
+	`
+	sqlQuery3 := `
+UPDATE webhooks
+SET failure_count = $2, enabled = $3,
+	disabled_at = CASE WHEN $4 THEN NOW() ELSE disabled_at END
+WHERE id = $1
+	`
+	sqlQuery4 := `
+UPDATE webhook_deliveries
+SET status = 'failed', error = 'webhook was disabled after repeated failures'
+WHERE webhook_id = $1
+AND status = 'pending'
+	`
+	delivery.Record(attempt, time.Now())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := model.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	args := []interface{}{
+		delivery.ID,
+		delivery.Status,
+		delivery.Attempts,
+		delivery.NextAttemptAt,
+		attempt.ResponseStatus,
+		attempt.Error,
+	}
+	_, err = tx.ExecContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return false, err
+	}
+
+	webhook := Webhook{ID: delivery.WebhookID}
+	err = tx.QueryRowContext(ctx, sqlQuery2, webhook.ID).Scan(&webhook.FailureCount, &webhook.Enabled)
+	if err != nil {
+		return false, err
+	}
+
+	disabled := webhook.Record(attempt)
+	args = []interface{}{webhook.ID, webhook.FailureCount, webhook.Enabled, disabled}
+	_, err = tx.ExecContext(ctx, sqlQuery3, args...)
+	if err != nil {
+		return false, err
+	}
+
+	if disabled {
+		_, err = tx.ExecContext(ctx, sqlQuery4, webhook.ID)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return disabled, tx.Commit()
+}
+
+// Deliveries lists the webhook's delivery log, optionally only the
+// deliveries with the given status.
+func (model WebhookModel) Deliveries(
+	webhookID uuid.UUID,
+	status string,
+	filters Filters,
+) ([]*WebhookDelivery, Metadata, error) {
+	sqlQuery := fmt.Sprintf(`
+SELECT COUNT(*) OVER(), id, webhook_id, event, payload, status, attempts, next_attempt_at,
+	last_attempt_at, response_status, error, created_at
+FROM webhook_deliveries
+WHERE webhook_id = $1
+AND ($2::TEXT = '' OR status = $2::TEXT)
+ORDER BY created_at %s, id
+LIMIT $3 OFFSET $4
+	`, deliverySortDirections[filters.Sort])
+	args := []interface{}{webhookID, status, filters.limit(), filters.offset()}
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := model.DB.QueryContext(ctx, sqlQuery, args...)
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err = rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.Payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.LastAttemptAt,
+			&delivery.ResponseStatus,
+			&delivery.Error,
+			&delivery.CreatedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	return deliveries, calculateMetadata(totalRecords, filters.Page, filters.PageSize), nil
+}
+
+// PurgeDeliveries removes the log of deliveries that were settled before the
+// given time.
+func (model WebhookModel) PurgeDeliveries(before time.Time) error {
+	sqlQuery := `
+DELETE FROM webhook_deliveries
+WHERE status <> 'pending'
+AND created_at < $1
+	`
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := model.DB.ExecContext(ctx, sqlQuery, before)
+	return err
+}
@@ -0,0 +1,31 @@
+package mailer
+
+import (
+	"io"
+	"sync"
+)
+
+// Log writes the emails it is asked to send to out instead of delivering
+// them, it stands in for SMTP during development.
+type Log struct {
+	out    io.Writer
+	sender string
+	mu     sync.Mutex
+}
+
+func NewLog(out io.Writer, sender string) *Log {
+	return &Log{out: out, sender: sender}
+}
+
+func (m *Log) Send(recipient, templateFile string, data interface{}) error {
+	msg, err := build(m.sender, recipient, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err = m.out.Write(append(msg, '\n'))
+	return err
+}
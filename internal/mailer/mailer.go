@@ -0,0 +1,104 @@
+package mailer
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/textproto"
+	"time"
+)
+
+//go:embed "templates"
+var templateFS embed.FS
+
+// Mailer sends an email rendered from one of the embedded templates. Every
+// template defines a "subject", a "plainBody" and an "htmlBody" block.
+type Mailer interface {
+	Send(recipient, templateFile string, data interface{}) error
+}
+
+type email struct {
+	subject   string
+	plainBody string
+	htmlBody  string
+}
+
+func render(templateFile string, data interface{}) (*email, error) {
+	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var msg email
+	blocks := map[string]*string{
+		"subject":   &msg.subject,
+		"plainBody": &msg.plainBody,
+		"htmlBody":  &msg.htmlBody,
+	}
+	for name, out := range blocks {
+		buf := new(bytes.Buffer)
+		err = tmpl.ExecuteTemplate(buf, name, data)
+		if err != nil {
+			return nil, err
+		}
+		*out = buf.String()
+	}
+
+	return &msg, nil
+}
+
+// build renders the template into a multipart message with a plain text and
+// an HTML alternative, ready to be written to an SMTP DATA command.
+func build(sender, recipient, templateFile string, data interface{}) ([]byte, error) {
+	msg, err := render(templateFile, data)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	body := multipart.NewWriter(buf)
+
+	fmt.Fprintf(buf, "From: %s\r\n", sender)
+	fmt.Fprintf(buf, "To: %s\r\n", recipient)
+	fmt.Fprintf(buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.subject))
+	fmt.Fprintf(buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", body.Boundary())
+
+	parts := []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=UTF-8", msg.plainBody},
+		{"text/html; charset=UTF-8", msg.htmlBody},
+	}
+	for _, part := range parts {
+		w, err := body.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		qp := quotedprintable.NewWriter(w)
+		_, err = qp.Write([]byte(part.content))
+		if err != nil {
+			return nil, err
+		}
+		err = qp.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = body.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,207 @@
+package mailer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strings"
+	"testing"
+)
+
+var activationData = map[string]interface{}{
+	"name":            "Alice <script>",
+	"activationToken": "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+}
+
+// received is what the stand-in SMTP server got from a client.
+type received struct {
+	from       string
+	recipients []string
+	data       []byte
+}
+
+// fakeSMTP accepts one connection and speaks just enough SMTP for
+// net/smtp, without STARTTLS or AUTH.
+func fakeSMTP(t *testing.T) (string, <-chan received) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	done := make(chan received, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var got received
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+
+		reply("220 localhost ESMTP")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.TrimRight(line, "\r\n")
+			verb := strings.ToUpper(strings.SplitN(command, " ", 2)[0])
+
+			switch verb {
+			case "EHLO", "HELO":
+				reply("250-localhost")
+				reply("250 8BITMIME")
+			case "MAIL":
+				got.from = command
+				reply("250 OK")
+			case "RCPT":
+				got.recipients = append(got.recipients, command)
+				reply("250 OK")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data bytes.Buffer
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(line, "."))
+				}
+				got.data = data.Bytes()
+				reply("250 OK")
+			case "QUIT":
+				reply("221 Bye")
+				done <- got
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), done
+}
+
+func TestSMTPSend(t *testing.T) {
+	addr, done := fakeSMTP(t)
+	host, portString, _ := net.SplitHostPort(addr)
+	port, err := net.LookupPort("tcp", portString)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mailer := NewSMTP(host, port, "", "", "Gocha <no-reply@gocha.test>")
+	err = mailer.Send("alice@example.com", "token_activation.tmpl", activationData)
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	got := <-done
+	if !strings.HasPrefix(got.from, "MAIL FROM:<no-reply@gocha.test>") {
+		t.Errorf("got %q", got.from)
+	}
+	if len(got.recipients) != 1 || got.recipients[0] != "RCPT TO:<alice@example.com>" {
+		t.Errorf("got recipients %q", got.recipients)
+	}
+
+	checkActivationEmail(t, got.data)
+}
+
+func TestLogSend(t *testing.T) {
+	var out bytes.Buffer
+	mailer := NewLog(&out, "Gocha <no-reply@gocha.test>")
+
+	err := mailer.Send("alice@example.com", "token_activation.tmpl", activationData)
+	if err != nil {
+		t.Fatalf("send failed: %v", err)
+	}
+
+	checkActivationEmail(t, out.Bytes())
+}
+
+func TestTemplatesRender(t *testing.T) {
+	templates, err := templateFS.ReadDir("templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range templates {
+		t.Run(file.Name(), func(t *testing.T) {
+			msg, err := render(file.Name(), map[string]interface{}{})
+			if err != nil {
+				t.Fatalf("render failed: %v", err)
+			}
+			if strings.TrimSpace(msg.subject) == "" {
+				t.Error("empty subject")
+			}
+			if strings.TrimSpace(msg.plainBody) == "" || strings.TrimSpace(msg.htmlBody) == "" {
+				t.Error("empty body")
+			}
+		})
+	}
+}
+
+// checkActivationEmail parses the message and checks both alternatives
+// carry the token, and that the HTML one escaped the name.
+func checkActivationEmail(t *testing.T, raw []byte) {
+	t.Helper()
+
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("unparsable message: %v", err)
+	}
+
+	if got := msg.Header.Get("To"); got != "alice@example.com" {
+		t.Errorf("got To %q", got)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil || subject != "Activate your Gocha account" {
+		t.Errorf("got subject %q, %v", subject, err)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("got content type %q, %v", mediaType, err)
+	}
+
+	bodies := make(map[string]string)
+	parts := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		contentType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		body, err := io.ReadAll(quotedprintable.NewReader(part))
+		if err != nil {
+			t.Fatal(err)
+		}
+		bodies[contentType] = string(body)
+	}
+
+	plain, html := bodies["text/plain"], bodies["text/html"]
+	for name, body := range map[string]string{"plain": plain, "html": html} {
+		if !strings.Contains(body, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+			t.Errorf("the %s body is missing the token:\n%s", name, body)
+		}
+	}
+	if strings.Contains(html, "<script>") || !strings.Contains(html, "Alice &lt;script&gt;") {
+		t.Errorf("the html body did not escape the name:\n%s", html)
+	}
+}
@@ -0,0 +1,101 @@
+package mailer
+
+import (
+	"crypto/tls"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"time"
+)
+
+// SMTP delivers emails through an SMTP server, upgrading the connection with
+// STARTTLS when the server offers it.
+type SMTP struct {
+	host    string
+	addr    string
+	auth    smtp.Auth
+	sender  string
+	timeout time.Duration
+}
+
+func NewSMTP(host string, port int, username, password, sender string) *SMTP {
+	m := &SMTP{
+		host:    host,
+		addr:    net.JoinHostPort(host, strconv.Itoa(port)),
+		sender:  sender,
+		timeout: 10 * time.Second,
+	}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+func (m *SMTP) Send(recipient, templateFile string, data interface{}) error {
+	from, err := mail.ParseAddress(m.sender)
+	if err != nil {
+		return err
+	}
+
+	msg, err := build(m.sender, recipient, templateFile, data)
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", m.addr, m.timeout)
+	if err != nil {
+		return err
+	}
+	err = conn.SetDeadline(time.Now().Add(m.timeout))
+	if err != nil {
+		conn.Close()
+		return err
+	}
+
+	client, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		err = client.StartTLS(&tls.Config{ServerName: m.host})
+		if err != nil {
+			return err
+		}
+	}
+	if m.auth != nil {
+		if ok, _ := client.Extension("AUTH"); ok {
+			err = client.Auth(m.auth)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = client.Mail(from.Address)
+	if err != nil {
+		return err
+	}
+	err = client.Rcpt(recipient)
+	if err != nil {
+		return err
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
@@ -0,0 +1,399 @@
+// Package oidc signs users in through an OpenID Connect provider using the
+// authorization code flow with PKCE. Only what the API needs is covered:
+// discovery, the code exchange and verification of RS256 signed ID tokens.
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid ID token")
+	// ErrCodeRejected is returned when the provider refuses the authorization
+	// code, usually because it expired or was already used.
+	ErrCodeRejected = errors.New("authorization code was rejected")
+)
+
+// clockSkew is how far the provider's clock may be off from ours.
+const clockSkew = time.Minute
+
+// keysRefreshInterval limits how often an unknown key ID triggers fetching
+// the key set again.
+const keysRefreshInterval = time.Minute
+
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+}
+
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu          sync.Mutex
+	metadata    *metadata
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+type metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims are the parts of an ID token the API cares about.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      audience `json:"aud"`
+	Expiry        int64    `json:"exp"`
+	Nonce         string   `json:"nonce"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	Name          string   `json:"name"`
+}
+
+// VerifiedEmail returns the email address if the provider vouches for it,
+// and false if it does not.
+func (claims *Claims) VerifiedEmail() (string, bool) {
+	if !claims.EmailVerified || claims.Email == "" {
+		return "", false
+	}
+	return claims.Email, true
+}
+
+// audience is either a single string or a list of them.
+type audience []string
+
+func (aud *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*aud = audience{single}
+		return nil
+	}
+	var list []string
+	err := json.Unmarshal(data, &list)
+	*aud = list
+	return err
+}
+
+// New returns a provider for the config, the metadata is discovered lazily
+// so the provider does not have to be up when the server starts.
+func New(config Config, client *http.Client) *Provider {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+	if !slices.Contains(config.Scopes, "openid") {
+		config.Scopes = append([]string{"openid"}, config.Scopes...)
+	}
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	return &Provider{config: config, client: client}
+}
+
+// Issuer identifies the provider for identities linked through it.
+func (provider *Provider) Issuer() string {
+	return provider.config.Issuer
+}
+
+// RandomString returns an unguessable URL safe string, used for states,
+// nonces and PKCE verifiers.
+func RandomString() (string, error) {
+	randomBytes := make([]byte, 32)
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+func codeChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// AuthCodeURL is where the user is sent to sign in with the provider.
+func (provider *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	meta, err := provider.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {provider.config.ClientID},
+		"redirect_uri":          {provider.config.RedirectURL},
+		"scope":                 {strings.Join(provider.config.Scopes, " ")},
+		"state":                 {state},
+		"nonce":                 {nonce},
+		"code_challenge":        {codeChallenge(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(meta.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return meta.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Login exchanges the code the provider redirected back with and returns
+// the verified claims of the ID token.
+func (provider *Provider) Login(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	rawIDToken, err := provider.exchange(ctx, code, verifier)
+	if err != nil {
+		return nil, err
+	}
+	return provider.verify(ctx, rawIDToken, nonce)
+}
+
+func (provider *Provider) discover(ctx context.Context) (*metadata, error) {
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	if provider.metadata != nil {
+		return provider.metadata, nil
+	}
+
+	var meta metadata
+	err := provider.getJSON(ctx, provider.config.Issuer+"/.well-known/openid-configuration", &meta)
+	if err != nil {
+		return nil, fmt.Errorf("oidc discovery: %w", err)
+	}
+
+	if strings.TrimSuffix(meta.Issuer, "/") != provider.config.Issuer {
+		return nil, fmt.Errorf("oidc discovery: issuer %q does not match %q", meta.Issuer, provider.config.Issuer)
+	}
+	if meta.AuthorizationEndpoint == "" || meta.TokenEndpoint == "" || meta.JWKSURI == "" {
+		return nil, errors.New("oidc discovery: incomplete provider metadata")
+	}
+
+	provider.metadata = &meta
+	return provider.metadata, nil
+}
+
+func (provider *Provider) exchange(ctx context.Context, code, verifier string) (string, error) {
+	meta, err := provider.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {provider.config.RedirectURL},
+		"code_verifier": {verifier},
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, meta.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(url.QueryEscape(provider.config.ClientID), url.QueryEscape(provider.config.ClientSecret))
+
+	res, err := provider.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	err = json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(&body)
+	if err != nil {
+		return "", fmt.Errorf("oidc token exchange: %w", err)
+	}
+
+	if body.Error != "" {
+		return "", fmt.Errorf("%w: %s: %s", ErrCodeRejected, body.Error, body.ErrorDescription)
+	}
+	if res.StatusCode != http.StatusOK || body.IDToken == "" {
+		return "", fmt.Errorf("oidc token exchange: unexpected response %s", res.Status)
+	}
+	return body.IDToken, nil
+}
+
+func (provider *Provider) verify(ctx context.Context, rawIDToken, nonce string) (*Claims, error) {
+	parts := strings.Split(rawIDToken, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}
+	err := decodeSegment(parts[0], &header)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	var hash crypto.Hash
+	switch header.Algorithm {
+	case "RS256":
+		hash = crypto.SHA256
+	case "RS384":
+		hash = crypto.SHA384
+	case "RS512":
+		hash = crypto.SHA512
+	default:
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Algorithm)
+	}
+
+	key, err := provider.key(ctx, header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	hasher := hash.New()
+	hasher.Write([]byte(parts[0] + "." + parts[1]))
+	err = rsa.VerifyPKCS1v15(key, hash, hasher.Sum(nil), signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims Claims
+	err = decodeSegment(parts[1], &claims)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != provider.config.Issuer:
+		return nil, fmt.Errorf("%w: wrong issuer", ErrInvalidToken)
+	case !slices.Contains(claims.Audience, provider.config.ClientID):
+		return nil, fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+	case time.Unix(claims.Expiry, 0).Add(clockSkew).Before(time.Now()):
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: wrong nonce", ErrInvalidToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidToken)
+	}
+	return &claims, nil
+}
+
+// key looks up a signing key, fetching the key set again when the provider
+// rotated to a key we have not seen yet.
+func (provider *Provider) key(ctx context.Context, keyID string) (*rsa.PublicKey, error) {
+	meta, err := provider.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	provider.mu.Lock()
+	defer provider.mu.Unlock()
+
+	key, ok := provider.keys[keyID]
+	if ok {
+		return key, nil
+	}
+	if time.Since(provider.keysFetched) < keysRefreshInterval {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, keyID)
+	}
+
+	var set struct {
+		Keys []struct {
+			KeyType string `json:"kty"`
+			KeyID   string `json:"kid"`
+			Use     string `json:"use"`
+			N       string `json:"n"`
+			E       string `json:"e"`
+		} `json:"keys"`
+	}
+	err = provider.getJSON(ctx, meta.JWKSURI, &set)
+	if err != nil {
+		return nil, fmt.Errorf("oidc keys: %w", err)
+	}
+
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range set.Keys {
+		if jwk.KeyType != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) > 4 {
+			continue
+		}
+
+		keys[jwk.KeyID] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+
+	provider.keys = keys
+	provider.keysFetched = time.Now()
+
+	key, ok = keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown key %q", ErrInvalidToken, keyID)
+	}
+	return key, nil
+}
+
+func (provider *Provider) getJSON(ctx context.Context, url string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := provider.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected response %s from %s", res.Status, url)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(dst)
+}
+
+func decodeSegment(segment string, dst interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, dst)
+}
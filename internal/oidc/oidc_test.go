@@ -0,0 +1,252 @@
+package oidc
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testClientID = "gocha-test"
+	testKeyID    = "test-key"
+	testNonce    = "test-nonce"
+	testVerifier = "test-verifier"
+)
+
+// testIdP is a stand-in provider that serves discovery, its key set and a
+// token endpoint handing out whichever ID token the test set last.
+type testIdP struct {
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu      sync.Mutex
+	idToken string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := &testIdP{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		e := big.NewInt(int64(key.PublicKey.E)).Bytes()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": testKeyID,
+				"use": "sig",
+				"alg": "RS256",
+				"n":   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(e),
+			}},
+		})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		if r.PostForm.Get("code") != "good-code" || r.PostForm.Get("code_verifier") != testVerifier {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		idp.mu.Lock()
+		idToken := idp.idToken
+		idp.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+	})
+
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+func (idp *testIdP) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            idp.server.URL,
+		"sub":            "user-1",
+		"aud":            testClientID,
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"nonce":          testNonce,
+		"email":          "alice@example.com",
+		"email_verified": true,
+		"name":           "Alice",
+	}
+}
+
+func (idp *testIdP) sign(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "kid": testKeyID, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." +
+		base64.RawURLEncoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func (idp *testIdP) setIDToken(idToken string) {
+	idp.mu.Lock()
+	defer idp.mu.Unlock()
+	idp.idToken = idToken
+}
+
+func TestLogin(t *testing.T) {
+	idp := newTestIdP(t)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		key     *rsa.PrivateKey
+		change  func(claims map[string]interface{})
+		code    string
+		wantErr error
+	}{
+		{name: "valid"},
+		{name: "bad signature", key: otherKey, wantErr: ErrInvalidToken},
+		{
+			name:    "wrong nonce",
+			change:  func(claims map[string]interface{}) { claims["nonce"] = "other-nonce" },
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "wrong audience",
+			change:  func(claims map[string]interface{}) { claims["aud"] = []string{"someone-else"} },
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name: "expired",
+			change: func(claims map[string]interface{}) {
+				claims["exp"] = time.Now().Add(-clockSkew - time.Minute).Unix()
+			},
+			wantErr: ErrInvalidToken,
+		},
+		{
+			name:    "wrong issuer",
+			change:  func(claims map[string]interface{}) { claims["iss"] = "https://evil.example.com" },
+			wantErr: ErrInvalidToken,
+		},
+		{name: "rejected code", code: "bad-code", wantErr: ErrCodeRejected},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			key := test.key
+			if key == nil {
+				key = idp.key
+			}
+			claims := idp.claims()
+			if test.change != nil {
+				test.change(claims)
+			}
+			idp.setIDToken(idp.sign(t, key, claims))
+
+			code := test.code
+			if code == "" {
+				code = "good-code"
+			}
+
+			provider := New(Config{Issuer: idp.server.URL, ClientID: testClientID}, idp.server.Client())
+			got, err := provider.Login(context.Background(), code, testVerifier, testNonce)
+
+			if test.wantErr != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("got error %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got.Subject != "user-1" {
+				t.Errorf("got subject %q, want %q", got.Subject, "user-1")
+			}
+			if email, ok := got.VerifiedEmail(); !ok || email != "alice@example.com" {
+				t.Errorf("got verified email %q %v, want %q true", email, ok, "alice@example.com")
+			}
+		})
+	}
+}
+
+func TestLoginUnverifiedEmail(t *testing.T) {
+	idp := newTestIdP(t)
+
+	claims := idp.claims()
+	claims["email_verified"] = false
+	idp.setIDToken(idp.sign(t, idp.key, claims))
+
+	provider := New(Config{Issuer: idp.server.URL, ClientID: testClientID}, idp.server.Client())
+	got, err := provider.Login(context.Background(), "good-code", testVerifier, testNonce)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the token itself is fine, the email must just not be trusted
+	if email, ok := got.VerifiedEmail(); ok {
+		t.Errorf("got verified email %q for an unverified address", email)
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	idp := newTestIdP(t)
+
+	provider := New(Config{Issuer: idp.server.URL, ClientID: testClientID}, idp.server.Client())
+	authURL, err := provider.AuthCodeURL(context.Background(), "state", testNonce, testVerifier)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := idp.server.URL + "/authorize?"
+	if !strings.HasPrefix(authURL, want) {
+		t.Fatalf("got %q, want it to start with %q", authURL, want)
+	}
+	for _, part := range []string{
+		"code_challenge=" + codeChallenge(testVerifier),
+		"code_challenge_method=S256",
+		"nonce=" + testNonce,
+		"scope=openid+email+profile",
+	} {
+		if !strings.Contains(authURL, part) {
+			t.Errorf("%q does not contain %q", authURL, part)
+		}
+	}
+}
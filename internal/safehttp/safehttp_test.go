@@ -0,0 +1,94 @@
+package safehttp
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPublicAddr(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"224.0.0.1", false},
+		{"::1", false},
+		{"::", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:169.254.169.254", false},
+		{"64:ff9b::a9fe:a9fe", false},
+	}
+
+	for _, test := range tests {
+		if got := PublicAddr(netip.MustParseAddr(test.addr)); got != test.want {
+			t.Errorf("PublicAddr(%s) = %v, want %v", test.addr, got, test.want)
+		}
+	}
+}
+
+func TestPublicHost(t *testing.T) {
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"93.184.216.34", true},
+		{"localhost", false},
+		{"LOCALHOST.", false},
+		{"api.localhost", false},
+		{"127.0.0.1", false},
+		{"[::1]", false},
+		{"169.254.169.254", false},
+	}
+
+	for _, test := range tests {
+		if got := PublicHost(test.host); got != test.want {
+			t.Errorf("PublicHost(%q) = %v, want %v", test.host, got, test.want)
+		}
+	}
+}
+
+func TestClientRefusesPrivateAddresses(t *testing.T) {
+	var reached atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Store(true)
+	}))
+	defer server.Close()
+
+	client := NewClient(5 * time.Second)
+
+	// a name that resolves to loopback is stopped when dialing as well
+	urls := []string{
+		server.URL,
+		strings.Replace(server.URL, "127.0.0.1", "localhost", 1),
+	}
+	for _, url := range urls {
+		res, err := client.Post(url, "application/json", strings.NewReader(`{}`))
+		if err == nil {
+			res.Body.Close()
+			t.Fatalf("request to %s succeeded", url)
+		}
+		if !errors.Is(err, ErrBlockedAddress) {
+			t.Errorf("request to %s: got error %v, want %v", url, err, ErrBlockedAddress)
+		}
+	}
+	if reached.Load() {
+		t.Error("the private server was reached")
+	}
+}
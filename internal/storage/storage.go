@@ -0,0 +1,82 @@
+package storage
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+var ErrUnsupportedImage = errors.New("unsupported image type")
+
+var imageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// Disk keeps uploaded files under a root directory on the local disk.
+type Disk struct {
+	root string
+}
+
+func New(root string) (*Disk, error) {
+	err := os.MkdirAll(root, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &Disk{root: root}, nil
+}
+
+// Path resolves a stored file name to its location on disk, names can never
+// point outside of the root directory.
+func (disk *Disk) Path(name string) string {
+	return filepath.Join(disk.root, filepath.Clean("/"+name))
+}
+
+// SaveImage sniffs the content type of an image and stores it as dir/name
+// with the matching extension, returning the stored file name.
+func (disk *Disk) SaveImage(dir, name string, content []byte) (string, error) {
+	extension, ok := imageExtensions[http.DetectContentType(content)]
+	if !ok {
+		return "", ErrUnsupportedImage
+	}
+
+	return disk.Save(filepath.Join(dir, name+extension), content)
+}
+
+// Save writes the content to the given file name, replacing any previous file.
+func (disk *Disk) Save(name string, content []byte) (string, error) {
+	path := disk.Path(name)
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return "", err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(temp.Name())
+
+	_, err = temp.Write(content)
+	if err != nil {
+		temp.Close()
+		return "", err
+	}
+	err = temp.Close()
+	if err != nil {
+		return "", err
+	}
+
+	return name, os.Rename(temp.Name(), path)
+}
+
+func (disk *Disk) Delete(name string) error {
+	err := os.Remove(disk.Path(name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
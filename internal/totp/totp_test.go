@@ -0,0 +1,126 @@
+package totp
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 seed of RFC 6238 Appendix B, "12345678901234567890".
+var rfcSecret = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+func TestCodeRFC6238(t *testing.T) {
+	// the RFC lists eight digit codes, six digit ones are their last six
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+		{20000000000, "65353130"},
+	}
+
+	for _, test := range tests {
+		got, err := Code(rfcSecret, Step(time.Unix(test.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := test.want[len(test.want)-Digits:]; got != want {
+			t.Errorf("Code at %d = %s, want %s", test.unix, got, want)
+		}
+	}
+}
+
+func TestCodeLowercaseSecret(t *testing.T) {
+	got, err := Code(strings.ToLower(rfcSecret), Step(time.Unix(59, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "287082" {
+		t.Errorf("got %s, want 287082", got)
+	}
+}
+
+func TestValidateSkew(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	current := Step(now)
+
+	tests := []struct {
+		name   string
+		offset int64
+		want   bool
+	}{
+		{"two steps behind", -2, false},
+		{"one step behind", -1, true},
+		{"current step", 0, true},
+		{"one step ahead", 1, true},
+		{"two steps ahead", 2, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			code, err := Code(rfcSecret, current+test.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			step, ok := Validate(rfcSecret, code, now)
+			if ok != test.want {
+				t.Fatalf("got %v, want %v", ok, test.want)
+			}
+			if ok && step != current+test.offset {
+				t.Errorf("got step %d, want %d", step, current+test.offset)
+			}
+		})
+	}
+}
+
+func TestValidateRejectsMalformedCodes(t *testing.T) {
+	now := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870820", "94287082"} {
+		if _, ok := Validate(rfcSecret, code, now); ok {
+			t.Errorf("code %q was accepted", code)
+		}
+	}
+}
+
+func TestValidateAfterRejectsReplay(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	code, err := Code(rfcSecret, Step(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step, ok := ValidateAfter(rfcSecret, code, now, 0)
+	if !ok {
+		t.Fatal("a fresh code was refused")
+	}
+
+	// the same code again, also once the clock moved on within the window
+	for _, at := range []time.Time{now, now.Add(Period)} {
+		if _, ok := ValidateAfter(rfcSecret, code, at, step); ok {
+			t.Errorf("the code was accepted again at %s", at)
+		}
+	}
+
+	// an earlier code that is still in the window is refused too
+	earlier, err := Code(rfcSecret, step-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ValidateAfter(rfcSecret, earlier, now, step); ok {
+		t.Error("a code older than the last used one was accepted")
+	}
+
+	next, err := Code(rfcSecret, step+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := ValidateAfter(rfcSecret, next, now.Add(Period), step); !ok {
+		t.Error("the next step's code was refused")
+	}
+}
@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS chat_bans;
+ALTER TABLE users_chats DROP COLUMN IF EXISTS muted_until;
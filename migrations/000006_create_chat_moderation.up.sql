@@ -0,0 +1,9 @@
+ALTER TABLE users_chats ADD COLUMN IF NOT EXISTS muted_until TIMESTAMP(0) WITH TIME ZONE;
+
+CREATE TABLE IF NOT EXISTS chat_bans (
+  chat_id UUID NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+  user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  banned_by UUID REFERENCES users (id) ON DELETE SET NULL,
+  created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (chat_id, user_id)
+);
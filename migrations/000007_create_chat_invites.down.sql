@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS chat_join_requests;
+DROP TABLE IF EXISTS chat_invites;
+ALTER TABLE chats DROP COLUMN IF EXISTS join_policy;
@@ -0,0 +1,20 @@
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS join_policy TEXT NOT NULL DEFAULT 'open';
+
+CREATE TABLE IF NOT EXISTS chat_invites (
+  id UUID PRIMARY KEY,
+  hash BYTEA UNIQUE NOT NULL,
+  chat_id UUID NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+  created_by UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  expiry TIMESTAMP(0) WITH TIME ZONE,
+  max_uses INT NOT NULL DEFAULT 0,
+  uses INT NOT NULL DEFAULT 0,
+  revoked BOOL NOT NULL DEFAULT FALSE
+);
+
+CREATE TABLE IF NOT EXISTS chat_join_requests (
+  chat_id UUID NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+  user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (chat_id, user_id)
+);
@@ -0,0 +1,7 @@
+-- Irreversible: the up migration gave every direct chat a new id, merged the
+-- chats between the same two users and added both of them as members, none of
+-- which can be undone. This only drops the new columns, the chats keep their
+-- new ids and members and restoring a backup is the only way back.
+DROP INDEX IF EXISTS chats_direct_peers_idx;
+ALTER TABLE chats DROP COLUMN IF EXISTS peer_high;
+ALTER TABLE chats DROP COLUMN IF EXISTS peer_low;
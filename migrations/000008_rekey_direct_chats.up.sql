@@ -0,0 +1,47 @@
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS peer_low UUID REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS peer_high UUID REFERENCES users (id) ON DELETE CASCADE;
+
+-- Private chats used to be keyed by the recipient's user id. Give every
+-- conversation its own id, merge conversations between the same two users
+-- and make both of them members.
+CREATE TEMPORARY TABLE direct_rekey AS
+SELECT
+  id AS old_id,
+  LEAST(owner_id, id) AS peer_low,
+  GREATEST(owner_id, id) AS peer_high,
+  FIRST_VALUE(id) OVER (
+    PARTITION BY LEAST(owner_id, id), GREATEST(owner_id, id)
+    ORDER BY created_at, id
+  ) AS keep_id,
+  NULL::UUID AS new_id
+FROM chats
+WHERE is_private AND peer_low IS NULL AND id IN (SELECT id FROM users);
+
+UPDATE direct_rekey
+SET new_id = keys.new_id
+FROM (SELECT keep_id, gen_random_uuid() AS new_id FROM direct_rekey GROUP BY keep_id) keys
+WHERE direct_rekey.keep_id = keys.keep_id;
+
+INSERT INTO chats (id, name, created_at, owner_id, is_private, join_policy, peer_low, peer_high)
+SELECT DISTINCT ON (direct_rekey.new_id)
+  direct_rekey.new_id, chats.name, chats.created_at, chats.owner_id, TRUE, chats.join_policy,
+  direct_rekey.peer_low, direct_rekey.peer_high
+FROM direct_rekey
+JOIN chats ON chats.id = direct_rekey.keep_id;
+
+UPDATE messages
+SET chat_id = direct_rekey.new_id
+FROM direct_rekey
+WHERE messages.chat_id = direct_rekey.old_id;
+
+INSERT INTO users_chats (chat_id, user_id, is_admin)
+SELECT new_id, peer_low, FALSE FROM direct_rekey
+UNION
+SELECT new_id, peer_high, FALSE FROM direct_rekey
+ON CONFLICT DO NOTHING;
+
+DELETE FROM chats WHERE id IN (SELECT old_id FROM direct_rekey);
+
+DROP TABLE direct_rekey;
+
+CREATE UNIQUE INDEX IF NOT EXISTS chats_direct_peers_idx ON chats (peer_low, peer_high) WHERE is_private;
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS chats_member_key_idx;
+ALTER TABLE chats DROP COLUMN IF EXISTS member_key;
+ALTER TABLE chats DROP COLUMN IF EXISTS is_group_direct;
@@ -0,0 +1,4 @@
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS is_group_direct BOOL NOT NULL DEFAULT FALSE;
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS member_key TEXT;
+
+CREATE UNIQUE INDEX IF NOT EXISTS chats_member_key_idx ON chats (member_key) WHERE member_key IS NOT NULL;
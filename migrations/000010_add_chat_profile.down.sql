@@ -0,0 +1,3 @@
+ALTER TABLE chats DROP COLUMN IF EXISTS avatar;
+ALTER TABLE chats DROP COLUMN IF EXISTS topic;
+ALTER TABLE chats DROP COLUMN IF EXISTS description;
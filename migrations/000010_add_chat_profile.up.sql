@@ -0,0 +1,3 @@
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS topic TEXT NOT NULL DEFAULT '';
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS avatar TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS messages_chat_id_sent_idx;
+ALTER TABLE chats DROP COLUMN IF EXISTS is_listed;
@@ -0,0 +1,3 @@
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS is_listed BOOL NOT NULL DEFAULT TRUE;
+
+CREATE INDEX IF NOT EXISTS messages_chat_id_sent_idx ON messages (chat_id, sent);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS chats_deleted_at_idx;
+ALTER TABLE chats DROP COLUMN IF EXISTS deleted_at;
+ALTER TABLE users_chats DROP COLUMN IF EXISTS joined_at;
@@ -0,0 +1,4 @@
+ALTER TABLE users_chats ADD COLUMN IF NOT EXISTS joined_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW();
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP(0) WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS chats_deleted_at_idx ON chats (deleted_at) WHERE deleted_at IS NOT NULL;
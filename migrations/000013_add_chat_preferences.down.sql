@@ -0,0 +1,3 @@
+ALTER TABLE users_chats DROP COLUMN IF EXISTS hidden;
+ALTER TABLE users_chats DROP COLUMN IF EXISTS notify;
+ALTER TABLE users_chats DROP COLUMN IF EXISTS notifications_muted_until;
@@ -0,0 +1,3 @@
+ALTER TABLE users_chats ADD COLUMN IF NOT EXISTS notifications_muted_until TIMESTAMP(0) WITH TIME ZONE;
+ALTER TABLE users_chats ADD COLUMN IF NOT EXISTS notify TEXT NOT NULL DEFAULT 'all';
+ALTER TABLE users_chats ADD COLUMN IF NOT EXISTS hidden BOOL NOT NULL DEFAULT FALSE;
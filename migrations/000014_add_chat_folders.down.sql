@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS chat_folder_chats;
+DROP TABLE IF EXISTS chat_folders;
+ALTER TABLE users_chats DROP COLUMN IF EXISTS archived;
+ALTER TABLE users_chats DROP COLUMN IF EXISTS pinned_at;
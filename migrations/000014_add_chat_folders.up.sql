@@ -0,0 +1,22 @@
+ALTER TABLE users_chats ADD COLUMN IF NOT EXISTS pinned_at TIMESTAMP(0) WITH TIME ZONE;
+ALTER TABLE users_chats ADD COLUMN IF NOT EXISTS archived BOOL NOT NULL DEFAULT FALSE;
+
+CREATE TABLE IF NOT EXISTS chat_folders (
+  id UUID PRIMARY KEY,
+  user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  name TEXT NOT NULL,
+  include_direct BOOL NOT NULL DEFAULT FALSE,
+  include_groups BOOL NOT NULL DEFAULT FALSE,
+  include_public BOOL NOT NULL DEFAULT FALSE,
+  exclude_muted BOOL NOT NULL DEFAULT FALSE,
+  exclude_archived BOOL NOT NULL DEFAULT FALSE,
+  created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS chat_folders_user_id_idx ON chat_folders(user_id);
+
+CREATE TABLE IF NOT EXISTS chat_folder_chats (
+  folder_id UUID NOT NULL REFERENCES chat_folders (id) ON DELETE CASCADE,
+  chat_id UUID NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+  PRIMARY KEY (folder_id, chat_id)
+);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS message_reactions;
+DROP INDEX IF EXISTS messages_chat_id_user_id_sent_idx;
+ALTER TABLE chats DROP COLUMN IF EXISTS announcement_only;
+ALTER TABLE chats DROP COLUMN IF EXISTS slow_mode_seconds;
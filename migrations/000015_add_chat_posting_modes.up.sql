@@ -0,0 +1,12 @@
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS slow_mode_seconds INT NOT NULL DEFAULT 0;
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS announcement_only BOOL NOT NULL DEFAULT FALSE;
+
+CREATE INDEX IF NOT EXISTS messages_chat_id_user_id_sent_idx ON messages (chat_id, user_id, sent);
+
+CREATE TABLE IF NOT EXISTS message_reactions (
+  message_id UUID NOT NULL REFERENCES messages (id) ON DELETE CASCADE,
+  user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  emoji TEXT NOT NULL,
+  created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  PRIMARY KEY (message_id, user_id, emoji)
+);
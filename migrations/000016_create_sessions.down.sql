@@ -0,0 +1,2 @@
+ALTER TABLE tokens DROP COLUMN IF EXISTS session_id;
+DROP TABLE IF EXISTS sessions;
@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS sessions (
+  id UUID PRIMARY KEY,
+  user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  device_name TEXT NOT NULL DEFAULT '',
+  ip TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  last_used_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS sessions_user_id_idx ON sessions (user_id);
+
+-- authentication tokens now always belong to a session
+DELETE FROM tokens WHERE scope = 'authentication';
+ALTER TABLE tokens ADD COLUMN IF NOT EXISTS session_id UUID REFERENCES sessions (id) ON DELETE CASCADE;
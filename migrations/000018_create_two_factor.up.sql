@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS user_totp (
+  user_id UUID PRIMARY KEY REFERENCES users (id) ON DELETE CASCADE,
+  secret TEXT NOT NULL,
+  confirmed BOOL NOT NULL DEFAULT FALSE,
+  last_used_step BIGINT NOT NULL DEFAULT 0,
+  failed_attempts INT NOT NULL DEFAULT 0,
+  created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+  user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  hash BYTEA NOT NULL,
+  used_at TIMESTAMP(0) WITH TIME ZONE,
+  PRIMARY KEY (user_id, hash)
+);
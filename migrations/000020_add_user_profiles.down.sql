@@ -0,0 +1,6 @@
+ALTER TABLE users DROP COLUMN IF EXISTS status_expires_at;
+ALTER TABLE users DROP COLUMN IF EXISTS status_emoji;
+ALTER TABLE users DROP COLUMN IF EXISTS status_text;
+ALTER TABLE users DROP COLUMN IF EXISTS avatar;
+ALTER TABLE users DROP COLUMN IF EXISTS bio;
+ALTER TABLE users DROP COLUMN IF EXISTS version;
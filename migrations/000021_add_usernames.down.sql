@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS users_name_trgm_idx;
+DROP INDEX IF EXISTS users_username_trgm_idx;
+
+ALTER TABLE users DROP COLUMN IF EXISTS discoverability;
+ALTER TABLE users DROP COLUMN IF EXISTS username;
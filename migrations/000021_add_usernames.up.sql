@@ -0,0 +1,7 @@
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS username CITEXT UNIQUE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS discoverability TEXT NOT NULL DEFAULT 'everyone';
+
+CREATE INDEX IF NOT EXISTS users_username_trgm_idx ON users USING GIN ((username::TEXT) gin_trgm_ops);
+CREATE INDEX IF NOT EXISTS users_name_trgm_idx ON users USING GIN (name gin_trgm_ops);
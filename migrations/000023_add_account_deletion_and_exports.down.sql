@@ -0,0 +1,12 @@
+DROP TABLE IF EXISTS user_exports;
+
+ALTER TABLE chats DROP CONSTRAINT IF EXISTS chats_owner_id_fkey;
+ALTER TABLE chats ADD CONSTRAINT chats_owner_id_fkey
+  FOREIGN KEY (owner_id) REFERENCES users (id) ON DELETE CASCADE;
+
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_user_id_fkey;
+ALTER TABLE messages ADD CONSTRAINT messages_user_id_fkey
+  FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+
+ALTER TABLE users DROP COLUMN IF EXISTS anonymized_at;
+ALTER TABLE users DROP COLUMN IF EXISTS deleted_at;
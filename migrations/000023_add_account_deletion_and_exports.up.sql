@@ -0,0 +1,24 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP(0) WITH TIME ZONE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS anonymized_at TIMESTAMP(0) WITH TIME ZONE;
+
+-- deleted accounts are anonymized instead of removed, a stray DELETE must
+-- not take their messages out of other people's chats
+ALTER TABLE messages DROP CONSTRAINT IF EXISTS messages_user_id_fkey;
+ALTER TABLE messages ADD CONSTRAINT messages_user_id_fkey
+  FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE RESTRICT;
+
+ALTER TABLE chats DROP CONSTRAINT IF EXISTS chats_owner_id_fkey;
+ALTER TABLE chats ADD CONSTRAINT chats_owner_id_fkey
+  FOREIGN KEY (owner_id) REFERENCES users (id) ON DELETE RESTRICT;
+
+CREATE TABLE IF NOT EXISTS user_exports (
+  id UUID PRIMARY KEY,
+  user_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  status TEXT NOT NULL DEFAULT 'pending',
+  file TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  completed_at TIMESTAMP(0) WITH TIME ZONE,
+  expires_at TIMESTAMP(0) WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS user_exports_user_id_idx ON user_exports (user_id, created_at);
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS api_keys;
+
+DROP INDEX IF EXISTS users_bot_owner_id_idx;
+ALTER TABLE users DROP COLUMN IF EXISTS bot_owner_id;
+ALTER TABLE users DROP COLUMN IF EXISTS is_bot;
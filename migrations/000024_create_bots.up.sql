@@ -0,0 +1,18 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS is_bot BOOL NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS bot_owner_id UUID REFERENCES users (id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS users_bot_owner_id_idx ON users (bot_owner_id);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+  id UUID PRIMARY KEY,
+  bot_id UUID NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+  name TEXT NOT NULL DEFAULT '',
+  hash BYTEA UNIQUE NOT NULL,
+  chat_ids UUID[] NOT NULL DEFAULT '{}',
+  permissions TEXT[] NOT NULL DEFAULT '{}',
+  created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  last_used_at TIMESTAMP(0) WITH TIME ZONE,
+  expiry TIMESTAMP(0) WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS api_keys_bot_id_idx ON api_keys (bot_id);
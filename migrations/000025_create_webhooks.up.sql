@@ -0,0 +1,32 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+  id UUID PRIMARY KEY,
+  chat_id UUID NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+  created_by UUID REFERENCES users (id) ON DELETE SET NULL,
+  url TEXT NOT NULL,
+  secret TEXT NOT NULL,
+  events TEXT[] NOT NULL,
+  enabled BOOL NOT NULL DEFAULT TRUE,
+  failure_count INTEGER NOT NULL DEFAULT 0,
+  disabled_at TIMESTAMP(0) WITH TIME ZONE,
+  created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS webhooks_chat_id_idx ON webhooks (chat_id);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id UUID PRIMARY KEY,
+  webhook_id UUID NOT NULL REFERENCES webhooks (id) ON DELETE CASCADE,
+  event TEXT NOT NULL,
+  payload JSONB NOT NULL,
+  status TEXT NOT NULL DEFAULT 'pending',
+  attempts INTEGER NOT NULL DEFAULT 0,
+  next_attempt_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  last_attempt_at TIMESTAMP(0) WITH TIME ZONE,
+  response_status INTEGER,
+  error TEXT NOT NULL DEFAULT '',
+  created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook_id_idx ON webhook_deliveries (webhook_id, created_at);
+CREATE INDEX IF NOT EXISTS webhook_deliveries_pending_idx ON webhook_deliveries (next_attempt_at)
+  WHERE status = 'pending';
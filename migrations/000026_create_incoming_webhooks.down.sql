@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS incoming_webhooks;
+
+ALTER TABLE messages DROP COLUMN IF EXISTS attachments;
+ALTER TABLE messages DROP COLUMN IF EXISTS display_avatar;
+ALTER TABLE messages DROP COLUMN IF EXISTS display_name;
@@ -0,0 +1,17 @@
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS display_avatar TEXT NOT NULL DEFAULT '';
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS attachments JSONB NOT NULL DEFAULT '[]';
+
+-- every incoming webhook posts as its own bot account
+CREATE TABLE IF NOT EXISTS incoming_webhooks (
+  id UUID PRIMARY KEY,
+  chat_id UUID NOT NULL REFERENCES chats (id) ON DELETE CASCADE,
+  user_id UUID NOT NULL REFERENCES users (id),
+  created_by UUID REFERENCES users (id) ON DELETE SET NULL,
+  name TEXT NOT NULL,
+  token_hash BYTEA UNIQUE NOT NULL,
+  created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT NOW(),
+  last_used_at TIMESTAMP(0) WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS incoming_webhooks_chat_id_idx ON incoming_webhooks (chat_id);
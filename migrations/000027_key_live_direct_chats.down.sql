@@ -0,0 +1,7 @@
+-- Fails while a deleted conversation and its replacement both exist, purge
+-- or delete one of them first.
+DROP INDEX IF EXISTS chats_member_key_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS chats_member_key_idx ON chats (member_key) WHERE member_key IS NOT NULL;
+
+DROP INDEX IF EXISTS chats_direct_peers_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS chats_direct_peers_idx ON chats (peer_low, peer_high) WHERE is_private;
@@ -0,0 +1,9 @@
+-- A deleted conversation no longer holds on to its members, opening it again
+-- starts a new chat while the deleted one stays restorable until purged.
+DROP INDEX IF EXISTS chats_direct_peers_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS chats_direct_peers_idx ON chats (peer_low, peer_high)
+WHERE is_private AND deleted_at IS NULL;
+
+DROP INDEX IF EXISTS chats_member_key_idx;
+CREATE UNIQUE INDEX IF NOT EXISTS chats_member_key_idx ON chats (member_key)
+WHERE member_key IS NOT NULL AND deleted_at IS NULL;